@@ -8,7 +8,7 @@ import (
 )
 
 func benchmarkSet(b *testing.B, item *Item) {
-	cmd, c := newUnixServer(b)
+	c := newUnixServer(b)
 	b.SetBytes(int64(len(item.Key) + len(item.Value)))
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -16,13 +16,10 @@ func benchmarkSet(b *testing.B, item *Item) {
 			b.Fatal(err)
 		}
 	}
-	b.StopTimer()
-	cmd.Process.Kill()
-	cmd.Wait()
 }
 
 func benchmarkSetGet(b *testing.B, item *Item) {
-	cmd, c := newUnixServer(b)
+	c := newUnixServer(b)
 	key := item.Key
 	b.SetBytes(int64(len(item.Key) + len(item.Value)))
 	b.ResetTimer()
@@ -34,9 +31,6 @@ func benchmarkSetGet(b *testing.B, item *Item) {
 			b.Fatal(err)
 		}
 	}
-	b.StopTimer()
-	cmd.Process.Kill()
-	cmd.Wait()
 }
 
 func largeItem() *Item {
@@ -69,7 +63,7 @@ func benchmarkConcurrentSetGet(b *testing.B, item *Item, count int, opcount int)
 	mp := runtime.GOMAXPROCS(0)
 	defer runtime.GOMAXPROCS(mp)
 	runtime.GOMAXPROCS(count)
-	cmd, c := newUnixServer(b)
+	c := newUnixServer(b)
 	// Items are not thread safe
 	items := make([]*Item, count)
 	for ii := range items {
@@ -87,24 +81,23 @@ func benchmarkConcurrentSetGet(b *testing.B, item *Item, count int, opcount int)
 				defer wg.Done()
 				for k := 0; k < opcount; k++ {
 					if err := c.Set(it); err != nil {
-						b.Fatal(err)
+						b.Error(err)
+						return
 					}
 					if _, err := c.Get(key); err != nil {
-						b.Fatal(err)
+						b.Error(err)
+						return
 					}
 				}
 			}()
 		}
 		wg.Wait()
 	}
-	b.StopTimer()
-	cmd.Process.Kill()
-	cmd.Wait()
 }
 
 func BenchmarkGetCacheMiss(b *testing.B) {
 	key := "not"
-	cmd, c := newUnixServer(b)
+	c := newUnixServer(b)
 	c.Delete(key)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -112,9 +105,6 @@ func BenchmarkGetCacheMiss(b *testing.B) {
 			b.Fatal(err)
 		}
 	}
-	b.StopTimer()
-	cmd.Process.Kill()
-	cmd.Wait()
 }
 
 func BenchmarkConcurrentSetGetSmall10_100(b *testing.B) {
@@ -0,0 +1,319 @@
+package memcache
+
+// binaryCodec speaks the binary protocol.
+type binaryCodec struct{}
+
+func (binaryCodec) get(cn *poolConn, req *request, key string) (*Item, error) {
+	return binaryRetrieve(cn, req, cmdGet, key, nil)
+}
+
+func (binaryCodec) getAndTouch(cn *poolConn, req *request, key string, expiration int32) (*Item, error) {
+	extras := make([]byte, 4)
+	putUint32(extras, uint32(expiration))
+	return binaryRetrieve(cn, req, cmdGAT, key, extras)
+}
+
+func binaryRetrieve(cn *poolConn, req *request, cmd command, key string, extras []byte) (*Item, error) {
+	if err := sendConnCommand(cn, key, cmd, nil, 0, extras); err != nil {
+		return nil, err
+	}
+	req.sent()
+	hdr, k, extras, value, err := parseResponse(key, cn, cn.maxBody)
+	if err != nil {
+		return nil, err
+	}
+	flags, err := itemFlags(extras)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" && len(k) > 0 {
+		key = string(k)
+	}
+	return &Item{
+		Key:   key,
+		Value: value,
+		Flags: flags,
+		casid: bUint64(hdr[16:24]),
+	}, nil
+}
+
+// getMulti pipelines a quiet get for each key, terminated by a noop.
+// Keys too long to be encoded are skipped, as misses.
+func (binaryCodec) getMulti(cn *poolConn, req *request, keys []string, found func(*Item)) error {
+	for ii, k := range keys {
+		if len(k) > 0xffff {
+			continue
+		}
+		if err := sendConnCommandOpaque(cn, k, cmdGetKQ, nil, 0, nil, uint32(ii)); err != nil {
+			return err
+		}
+	}
+	if err := sendConnCommandOpaque(cn, "", cmdNoop, nil, 0, nil, uint32(len(keys))); err != nil {
+		return err
+	}
+	req.sent()
+	for {
+		hdr, k, extras, value, err := parseResponse("", cn, cn.maxBody)
+		if hdr == nil {
+			return err
+		}
+		index, perr := pipelineIndex(hdr, cmdGetKQ, len(keys))
+		if perr != nil {
+			return perr
+		}
+		if index == len(keys) {
+			return nil
+		}
+		if err != nil {
+			// Failure for a single key, such as a malformed one.
+			continue
+		}
+		if string(k) != keys[index] {
+			return protocolError("response for key %q to the get of %q", k, keys[index])
+		}
+
+		flags, err := itemFlags(extras)
+		if err != nil {
+			return err
+		}
+		found(&Item{
+			Key:   string(k),
+			Value: value,
+			Flags: flags,
+			casid: bUint64(hdr[16:24]),
+		})
+	}
+}
+
+func (binaryCodec) store(cn *poolConn, req *request, cmd command, item *Item, casid uint64) error {
+	extras := make([]byte, 8)
+	putUint32(extras, item.Flags)
+	putUint32(extras[4:8], uint32(item.Expiration))
+	if err := sendConnCommand(cn, item.Key, cmd, item.Value, casid, extras); err != nil {
+		return err
+	}
+	req.sent()
+
+	hdr, _, _, _, err := parseResponse(item.Key, cn, cn.maxBody)
+	if casid != 0 && hdr != nil {
+		// The server answers a failed CAS with the statuses used
+		// by add and replace.
+		switch bUint16(hdr[6:8]) {
+		case respKeyExists:
+			err = ErrCASConflict
+		case respKeyNotFound:
+			err = ErrNotStored
+		}
+	}
+	if err != nil {
+		return err
+	}
+	item.casid = bUint64(hdr[16:24])
+	return nil
+}
+
+func (binaryCodec) delete(cn *poolConn, req *request, key string, casid uint64) error {
+	if err := sendConnCommand(cn, key, cmdDelete, nil, casid, nil); err != nil {
+		return err
+	}
+	req.sent()
+	hdr, _, _, _, err := parseResponse(key, cn, cn.maxBody)
+	if casid != 0 && hdr != nil && bUint16(hdr[6:8]) == respKeyExists {
+		err = ErrCASConflict
+	}
+	return err
+}
+
+func (binaryCodec) touch(cn *poolConn, req *request, key string, expiration int32) error {
+	extras := make([]byte, 4)
+	putUint32(extras, uint32(expiration))
+	if err := sendConnCommand(cn, key, cmdTouch, nil, 0, extras); err != nil {
+		return err
+	}
+	req.sent()
+	_, _, _, _, err := parseResponse(key, cn, cn.maxBody)
+	return err
+}
+
+func incrDecrExtras(delta, initial uint64, expiration uint32) []byte {
+	extras := make([]byte, 20)
+	putUint64(extras, delta)
+	putUint64(extras[8:16], initial)
+	putUint32(extras[16:20], expiration)
+	return extras
+}
+
+func (binaryCodec) incrDecr(cn *poolConn, req *request, cmd command, key string, delta, initial uint64, expiration uint32) (uint64, error) {
+	extras := incrDecrExtras(delta, initial, expiration)
+	if err := sendConnCommand(cn, key, cmd, nil, 0, extras); err != nil {
+		return 0, err
+	}
+	req.sent()
+
+	_, _, _, value, err := parseResponse(key, cn, cn.maxBody)
+	if err != nil {
+		return 0, err
+	}
+	if len(value) != 8 {
+		return 0, protocolError("incr/decr response value of %d bytes, want 8", len(value))
+	}
+	return bUint64(value), nil
+}
+
+// setQ pipelines a quiet set for each item, terminated by a noop. Only
+// failures are answered, with the index of the item as opaque.
+func (binaryCodec) setQ(cn *poolConn, req *request, items []*Item) ([]error, error) {
+	var errs []error
+	extras := make([]byte, 8)
+	for ii, item := range items {
+		if len(item.Key) > 0xffff {
+			if errs == nil {
+				errs = make([]error, len(items))
+			}
+			errs[ii] = ErrMalformedKey
+			continue
+		}
+		putUint32(extras, item.Flags)
+		putUint32(extras[4:8], uint32(item.Expiration))
+		if err := sendConnCommandOpaque(cn, item.Key, cmdSetQ, item.Value, 0, extras, uint32(ii)); err != nil {
+			return nil, err
+		}
+	}
+	if err := sendConnCommandOpaque(cn, "", cmdNoop, nil, 0, nil, uint32(len(items))); err != nil {
+		return nil, err
+	}
+	req.sent()
+
+	for {
+		hdr, _, _, _, err := parseResponse("", cn, cn.maxBody)
+		if hdr == nil {
+			return nil, err
+		}
+		opaque, perr := pipelineIndex(hdr, cmdSetQ, len(items))
+		if perr != nil {
+			return nil, perr
+		}
+		if opaque == len(items) {
+			return errs, nil
+		}
+		if err == nil {
+			continue
+		}
+		if errs == nil {
+			errs = make([]error, len(items))
+		}
+		if err == response(respInvalidArgs) && !legalKey(items[opaque].Key) {
+			err = ErrMalformedKey
+		}
+		errs[opaque] = err
+	}
+}
+
+// pipelineIndex checks the response header hdr read from a pipeline of n
+// cmd requests, whose opaques are their indexes, terminated by a noop
+// with the opaque n. It returns the index of the request answered, n
+// for the noop.
+func pipelineIndex(hdr []byte, cmd command, n int) (int, error) {
+	opaque := bUint32(hdr[12:16])
+	switch command(hdr[1]) {
+	case cmdNoop:
+		if opaque == uint32(n) {
+			return n, nil
+		}
+	case cmd:
+		if opaque < uint32(n) {
+			return int(opaque), nil
+		}
+	}
+	return 0, protocolError("unexpected response to opcode 0x%02x with opaque %d in a pipeline of %d requests", hdr[1], opaque, n)
+}
+
+// incrDecrQ pipelines a quiet incr/decr for each key, terminated by a
+// noop. The server only answers failed commands, which are matched back
+// to their key through the opaque field.
+func (binaryCodec) incrDecrQ(cn *poolConn, req *request, cmd command, keys []string, delta, initial uint64, expiration uint32) ([]error, error) {
+	extras := incrDecrExtras(delta, initial, expiration)
+	var errs []error
+	for ii, key := range keys {
+		if len(key) > 0xffff {
+			if errs == nil {
+				errs = make([]error, len(keys))
+			}
+			errs[ii] = ErrMalformedKey
+			continue
+		}
+		if err := sendConnCommandOpaque(cn, key, cmd, nil, 0, extras, uint32(ii)); err != nil {
+			return nil, err
+		}
+	}
+	if err := sendConnCommandOpaque(cn, "", cmdNoop, nil, 0, nil, uint32(len(keys))); err != nil {
+		return nil, err
+	}
+	req.sent()
+
+	for {
+		hdr, _, _, _, err := parseResponse("", cn, cn.maxBody)
+		if hdr == nil {
+			return nil, err
+		}
+		opaque, perr := pipelineIndex(hdr, cmd, len(keys))
+		if perr != nil {
+			return nil, perr
+		}
+		if opaque == len(keys) {
+			return errs, nil
+		}
+		if err == nil {
+			continue
+		}
+		if errs == nil {
+			errs = make([]error, len(keys))
+		}
+		if err == response(respInvalidArgs) && !legalKey(keys[opaque]) {
+			err = ErrMalformedKey
+		}
+		errs[opaque] = err
+	}
+}
+
+func (binaryCodec) flush(cn *poolConn, req *request, expiration int) error {
+	var extras []byte
+	if expiration > 0 {
+		extras = make([]byte, 4)
+		putUint32(extras, uint32(expiration))
+	}
+	if err := sendConnCommand(cn, "", cmdFlush, nil, 0, extras); err != nil {
+		return err
+	}
+	req.sent()
+	_, _, _, _, err := parseResponse("", cn, cn.maxBody)
+	return err
+}
+
+// stats reads the statistics sent by the server as a response per
+// statistic, terminated by one with an empty key.
+func (binaryCodec) stats(cn *poolConn, req *request) (map[string]string, error) {
+	if err := sendConnCommand(cn, "", cmdStat, nil, 0, nil); err != nil {
+		return nil, err
+	}
+	req.sent()
+	stats := make(map[string]string)
+	for {
+		_, key, _, value, err := parseResponse("", cn, cn.maxBody)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) == 0 {
+			return stats, nil
+		}
+		stats[string(key)] = string(value)
+	}
+}
+
+func (binaryCodec) noop(cn *poolConn) error {
+	if err := sendConnCommand(cn, "", cmdNoop, nil, 0, nil); err != nil {
+		return err
+	}
+	_, _, _, _, err := parseResponse("", cn, maxControlResponseSize)
+	return err
+}
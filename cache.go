@@ -0,0 +1,48 @@
+package memcache
+
+import "context"
+
+// Cache is the set of commands of a Client, so that code using a cache
+// can be given either a Client or a MemoryCache in its tests. The
+// methods behave as documented on Client.
+type Cache interface {
+	Get(key string) (*Item, error)
+	GetContext(ctx context.Context, key string) (*Item, error)
+	GetMulti(keys []string) (map[string]*Item, error)
+	GetMultiContext(ctx context.Context, keys []string) (map[string]*Item, error)
+	GetAndTouch(key string, expiration int32) (*Item, error)
+	GetAndTouchContext(ctx context.Context, key string, expiration int32) (*Item, error)
+
+	Set(item *Item) error
+	SetContext(ctx context.Context, item *Item) error
+	Add(item *Item) error
+	AddContext(ctx context.Context, item *Item) error
+	CompareAndSwap(item *Item) error
+	CompareAndSwapContext(ctx context.Context, item *Item) error
+
+	Delete(key string) error
+	DeleteContext(ctx context.Context, key string) error
+	Touch(key string, expiration int32) error
+	TouchContext(ctx context.Context, key string, expiration int32) error
+
+	Increment(key string, delta uint64) (uint64, error)
+	IncrementContext(ctx context.Context, key string, delta uint64) (uint64, error)
+	Decrement(key string, delta uint64) (uint64, error)
+	DecrementContext(ctx context.Context, key string, delta uint64) (uint64, error)
+	IncrementWithDefault(key string, delta, initial uint64, expiration int32) (uint64, error)
+	IncrementWithDefaultContext(ctx context.Context, key string, delta, initial uint64, expiration int32) (uint64, error)
+	DecrementWithDefault(key string, delta, initial uint64, expiration int32) (uint64, error)
+	DecrementWithDefaultContext(ctx context.Context, key string, delta, initial uint64, expiration int32) (uint64, error)
+	IncrementQ(keys []string, delta, initial uint64, expiration int32) error
+	IncrementQContext(ctx context.Context, keys []string, delta, initial uint64, expiration int32) error
+	DecrementQ(keys []string, delta, initial uint64, expiration int32) error
+	DecrementQContext(ctx context.Context, keys []string, delta, initial uint64, expiration int32) error
+
+	Flush(expiration int) error
+	FlushContext(ctx context.Context, expiration int) error
+}
+
+var (
+	_ Cache = (*Client)(nil)
+	_ Cache = (*MemoryCache)(nil)
+)
@@ -0,0 +1,174 @@
+package memcache
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dev-lazarev/memcache/memtest"
+)
+
+// testClock is a settable clock, shared by a Cache and the test.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// newClockedClient returns a Client using protocol, talking to a memtest
+// server whose time is given by the returned clock.
+func newClockedClient(t *testing.T, protocol Protocol) (*Client, *testClock) {
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	s := memtest.NewUnstartedServer()
+	s.Clock = clock.Now
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	c, err := New([]Config{{Server: s.Addr, MaxIdle: 4, MaxCap: 8, ConnectionTimeout: time.Second, Protocol: protocol}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c, clock
+}
+
+// TestCache checks that a Client, using any protocol, and a
+// MemoryCache behave the same.
+func TestCache(t *testing.T) {
+	for _, protocol := range []Protocol{ProtocolBinary, ProtocolText, ProtocolMeta} {
+		t.Run("Client/"+protocol.String(), func(t *testing.T) {
+			c, clock := newClockedClient(t, protocol)
+			testCache(t, c, clock)
+		})
+	}
+	t.Run("MemoryCache", func(t *testing.T) {
+		clock := &testClock{now: time.Unix(1700000000, 0)}
+		// The zero value is ready to use.
+		testCache(t, &MemoryCache{Clock: clock.Now}, clock)
+	})
+}
+
+func testCache(t *testing.T, c Cache, clock *testClock) {
+	checkErr := func(got, want error, format string, args ...interface{}) {
+		t.Helper()
+		if got != want {
+			t.Fatalf(format+" = %v, want %v", append(args, got, want)...)
+		}
+	}
+
+	// Storage commands.
+	foo := &Item{Key: "foo", Value: []byte("fooval"), Flags: 42}
+	checkErr(c.Set(foo), nil, "Set(foo)")
+	it, err := c.Get("foo")
+	checkErr(err, nil, "Get(foo)")
+	if string(it.Value) != "fooval" || it.Flags != 42 {
+		t.Errorf("Get(foo) = %q, flags %d, want fooval, flags 42", it.Value, it.Flags)
+	}
+	_, err = c.Get("missing")
+	checkErr(err, ErrCacheMiss, "Get(missing)")
+	checkErr(c.Add(&Item{Key: "foo", Value: []byte("x")}), ErrNotStored, "Add(existing)")
+	checkErr(c.Add(&Item{Key: "bar", Value: []byte("barval")}), nil, "Add(bar)")
+
+	items, err := c.GetMulti([]string{"foo", "bar", "missing"})
+	checkErr(err, nil, "GetMulti")
+	if len(items) != 2 || string(items["foo"].Value) != "fooval" || string(items["bar"].Value) != "barval" {
+		t.Errorf("GetMulti = %v, want foo and bar", items)
+	}
+
+	// Compare and swap.
+	it, err = c.Get("foo")
+	checkErr(err, nil, "Get(foo)")
+	stale := *it
+	it.Value = []byte("swapped")
+	checkErr(c.CompareAndSwap(it), nil, "CompareAndSwap(foo)")
+	stale.Value = []byte("stale")
+	checkErr(c.CompareAndSwap(&stale), ErrCASConflict, "CompareAndSwap(stale foo)")
+	checkErr(c.Delete("foo"), nil, "Delete(foo)")
+	checkErr(c.CompareAndSwap(it), ErrNotStored, "CompareAndSwap(deleted foo)")
+	checkErr(c.Delete("foo"), ErrCacheMiss, "Delete(deleted foo)")
+
+	// Arithmetic.
+	_, err = c.Increment("n", 1)
+	checkErr(err, ErrCacheMiss, "Increment(missing)")
+	n, err := c.IncrementWithDefault("n", 1, 10, 0)
+	checkErr(err, nil, "IncrementWithDefault(n)")
+	if n != 10 {
+		t.Errorf("IncrementWithDefault(missing n) = %d, want 10", n)
+	}
+	if n, _ = c.Increment("n", 5); n != 15 {
+		t.Errorf("Increment(n, 5) = %d, want 15", n)
+	}
+	if n, _ = c.Decrement("n", 20); n != 0 {
+		t.Errorf("Decrement(n, 20) = %d, want 0", n)
+	}
+	if n, _ = c.DecrementWithDefault("m", 1, 3, 0); n != 3 {
+		t.Errorf("DecrementWithDefault(missing m) = %d, want 3", n)
+	}
+	_, err = c.IncrementWithDefault("neg", 1, 10, -1)
+	checkErr(err, ErrNegativeExpiration, "IncrementWithDefault(negative expiration)")
+	checkErr(c.DecrementQ([]string{"neg"}, 1, 10, -1), ErrNegativeExpiration, "DecrementQ(negative expiration)")
+	checkErr(c.Set(&Item{Key: "s", Value: []byte("abc")}), nil, "Set(s)")
+	_, err = c.Increment("s", 1)
+	checkErr(err, ErrBadIncrDec, "Increment(non numeric)")
+	checkErr(c.IncrementQ([]string{"n", "q"}, 2, 7, 0), nil, "IncrementQ")
+	if it, _ := c.Get("n"); it == nil || string(it.Value) != "2" {
+		t.Errorf("Get(n) after IncrementQ = %v, want 2", it)
+	}
+	if it, _ := c.Get("q"); it == nil || string(it.Value) != "7" {
+		t.Errorf("Get(q) after IncrementQ = %v, want 7", it)
+	}
+	if err := c.DecrementQ([]string{"s"}, 1, 0, 0); err == nil || !strings.Contains(err.Error(), "s: ") {
+		t.Errorf("DecrementQ(non numeric) = %v, want an error for s", err)
+	}
+
+	// Expirations.
+	checkErr(c.Set(&Item{Key: "short", Value: []byte("v"), Expiration: 10}), nil, "Set(short)")
+	checkErr(c.Set(&Item{Key: "absolute", Value: []byte("v"), Expiration: int32(clock.Now().Unix() + 30)}), nil, "Set(absolute)")
+	clock.Advance(10 * time.Second)
+	_, err = c.Get("short")
+	checkErr(err, ErrCacheMiss, "Get(expired)")
+	_, err = c.Get("absolute")
+	checkErr(err, nil, "Get(absolute)")
+	clock.Advance(20 * time.Second)
+	_, err = c.Get("absolute")
+	checkErr(err, ErrCacheMiss, "Get(expired absolute)")
+	checkErr(c.Set(&Item{Key: "touched", Value: []byte("v"), Expiration: 10}), nil, "Set(touched)")
+	checkErr(c.Touch("touched", 60), nil, "Touch(touched)")
+	checkErr(c.Touch("missing", 60), ErrCacheMiss, "Touch(missing)")
+	clock.Advance(30 * time.Second)
+	it, err = c.GetAndTouch("touched", 10)
+	checkErr(err, nil, "GetAndTouch(touched)")
+	if string(it.Value) != "v" {
+		t.Errorf("GetAndTouch(touched) = %q, want v", it.Value)
+	}
+	_, err = c.GetAndTouch("missing", 10)
+	checkErr(err, ErrCacheMiss, "GetAndTouch(missing)")
+	clock.Advance(10 * time.Second)
+	_, err = c.Get("touched")
+	checkErr(err, ErrCacheMiss, "Get(expired touched)")
+
+	// Flush.
+	checkErr(c.Flush(60), nil, "Flush(60)")
+	_, err = c.Get("bar")
+	checkErr(err, nil, "Get(bar) before delayed flush")
+	clock.Advance(time.Minute)
+	_, err = c.Get("bar")
+	checkErr(err, ErrCacheMiss, "Get(bar) after delayed flush")
+	checkErr(c.Set(&Item{Key: "bar", Value: []byte("v")}), nil, "Set(bar)")
+	checkErr(c.Flush(0), nil, "Flush(0)")
+	_, err = c.Get("bar")
+	checkErr(err, ErrCacheMiss, "Get(bar) after flush")
+}
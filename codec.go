@@ -0,0 +1,82 @@
+package memcache
+
+// Protocol is the memcached protocol spoken with a server.
+type Protocol int
+
+const (
+	// ProtocolBinary is the binary protocol, the default.
+	ProtocolBinary Protocol = iota
+
+	// ProtocolText is the text, or ASCII, protocol, for servers and
+	// proxies such as twemproxy which don't speak the binary one.
+	ProtocolText
+
+	// ProtocolMeta is the meta protocol of memcached 1.6+. The Meta
+	// methods of Client, and GetOrRefresh, need it or ProtocolText.
+	ProtocolMeta
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolBinary:
+		return "binary"
+	case ProtocolText:
+		return "text"
+	case ProtocolMeta:
+		return "meta"
+	}
+	return "unknown"
+}
+
+// codec runs the commands of a Client over a connection, in one of the
+// protocols. Its methods call req.sent once the request is written.
+// Errors for which resumableError is false leave the connection in an
+// unknown state.
+type codec interface {
+	get(cn *poolConn, req *request, key string) (*Item, error)
+	getAndTouch(cn *poolConn, req *request, key string, expiration int32) (*Item, error)
+	getMulti(cn *poolConn, req *request, keys []string, found func(*Item)) error
+	// store runs cmd, either cmdSet or cmdAdd, for item. A non-zero
+	// casid makes a set a compare and swap.
+	store(cn *poolConn, req *request, cmd command, item *Item, casid uint64) error
+	// setQ sets every item, pipelined. The returned slice is either nil
+	// or has an error per item, the error is set if the connection
+	// can't be reused. Along with that error, a non-nil slice tells the
+	// items answered before it apart from the others, which get it.
+	setQ(cn *poolConn, req *request, items []*Item) ([]error, error)
+	// delete deletes key. A non-zero casid only deletes it if its CAS
+	// ID still matches, ErrCASConflict is returned otherwise.
+	delete(cn *poolConn, req *request, key string, casid uint64) error
+	touch(cn *poolConn, req *request, key string, expiration int32) error
+	// incrDecr runs cmd, either cmdIncr or cmdDecr. The key is created
+	// with initial unless expiration is noAutoCreate.
+	incrDecr(cn *poolConn, req *request, cmd command, key string, delta, initial uint64, expiration uint32) (uint64, error)
+	// incrDecrQ runs cmd, cmdIncrementQ or cmdDecrementQ, for every key.
+	// The returned slice is either nil or has an error per key, the
+	// error is set if the connection can't be reused.
+	incrDecrQ(cn *poolConn, req *request, cmd command, keys []string, delta, initial uint64, expiration uint32) ([]error, error)
+	flush(cn *poolConn, req *request, expiration int) error
+	stats(cn *poolConn, req *request) (map[string]string, error)
+	// noop checks that the server answers.
+	noop(cn *poolConn) error
+}
+
+func (p Protocol) codec() codec {
+	switch p {
+	case ProtocolText:
+		return textCodec{}
+	case ProtocolMeta:
+		return metaCodec{}
+	}
+	return binaryCodec{}
+}
+
+// resumableError reports whether a connection can be reused after a
+// command failed with err, because the whole response was read.
+func resumableError(err error) bool {
+	switch err {
+	case nil, ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrBadIncrDec, ErrMalformedKey:
+		return true
+	}
+	return false
+}
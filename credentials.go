@@ -0,0 +1,128 @@
+package memcache
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials are the user and password used to authenticate a
+// connection using SASL.
+type Credentials struct {
+	User     string
+	Password string
+}
+
+// CredentialsProvider returns the credentials for a server. It is
+// consulted every time a new connection is established, so rotated
+// credentials are picked up without rebuilding the Client. Connections
+// already established are not affected by a rotation. Implementations
+// must be safe for concurrent use.
+type CredentialsProvider interface {
+	Credentials() (Credentials, error)
+}
+
+// StaticCredentials returns a CredentialsProvider which always returns
+// the given user and password.
+func StaticCredentials(user, password string) CredentialsProvider {
+	return staticCredentials{User: user, Password: password}
+}
+
+type staticCredentials Credentials
+
+func (c staticCredentials) Credentials() (Credentials, error) {
+	return Credentials(c), nil
+}
+
+// EnvCredentials returns a CredentialsProvider which reads the user and
+// password from the given environment variables each time it's called.
+func EnvCredentials(userVar, passwordVar string) CredentialsProvider {
+	return envCredentials{userVar: userVar, passwordVar: passwordVar}
+}
+
+type envCredentials struct {
+	userVar     string
+	passwordVar string
+}
+
+func (c envCredentials) Credentials() (Credentials, error) {
+	return Credentials{
+		User:     os.Getenv(c.userVar),
+		Password: os.Getenv(c.passwordVar),
+	}, nil
+}
+
+// FileCredentials is a CredentialsProvider which reads the user and
+// password from files, such as mounted secrets. Leading and trailing
+// whitespace is trimmed. The files are read again whenever their
+// modification time or size changes.
+type FileCredentials struct {
+	userFile     string
+	passwordFile string
+
+	mu       sync.Mutex
+	user     fileSecret
+	password fileSecret
+}
+
+// NewFileCredentials returns a FileCredentials reading the user from
+// userFile and the password from passwordFile. If userFile is empty,
+// the user is always empty.
+func NewFileCredentials(userFile, passwordFile string) *FileCredentials {
+	return &FileCredentials{
+		userFile:     userFile,
+		passwordFile: passwordFile,
+	}
+}
+
+// Credentials implements CredentialsProvider.
+func (c *FileCredentials) Credentials() (Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	user, err := c.user.read(c.userFile)
+	if err != nil {
+		return Credentials{}, err
+	}
+	password, err := c.password.read(c.passwordFile)
+	if err != nil {
+		return Credentials{}, err
+	}
+	return Credentials{User: user, Password: password}, nil
+}
+
+// fileSecret caches the contents of a file until it changes.
+type fileSecret struct {
+	modTime time.Time
+	size    int64
+	value   string
+}
+
+func (s *fileSecret) read(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return s.value, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	s.modTime = fi.ModTime()
+	s.size = fi.Size()
+	s.value = strings.TrimSpace(string(data))
+	return s.value, nil
+}
+
+// credentials returns the credentials to use for a new connection.
+func (c Config) credentials() (Credentials, error) {
+	if c.Credentials != nil {
+		return c.Credentials.Credentials()
+	}
+	return Credentials{User: c.User, Password: c.Password}, nil
+}
@@ -0,0 +1,86 @@
+package memcache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileCredentials(t *testing.T) {
+	dir := t.TempDir()
+	userFile := filepath.Join(dir, "user")
+	passwordFile := filepath.Join(dir, "password")
+	write := func(path, data string, mtime time.Time) {
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write(userFile, "my_user\n", now)
+	write(passwordFile, "secret1\n", now)
+
+	p := NewFileCredentials(userFile, passwordFile)
+	creds, err := p.Credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.User != "my_user" || creds.Password != "secret1" {
+		t.Fatalf("Credentials() = %+v, want my_user/secret1", creds)
+	}
+
+	// Rotate the password, keeping the same size.
+	write(passwordFile, "secret2\n", now.Add(time.Minute))
+	creds, err = p.Credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Password != "secret2" {
+		t.Fatalf("Credentials() after rotation = %+v, want password secret2", creds)
+	}
+
+	os.Remove(passwordFile)
+	if _, err := p.Credentials(); err == nil {
+		t.Fatal("Credentials() with missing password file: want error, got nil")
+	}
+
+	p = NewFileCredentials("", userFile)
+	creds, err = p.Credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.User != "" || creds.Password != "my_user" {
+		t.Fatalf("Credentials() without user file = %+v, want empty user", creds)
+	}
+}
+
+func TestEnvCredentials(t *testing.T) {
+	t.Setenv("MEMCACHE_TEST_USER", "my_user")
+	t.Setenv("MEMCACHE_TEST_PASSWORD", "secret1")
+	p := EnvCredentials("MEMCACHE_TEST_USER", "MEMCACHE_TEST_PASSWORD")
+	creds, _ := p.Credentials()
+	if creds.User != "my_user" || creds.Password != "secret1" {
+		t.Fatalf("Credentials() = %+v, want my_user/secret1", creds)
+	}
+	t.Setenv("MEMCACHE_TEST_PASSWORD", "secret2")
+	creds, _ = p.Credentials()
+	if creds.Password != "secret2" {
+		t.Fatalf("Credentials() after rotation = %+v, want password secret2", creds)
+	}
+}
+
+func TestConfigCredentials(t *testing.T) {
+	config := Config{User: "static", Password: "static_pw"}
+	creds, _ := config.credentials()
+	if creds != (Credentials{User: "static", Password: "static_pw"}) {
+		t.Errorf("credentials() = %+v, want static credentials", creds)
+	}
+	config.Credentials = StaticCredentials("provided", "provided_pw")
+	creds, _ = config.credentials()
+	if creds != (Credentials{User: "provided", Password: "provided_pw"}) {
+		t.Errorf("credentials() = %+v, want provider credentials", creds)
+	}
+}
@@ -0,0 +1,139 @@
+package memcache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dev-lazarev/memcache/memtest"
+)
+
+func newFaultyServer(t *testing.T) (*memtest.Server, *Client) {
+	s := memtest.NewServer()
+	t.Cleanup(func() { s.Close() })
+	c, err := New([]Config{{
+		Server:            s.Addr,
+		MaxIdle:           1,
+		MaxCap:            1,
+		ConnectionTimeout: time.Second,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	if err := c.Set(&Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	return s, c
+}
+
+// checkRecovered checks that c works again once the faults are gone,
+// replacing the connection a fault broke.
+func checkRecovered(t *testing.T, s *memtest.Server, c *Client) {
+	t.Helper()
+	s.ClearFaults()
+	it, err := c.Get("foo")
+	if err != nil {
+		t.Fatalf("Get after fault: %v", err)
+	}
+	if string(it.Value) != "bar" {
+		t.Errorf("Get after fault = %q, want bar", it.Value)
+	}
+}
+
+func TestFaultTimeout(t *testing.T) {
+	s, c := newFaultyServer(t)
+	s.InjectFault(memtest.Fault{Command: "get", Times: 1, Delay: time.Second})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := c.GetContext(ctx, "foo")
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("GetContext from slow server = %v, want a timeout", err)
+	}
+	checkRecovered(t, s, c)
+}
+
+func TestFaultBrokenResponses(t *testing.T) {
+	for _, test := range []struct {
+		action  memtest.FaultAction
+		wantErr error // nil if any error will do
+	}{
+		{memtest.FaultCloseConnection, nil},
+		{memtest.FaultTruncateHeader, nil},
+		{memtest.FaultDropMidBody, nil},
+		{memtest.FaultBadMagic, ErrBadMagic},
+	} {
+		s, c := newFaultyServer(t)
+		s.InjectFault(memtest.Fault{Command: "get", Action: test.action})
+		_, err := c.Get("foo")
+		if err == nil || test.wantErr != nil && err != test.wantErr {
+			t.Errorf("action %d: Get = %v, want %v", test.action, err, test.wantErr)
+		}
+		checkRecovered(t, s, c)
+	}
+}
+
+func TestFaultWrongKey(t *testing.T) {
+	s, c := newFaultyServer(t)
+	s.InjectFault(memtest.Fault{Command: "get", Action: memtest.FaultWrongKey})
+	if items, err := c.GetMulti([]string{"foo"}); err != nil || len(items) != 0 {
+		t.Errorf("GetMulti answered for another key = %v, %v, want no items", items, err)
+	}
+	values, err := c.GetMultiOrLoad([]string{"foo"}, 0, func(context.Context, []string) (map[string][]byte, error) {
+		t.Error("loader called for a key answered for another one")
+		return nil, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "protocol error") || len(values) != 0 {
+		t.Errorf("GetMultiOrLoad answered for another key = %q, %v, want a protocol error", values, err)
+	}
+	checkRecovered(t, s, c)
+}
+
+func TestFaultWrongOpaque(t *testing.T) {
+	s, c := newFaultyServer(t)
+	s.InjectFault(memtest.Fault{Command: "get", Action: memtest.FaultWrongOpaque})
+	// The answer for foo claims to be the one for bar.
+	if items, err := c.GetMulti([]string{"foo", "bar"}); err != nil || len(items) != 0 {
+		t.Errorf("GetMulti with a wrong opaque = %v, %v, want no items", items, err)
+	}
+	s.ClearFaults()
+	s.InjectFault(memtest.Fault{Command: "incr", Action: memtest.FaultWrongOpaque})
+	if err := c.IncrementQ([]string{"foo"}, 1, 0, 0); err == nil || !strings.Contains(err.Error(), "protocol error") {
+		t.Errorf("IncrementQ with a wrong opaque = %v, want a protocol error", err)
+	}
+	checkRecovered(t, s, c)
+}
+
+func TestFaultStatus(t *testing.T) {
+	s, c := newFaultyServer(t)
+	s.InjectFault(memtest.Fault{Command: "set", Times: 1, Status: memtest.StatusBusy})
+	if err := c.Set(&Item{Key: "foo", Value: []byte("baz")}); err != response(respBusy) {
+		t.Fatalf("Set on busy server = %v, want %v", err, response(respBusy))
+	}
+	checkRecovered(t, s, c)
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	s := memtest.NewServer()
+	defer s.Close()
+	c, err := New([]Config{{Server: s.Addr, MaxIdle: 1, MaxCap: 1, MaxResponseSize: 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Set(&Item{Key: "big", Value: make([]byte, 101)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("big"); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("Get of a value over MaxResponseSize = %v, want ErrProtocol", err)
+	}
+	if err := c.Set(&Item{Key: "small", Value: []byte("v")}); err != nil {
+		t.Fatalf("Set after a protocol error: %v", err)
+	}
+	if _, err := c.Get("small"); err != nil {
+		t.Fatalf("Get after a protocol error: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package memcache
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+// bufConn is a net.Conn reading from and writing to in-memory buffers.
+type bufConn struct {
+	net.Conn
+	r *bytes.Reader
+	w bytes.Buffer
+}
+
+func (c *bufConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *bufConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+// fuzzMaxBody is the maximum body size used when fuzzing parseResponse.
+const fuzzMaxBody = 1 << 10
+
+func responseFrame(opcode command, status uint16, extras, key, value []byte) []byte {
+	hdr := make([]byte, 24)
+	hdr[0] = respMagic
+	hdr[1] = byte(opcode)
+	putUint16(hdr[2:], uint16(len(key)))
+	hdr[4] = byte(len(extras))
+	putUint16(hdr[6:], status)
+	putUint32(hdr[8:], uint32(len(extras)+len(key)+len(value)))
+	return append(append(append(hdr, extras...), key...), value...)
+}
+
+func FuzzParseResponse(f *testing.F) {
+	f.Add(responseFrame(cmdGet, respOk, []byte{0, 0, 0, 42}, nil, []byte("value")))
+	f.Add(responseFrame(cmdGetK, respOk, []byte{0, 0, 0, 0}, []byte("key"), []byte("value")))
+	f.Add(responseFrame(cmdGet, respKeyNotFound, nil, nil, []byte("Not found")))
+	f.Add(responseFrame(cmdNoop, respOk, nil, nil, nil))
+	f.Add(responseFrame(opAuthStart, respAuthContinue, nil, nil, []byte("challenge")))
+	huge := responseFrame(cmdGet, respOk, nil, nil, nil)
+	putUint32(huge[8:], 0xffffffff)
+	f.Add(huge)
+	overlap := responseFrame(cmdGet, respOk, []byte{0, 0, 0, 0}, []byte("key"), nil)
+	putUint32(overlap[8:], 2)
+	f.Add(overlap)
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		hdr, key, extras, value, err := parseResponse("key", &bufConn{r: bytes.NewReader(frame)}, fuzzMaxBody)
+		if err != nil {
+			if errors.Is(err, ErrProtocol) && hdr != nil {
+				t.Fatalf("protocol error %v returned a header", err)
+			}
+			return
+		}
+		total := int(bUint32(hdr[8:12]))
+		if total > fuzzMaxBody {
+			t.Fatalf("accepted a body of %d bytes", total)
+		}
+		if len(extras)+len(key)+len(value) != total {
+			t.Fatalf("extras, key and value of %d+%d+%d bytes, body of %d", len(extras), len(key), len(value), total)
+		}
+		if !bytes.Equal(frame[24:24+total], append(append(append([]byte(nil), extras...), key...), value...)) {
+			t.Fatal("decoded body differs from the frame")
+		}
+	})
+}
+
+func TestParseResponseLimits(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		frame func() []byte
+	}{
+		{"body too large", func() []byte {
+			return responseFrame(cmdGet, respOk, nil, nil, make([]byte, fuzzMaxBody+1))
+		}},
+		{"extras and key longer than body", func() []byte {
+			frame := responseFrame(cmdGetK, respOk, []byte{0, 0, 0, 0}, []byte("key"), nil)
+			putUint32(frame[8:], 5)
+			return frame
+		}},
+	} {
+		_, _, _, _, err := parseResponse("", &bufConn{r: bytes.NewReader(test.frame())}, fuzzMaxBody)
+		var pe *ProtocolError
+		if !errors.Is(err, ErrProtocol) || !errors.As(err, &pe) {
+			t.Errorf("%s: err = %v, want a ProtocolError", test.name, err)
+		}
+	}
+}
+
+func FuzzRequestEncoding(f *testing.F) {
+	f.Add("foo", uint8(cmdGet), []byte(nil), uint64(0), []byte(nil), uint32(0))
+	f.Add("foo", uint8(cmdSet), []byte("bar"), uint64(42), []byte{0, 0, 0, 1, 0, 0, 0, 0}, uint32(0))
+	f.Add("", uint8(cmdNoop), []byte(nil), uint64(0), []byte(nil), uint32(7))
+	f.Add("counter", uint8(cmdIncrementQ), []byte(nil), uint64(0), incrDecrExtras(1, 0, 0), uint32(3))
+
+	f.Fuzz(func(t *testing.T, key string, cmd uint8, value []byte, casid uint64, extras []byte, opaque uint32) {
+		if len(extras) > 0xff {
+			extras = extras[:0xff]
+		}
+		cn := &bufConn{}
+		if err := sendConnCommandOpaque(cn, key, command(cmd), value, casid, extras, opaque); err != nil {
+			if len(key) <= 0xffff {
+				t.Fatalf("encoding failed: %v", err)
+			}
+			return
+		}
+		frame := cn.w.Bytes()
+		if len(frame) < 24 || frame[0] != reqMagic || frame[1] != cmd {
+			t.Fatalf("bad header % x", frame)
+		}
+		kl, el, total := int(bUint16(frame[2:4])), int(frame[4]), int(bUint32(frame[8:12]))
+		if kl != len(key) || el != len(extras) || total != len(frame)-24 || total != kl+el+len(value) {
+			t.Fatalf("lengths key %d extras %d total %d for a frame of %d bytes", kl, el, total, len(frame))
+		}
+		if bUint32(frame[12:16]) != opaque || bUint64(frame[16:24]) != casid {
+			t.Fatal("opaque or cas not encoded")
+		}
+		body := frame[24:]
+		if !bytes.Equal(body[:el], extras) || string(body[el:el+kl]) != key || !bytes.Equal(body[el+kl:], value) {
+			t.Fatal("body not encoded as extras, key and value")
+		}
+	})
+}
@@ -1,11 +1,3 @@
 module github.com/dev-lazarev/memcache
 
 go 1.18
-
-require github.com/silenceper/pool v1.0.0
-
-require (
-	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
-	github.com/sirupsen/logrus v1.4.2 // indirect
-	golang.org/x/sys v0.0.0-20220928140112-f11e5e49a4ec // indirect
-)
@@ -0,0 +1,66 @@
+package memcache
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// errConnUnexpectedData is returned by checkAlive when a connection has
+// unread data while idle, meaning it's out of sync with the server.
+var errConnUnexpectedData = errors.New("memcache: unexpected data on idle connection")
+
+// connValidator returns the function used to validate idle connections
+// before they're reused, or nil if validation is disabled.
+func (c Config) connValidator() func(pc *poolConn) error {
+	if !c.ValidateConnections && c.PingIdleAfter <= 0 {
+		return nil
+	}
+	return func(pc *poolConn) error {
+		if c.ValidateConnections {
+			if err := checkAlive(pc.Conn); err != nil {
+				return err
+			}
+		}
+		if c.PingIdleAfter > 0 && time.Since(pc.returnedAt) > c.PingIdleAfter {
+			return ping(pc, c.ConnectionTimeout)
+		}
+		return nil
+	}
+}
+
+// checkAlive performs a non-blocking read on an idle connection. A live
+// connection has nothing to read, so the read times out immediately.
+// Anything else, such as EOF after the server closed the connection or
+// stray data, means it can't be reused.
+func checkAlive(cn net.Conn) error {
+	if err := cn.SetReadDeadline(time.Now()); err != nil {
+		return err
+	}
+	var buf [1]byte
+	n, err := cn.Read(buf[:])
+	if n > 0 {
+		return errConnUnexpectedData
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		return err
+	}
+	return cn.SetReadDeadline(time.Time{})
+}
+
+// ping sends a noop over cn and waits for its response, for at most
+// timeout if it's positive.
+func ping(cn *poolConn, timeout time.Duration) error {
+	if timeout > 0 {
+		if err := cn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+	}
+	if err := cn.codec.noop(cn); err != nil {
+		return err
+	}
+	if timeout > 0 {
+		return cn.SetDeadline(time.Time{})
+	}
+	return nil
+}
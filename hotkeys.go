@@ -0,0 +1,277 @@
+package memcache
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sketchDepth = 4
+	sketchWidth = 1024
+)
+
+// HotKeyConfig configures a HotKeyTracker.
+type HotKeyConfig struct {
+	//Fraction of the requests whose keys are counted, between 0 and 1. Defaults to 0.01
+	SampleRate float64
+
+	//Number of top keys kept per server, defaults to 10
+	TopK int
+
+	//Period over which request rates are measured, defaults to 10 seconds
+	Window time.Duration
+
+	//Estimated requests per second above which a key is reported to OnHotKey, zero disables it
+	Threshold float64
+
+	//Called when a key becomes hotter than Threshold. It's called again for the same key
+	//only after its rate went back under Threshold. It must return quickly
+	OnHotKey func(HotKey)
+}
+
+// HotKey is a frequently requested key.
+type HotKey struct {
+	// Key is the requested key.
+	Key string
+
+	// Server is the address of the server the key maps to.
+	Server string
+
+	// Rate is the estimated number of requests per second for the key,
+	// over the last Window.
+	Rate float64
+}
+
+// HotKeyTracker estimates which keys are requested the most on each
+// server. It counts a random sample of the requested keys in a
+// count-min sketch, keeping the heaviest ones as top keys. Counts are
+// kept for two consecutive windows, the previous one being weighted by
+// how much of it still overlaps the last Window.
+//
+// A HotKeyTracker is installed by setting Client.HotKeys.
+type HotKeyTracker struct {
+	config  HotKeyConfig
+	sampled uint64 // requests are sampled if splitmix64(seq) <= sampled
+	seq     uint64
+
+	mu      sync.Mutex
+	servers map[string]*serverHotKeys
+	now     func() time.Time
+}
+
+// serverHotKeys holds the counts of the keys of a single server.
+type serverHotKeys struct {
+	windowStart time.Time
+	cur, prev   *sketch
+	// top maps the heaviest keys to whether they're above Threshold.
+	top map[string]bool
+}
+
+// sketch is a count-min sketch.
+type sketch [sketchDepth][sketchWidth]uint32
+
+// NewHotKeyTracker returns a tracker configured by config.
+func NewHotKeyTracker(config HotKeyConfig) *HotKeyTracker {
+	if config.SampleRate <= 0 || config.SampleRate > 1 {
+		config.SampleRate = 0.01
+	}
+	if config.TopK <= 0 {
+		config.TopK = 10
+	}
+	if config.Window <= 0 {
+		config.Window = 10 * time.Second
+	}
+	sampled := ^uint64(0)
+	if config.SampleRate < 1 {
+		sampled = uint64(config.SampleRate * (1 << 63) * 2)
+	}
+	return &HotKeyTracker{
+		config:  config,
+		sampled: sampled,
+		servers: make(map[string]*serverHotKeys),
+		now:     time.Now,
+	}
+}
+
+// record counts a request for key on server, if it's sampled.
+func (t *HotKeyTracker) record(server, key string) {
+	if splitmix64(atomic.AddUint64(&t.seq, 1)) > t.sampled {
+		return
+	}
+	now := t.now()
+	t.mu.Lock()
+	s := t.server(server, now)
+	s.cur.add(keyHashes(key))
+	var hot *HotKey
+	if _, ok := s.top[key]; !ok {
+		if len(s.top) < t.config.TopK {
+			s.top[key] = false
+		} else if min, minRate := t.coldest(s, now); minRate < t.rate(s, key, now) {
+			delete(s.top, min)
+			s.top[key] = false
+		}
+	}
+	if wasHot, ok := s.top[key]; ok && t.config.Threshold > 0 {
+		rate := t.rate(s, key, now)
+		isHot := rate > t.config.Threshold
+		if isHot && !wasHot && t.config.OnHotKey != nil {
+			hot = &HotKey{Key: key, Server: server, Rate: rate}
+		}
+		s.top[key] = isHot
+	}
+	t.mu.Unlock()
+	if hot != nil {
+		t.config.OnHotKey(*hot)
+	}
+}
+
+// server returns the counts of server, rotating its windows. t.mu must
+// be held.
+func (t *HotKeyTracker) server(server string, now time.Time) *serverHotKeys {
+	s := t.servers[server]
+	if s == nil {
+		s = &serverHotKeys{windowStart: now, cur: new(sketch), top: make(map[string]bool)}
+		t.servers[server] = s
+		return s
+	}
+	if elapsed := now.Sub(s.windowStart); elapsed >= t.config.Window {
+		if elapsed >= 2*t.config.Window {
+			// Nothing was sampled during the whole previous window.
+			s.prev = nil
+			s.windowStart = now
+		} else {
+			s.prev = s.cur
+			s.windowStart = s.windowStart.Add(t.config.Window)
+		}
+		s.cur = new(sketch)
+	}
+	return s
+}
+
+// coldest returns the top key with the lowest rate and that rate. t.mu
+// must be held.
+func (t *HotKeyTracker) coldest(s *serverHotKeys, now time.Time) (string, float64) {
+	var min string
+	minRate := -1.0
+	for key := range s.top {
+		if rate := t.rate(s, key, now); minRate < 0 || rate < minRate {
+			min, minRate = key, rate
+		}
+	}
+	return min, minRate
+}
+
+// rate estimates the requests per second for key. t.mu must be held.
+func (t *HotKeyTracker) rate(s *serverHotKeys, key string, now time.Time) float64 {
+	h1, h2 := keyHashes(key)
+	count := float64(s.cur.estimate(h1, h2))
+	if s.prev != nil {
+		overlap := 1 - float64(now.Sub(s.windowStart))/float64(t.config.Window)
+		if overlap > 0 {
+			count += overlap * float64(s.prev.estimate(h1, h2))
+		}
+	}
+	return count / t.config.SampleRate / t.config.Window.Seconds()
+}
+
+func (s *sketch) add(h1, h2 uint32) {
+	for i := range s {
+		if c := &s[i][(h1+uint32(i)*h2)%sketchWidth]; *c < ^uint32(0) {
+			*c++
+		}
+	}
+}
+
+func (s *sketch) estimate(h1, h2 uint32) uint32 {
+	est := ^uint32(0)
+	for i := range s {
+		if c := s[i][(h1+uint32(i)*h2)%sketchWidth]; c < est {
+			est = c
+		}
+	}
+	return est
+}
+
+// Top returns the top keys of every server, hottest first.
+func (t *HotKeyTracker) Top() []HotKey {
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var keys []HotKey
+	for server := range t.servers {
+		keys = append(keys, t.top(server, now)...)
+	}
+	sortHotKeys(keys)
+	return keys
+}
+
+// TopByServer returns the top keys of the given server, as named in
+// Config.Server, hottest first.
+func (t *HotKeyTracker) TopByServer(server string) []HotKey {
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.servers[server] == nil {
+		return nil
+	}
+	keys := t.top(server, now)
+	sortHotKeys(keys)
+	return keys
+}
+
+// top returns the top keys of server still seen in the last Window.
+// t.mu must be held.
+func (t *HotKeyTracker) top(server string, now time.Time) []HotKey {
+	s := t.server(server, now)
+	keys := make([]HotKey, 0, len(s.top))
+	for key := range s.top {
+		rate := t.rate(s, key, now)
+		if rate == 0 {
+			delete(s.top, key)
+			continue
+		}
+		keys = append(keys, HotKey{Key: key, Server: server, Rate: rate})
+	}
+	return keys
+}
+
+func sortHotKeys(keys []HotKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Rate != keys[j].Rate {
+			return keys[i].Rate > keys[j].Rate
+		}
+		return keys[i].Key < keys[j].Key
+	})
+}
+
+// keyHashes returns the two hashes from which the sketch row indexes of
+// key are derived.
+func keyHashes(key string) (uint32, uint32) {
+	// 64-bit FNV-1a.
+	sum := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		sum ^= uint64(key[i])
+		sum *= 1099511628211
+	}
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+// splitmix64 scrambles a sequence number into a pseudo random value.
+func splitmix64(x uint64) uint64 {
+	x *= 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// pickServer returns the index of the server for key, counting the
+// request in the hot key tracker if there's one.
+func (c *Client) pickServer(key string) (uint32, error) {
+	serverIndex, err := c.servers.PickServerIndex(key)
+	if err == nil && c.HotKeys != nil {
+		c.HotKeys.record(c.servers.Name(serverIndex), key)
+	}
+	return serverIndex, err
+}
@@ -0,0 +1,90 @@
+package memcache
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHotKeyTracker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var hot []HotKey
+	tracker := NewHotKeyTracker(HotKeyConfig{
+		SampleRate: 1,
+		TopK:       3,
+		Window:     10 * time.Second,
+		Threshold:  5,
+		OnHotKey:   func(k HotKey) { hot = append(hot, k) },
+	})
+	tracker.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		tracker.record("a:1", "hot")
+		if i%2 == 0 {
+			tracker.record("a:1", "warm")
+		}
+		tracker.record("a:1", fmt.Sprintf("cold%d", i))
+	}
+	tracker.record("b:2", "other")
+
+	top := tracker.TopByServer("a:1")
+	if len(top) != 3 || top[0].Key != "hot" || top[1].Key != "warm" {
+		t.Fatalf("top keys of a:1 = %+v, want hot and warm first", top)
+	}
+	if top[0].Rate != 10 || top[1].Rate != 5 {
+		t.Errorf("rates = %v and %v, want 10 and 5 per second", top[0].Rate, top[1].Rate)
+	}
+	if all := tracker.Top(); len(all) != 4 || all[0].Key != "hot" || all[len(all)-1].Server != "b:2" {
+		t.Errorf("top keys = %+v", all)
+	}
+	if len(hot) != 1 || hot[0].Key != "hot" || hot[0].Server != "a:1" {
+		t.Errorf("hot keys reported = %+v, want only hot once", hot)
+	}
+
+	// A fifth of the previous window still counts.
+	now = now.Add(18 * time.Second)
+	if top := tracker.TopByServer("a:1"); len(top) == 0 || top[0].Key != "hot" || math.Abs(top[0].Rate-2) > 1e-9 {
+		t.Errorf("top keys 18s later = %+v, want hot at 2 per second", top)
+	}
+	// The key cooled down, so it's reported again when it heats up.
+	for i := 0; i < 80; i++ {
+		tracker.record("a:1", "hot")
+	}
+	if len(hot) != 2 {
+		t.Errorf("hot keys reported = %+v, want hot twice", hot)
+	}
+
+	now = now.Add(time.Minute)
+	if top := tracker.TopByServer("a:1"); len(top) != 0 {
+		t.Errorf("top keys after a minute = %+v, want none", top)
+	}
+}
+
+func TestHotKeySampling(t *testing.T) {
+	tracker := NewHotKeyTracker(HotKeyConfig{SampleRate: 0.1, Window: time.Second})
+	for i := 0; i < 100000; i++ {
+		tracker.record("a:1", "key")
+	}
+	top := tracker.Top()
+	if len(top) != 1 || top[0].Rate < 90000 || top[0].Rate > 110000 {
+		t.Errorf("sampled top keys = %+v, want a rate around 100000", top)
+	}
+}
+
+func TestClientHotKeys(t *testing.T) {
+	c := newStubClient(t, Config{MaxIdle: 1, MaxCap: 1})
+	c.HotKeys = NewHotKeyTracker(HotKeyConfig{SampleRate: 1})
+	for i := 0; i < 3; i++ {
+		if _, err := c.Get("foo"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.GetMulti([]string{"foo", "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	top := c.HotKeys.Top()
+	if len(top) != 2 || top[0].Key != "foo" || top[0].Server != "stub:11211" || top[0].Rate != 0.4 {
+		t.Errorf("top keys = %+v, want foo requested 4 times in 10s", top)
+	}
+}
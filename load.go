@@ -0,0 +1,406 @@
+package memcache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// loadLockSuffix is appended to a key to get the key of the lock taken
+// by GetOrLoad when Client.LoadLockTime is set.
+const loadLockSuffix = ":lock"
+
+// loadLockPoll is the interval at which GetOrLoad checks whether the
+// value locked by another process was stored.
+const loadLockPoll = 20 * time.Millisecond
+
+// errLoaderPanicked is reported to the callers waiting for a load whose
+// loader panicked.
+var errLoaderPanicked = errors.New("memcache: loader panicked")
+
+// loadGroup deduplicates the concurrent loads of the same keys.
+type loadGroup struct {
+	mu    sync.Mutex
+	calls map[string]*loadCall
+}
+
+// loadCall is a load in progress.
+type loadCall struct {
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+// join returns the call loading key, and whether it was created and the
+// caller must run it.
+func (g *loadGroup) join(key string) (*loadCall, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if call, ok := g.calls[key]; ok {
+		return call, false
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*loadCall)
+	}
+	call := &loadCall{done: make(chan struct{})}
+	g.calls[key] = call
+	return call, true
+}
+
+// finish records the result of the call loading key and wakes up the
+// callers waiting for it.
+func (g *loadGroup) finish(key string, call *loadCall, value []byte, err error) {
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	call.value, call.err = value, err
+	close(call.done)
+}
+
+// wait returns the result of call, once it's done.
+func (call *loadCall) wait(ctx context.Context) ([]byte, error) {
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// GetOrLoad gets the value for key or, on a cache miss, calls loader and
+// stores the value it returns with the expiration ttl, in the same
+// format as Item.Expiration.
+//
+// Concurrent calls for the same key share a single call to loader, run
+// with the context of the first caller. If LoadLockTime is set the
+// loads are also deduplicated across processes by a lock in memcached.
+// A failure to store the loaded value is logged, but doesn't fail the
+// call. ErrCacheMiss is returned if the key was loaded by a concurrent
+// GetMultiOrLoad whose loader didn't return it.
+func (c *Client) GetOrLoad(ctx context.Context, key string, ttl int32, loader func(context.Context) ([]byte, error)) ([]byte, error) {
+	item, err := c.GetContext(ctx, key)
+	if err == nil {
+		return item.Value, nil
+	}
+	if err != ErrCacheMiss {
+		return nil, err
+	}
+	call, run := c.loads.join(key)
+	if !run {
+		return call.wait(ctx)
+	}
+	var value []byte
+	err = errLoaderPanicked
+	defer func() {
+		c.loads.finish(key, call, value, err)
+	}()
+	value, err = c.loadLocked(ctx, key, ttl, loader)
+	return value, err
+}
+
+// loadLocked calls loader and stores the value it returns, under the
+// lock of key if LoadLockTime is set. If the lock is taken, it waits for
+// the value to be stored by its owner instead, up to LoadLockTime.
+func (c *Client) loadLocked(ctx context.Context, key string, ttl int32, loader func(context.Context) ([]byte, error)) ([]byte, error) {
+	lockKey := key + loadLockSuffix
+	if c.LoadLockTime > 0 && legalKey(lockKey) {
+		token, err := newLoadLockToken()
+		if err != nil {
+			return nil, err
+		}
+		err = c.AddContext(ctx, &Item{Key: lockKey, Value: token, Expiration: c.LoadLockTime})
+		switch err {
+		case nil:
+			// The lock expires anyway if it can't be released, so it's
+			// released even if ctx is done.
+			defer c.unlockLoad(lockKey, token)
+			// The value may have been stored by the previous owner of
+			// the lock since it was looked up.
+			item, err := c.GetContext(ctx, key)
+			if err == nil {
+				return item.Value, nil
+			}
+			if err != ErrCacheMiss {
+				return nil, err
+			}
+		case ErrNotStored:
+			value, err := c.waitLoaded(ctx, key)
+			if err != ErrCacheMiss {
+				return value, err
+			}
+			// The owner of the lock didn't store the value in time.
+		default:
+			return nil, err
+		}
+	}
+	value, err := loader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.SetContext(ctx, &Item{Key: key, Value: value, Expiration: ttl}); err != nil {
+		c.logWriteBack(key, err)
+	}
+	return value, nil
+}
+
+// newLoadLockToken returns a random value identifying the owner of a
+// lock taken by GetOrLoad.
+func newLoadLockToken() ([]byte, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	token := make([]byte, hex.EncodedLen(len(b)))
+	hex.Encode(token, b)
+	return token, nil
+}
+
+// unlockLoad deletes the lock at lockKey if it still holds token. Once
+// expired, it may have been taken by another process, whose lock must
+// be left alone.
+func (c *Client) unlockLoad(lockKey string, token []byte) {
+	item, err := c.Get(lockKey)
+	if err != nil || !bytes.Equal(item.Value, token) {
+		return
+	}
+	_ = c.deleteCAS(context.Background(), item)
+}
+
+// waitLoaded waits up to LoadLockTime for the value of key to be stored
+// by another process. ErrCacheMiss is returned if it isn't.
+func (c *Client) waitLoaded(ctx context.Context, key string) ([]byte, error) {
+	deadline := time.Now().Add(time.Duration(c.LoadLockTime) * time.Second)
+	t := time.NewTicker(loadLockPoll)
+	defer t.Stop()
+	for time.Now().Before(deadline) {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		item, err := c.GetContext(ctx, key)
+		if err == nil {
+			return item.Value, nil
+		}
+		if err != ErrCacheMiss {
+			return nil, err
+		}
+	}
+	return nil, ErrCacheMiss
+}
+
+// logWriteBack logs the failure to store the loaded value of key.
+func (c *Client) logWriteBack(key string, err error) {
+	index, perr := c.servers.PickServerIndex(key)
+	if perr != nil {
+		return
+	}
+	c.servers.logger(index).Warn("memcache: storing loaded value", "server", c.servers.Name(index), "key", key, "error", err)
+}
+
+// GetMultiOrLoad gets the values for keys like GetMulti and, for the
+// missing ones, calls loader once with those keys. The values it returns
+// are stored with the expiration ttl, in the same format as
+// Item.Expiration, by a pipeline of quiet sets per server. The returned
+// map holds the values found and loaded, keys missing from both are
+// absent.
+//
+// Keys already being loaded by a concurrent GetMultiOrLoad or GetOrLoad
+// aren't given to loader, their values are waited for instead. Failures
+// to store the loaded values are logged, but don't fail the call.
+//
+// The keys of a server which can't be reached aren't given to loader
+// either, so that an unavailable server doesn't send all its keys to
+// the backend. They're absent from the returned map, which holds the
+// other values along with an error listing them.
+func (c *Client) GetMultiOrLoad(keys []string, ttl int32, loader func(ctx context.Context, missing []string) (map[string][]byte, error)) (map[string][]byte, error) {
+	return c.GetMultiOrLoadContext(context.Background(), keys, ttl, loader)
+}
+
+// GetMultiOrLoadContext is like GetMultiOrLoad, with a context as in
+// GetMultiContext, which is given to loader.
+func (c *Client) GetMultiOrLoadContext(ctx context.Context, keys []string, ttl int32, loader func(ctx context.Context, missing []string) (map[string][]byte, error)) (map[string][]byte, error) {
+	items, failed, failedErrs, err := c.getMulti(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(keys))
+	for key, item := range items {
+		values[key] = item.Value
+	}
+	unavailable := make(map[string]bool, len(failed))
+	var failedKeys []string
+	var errs []error
+	for ii, key := range failed {
+		if !unavailable[key] {
+			unavailable[key] = true
+			failedKeys = append(failedKeys, key)
+			errs = append(errs, failedErrs[ii])
+		}
+	}
+	var missing []string
+	calls := make(map[string]*loadCall)
+	waiting := make(map[string]*loadCall)
+	for _, key := range keys {
+		if _, ok := values[key]; ok || unavailable[key] {
+			continue
+		}
+		if _, ok := calls[key]; ok {
+			continue
+		}
+		if _, ok := waiting[key]; ok {
+			continue
+		}
+		call, run := c.loads.join(key)
+		if run {
+			calls[key] = call
+			missing = append(missing, key)
+		} else {
+			waiting[key] = call
+		}
+	}
+
+	if len(missing) > 0 {
+		loaded, err := c.loadMulti(ctx, missing, calls, ttl, loader)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range missing {
+			if value, ok := loaded[key]; ok {
+				values[key] = value
+			}
+		}
+	}
+	for key, call := range waiting {
+		value, err := call.wait(ctx)
+		switch err {
+		case nil:
+			values[key] = value
+		case ErrCacheMiss:
+		default:
+			return nil, err
+		}
+	}
+	return values, failuresError("failed to get some keys: ", failedKeys, errs)
+}
+
+// loadMulti calls loader with the missing keys, stores the values it
+// returns and finishes the calls loading them. The keys it doesn't
+// return finish with ErrCacheMiss.
+func (c *Client) loadMulti(ctx context.Context, missing []string, calls map[string]*loadCall, ttl int32, loader func(ctx context.Context, missing []string) (map[string][]byte, error)) (loaded map[string][]byte, err error) {
+	err = errLoaderPanicked
+	defer func() {
+		for key, call := range calls {
+			switch value, ok := loaded[key]; {
+			case err != nil:
+				c.loads.finish(key, call, nil, err)
+			case ok:
+				c.loads.finish(key, call, value, nil)
+			default:
+				c.loads.finish(key, call, nil, ErrCacheMiss)
+			}
+		}
+	}()
+	loaded, err = loader(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	var items []*Item
+	for _, key := range missing {
+		if value, ok := loaded[key]; ok {
+			items = append(items, &Item{Key: key, Value: value, Expiration: ttl})
+		}
+	}
+	failed, errs := c.setQ(ctx, items)
+	for ii, key := range failed {
+		c.logWriteBack(key, errs[ii])
+	}
+	return loaded, nil
+}
+
+// setQ sets items with a pipeline of quiet sets per server, and returns
+// the keys which couldn't be stored along with their errors.
+func (c *Client) setQ(ctx context.Context, items []*Item) (failed []string, errs []error) {
+	itemMap := make(map[uint32][]*Item)
+	for _, item := range items {
+		serverIndex, err := c.servers.PickServerIndex(item.Key)
+		if err != nil {
+			failed = append(failed, item.Key)
+			errs = append(errs, err)
+			continue
+		}
+		itemMap[serverIndex] = append(itemMap[serverIndex], item)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	op := OpSet + "_q"
+	if c.Tracer != nil {
+		var span Span
+		ctx, span = c.startSpan(ctx, spanPrefix+op, op, len(items))
+		defer span.End()
+	}
+
+	wg.Add(len(itemMap))
+	for addr, items := range itemMap {
+		go func(serverIndex uint32, items []*Item) {
+			defer wg.Done()
+			keys := make([]string, len(items))
+			for ii, item := range items {
+				keys[ii] = item.Key
+			}
+			ctx, req := c.startServerRequest(ctx, op, serverIndex, keys)
+			itemErrs := c.setQServer(ctx, &req, serverIndex, items)
+			var err error
+			for _, err = range itemErrs {
+				if err != nil {
+					break
+				}
+			}
+			req.end(0, 0, err)
+			if len(itemErrs) == 0 {
+				return
+			}
+			mu.Lock()
+			for ii, key := range keys {
+				if itemErrs[ii] != nil {
+					failed = append(failed, key)
+					errs = append(errs, itemErrs[ii])
+				}
+			}
+			mu.Unlock()
+		}(addr, items)
+	}
+	wg.Wait()
+	return failed, errs
+}
+
+// setQServer runs the quiet sets of items on the given server. The
+// returned slice is either nil or has one entry per item. On a
+// connection error, only the items without an answer are failed with it
+// when the codec can tell them apart.
+func (c *Client) setQServer(ctx context.Context, req *request, serverIndex uint32, items []*Item) []error {
+	fail := func(err error) []error {
+		errs := make([]error, len(items))
+		for ii := range errs {
+			errs[ii] = err
+		}
+		return errs
+	}
+
+	cn, err := c.getConnection(ctx, serverIndex)
+	if err != nil {
+		return fail(err)
+	}
+	req.acquired(cn)
+	errs, err := cn.codec.setQ(cn, req, items)
+	c.releaseConnection(req, cn, err)
+	if err != nil && errs == nil {
+		return fail(err)
+	}
+	return errs
+}
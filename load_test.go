@@ -0,0 +1,355 @@
+package memcache
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dev-lazarev/memcache/memtest"
+)
+
+func TestGetOrLoad(t *testing.T) {
+	c := newLocalhostServer(t)
+	ctx := context.Background()
+
+	var loads int32
+	release := make(chan struct{})
+	loader := func(context.Context) ([]byte, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return []byte("loaded"), nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := c.GetOrLoad(ctx, "key", 100, loader)
+			if err != nil || string(value) != "loaded" {
+				t.Errorf("GetOrLoad = %q, %v, want loaded", value, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Errorf("loader called %d times, want 1", n)
+	}
+	if item, err := c.Get("key"); err != nil || string(item.Value) != "loaded" {
+		t.Errorf("Get of the loaded key = %+v, %v, want loaded", item, err)
+	}
+	if _, err := c.GetOrLoad(ctx, "key", 100, loader); err != nil || atomic.LoadInt32(&loads) != 1 {
+		t.Errorf("GetOrLoad of a cached key = %v with %d loads, want the cached value", err, atomic.LoadInt32(&loads))
+	}
+
+	loadErr := errors.New("load failed")
+	failing := func(context.Context) ([]byte, error) { return nil, loadErr }
+	if _, err := c.GetOrLoad(ctx, "failing", 100, failing); err != loadErr {
+		t.Errorf("GetOrLoad with a failing loader = %v, want %v", err, loadErr)
+	}
+	if _, err := c.Get("failing"); err != ErrCacheMiss {
+		t.Errorf("Get after a failed load = %v, want ErrCacheMiss", err)
+	}
+
+	// A waiter gives up with its context.
+	block := make(chan struct{})
+	defer close(block)
+	started := make(chan struct{})
+	go c.GetOrLoad(ctx, "slow", 100, func(context.Context) ([]byte, error) {
+		close(started)
+		<-block
+		return nil, loadErr
+	})
+	<-started
+	waitCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetOrLoad(waitCtx, "slow", 100, loader); err != context.DeadlineExceeded {
+		t.Errorf("GetOrLoad waiting past its deadline = %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestGetOrLoadLock(t *testing.T) {
+	s := memtest.NewServer()
+	defer s.Close()
+	newClient := func() *Client {
+		c, err := New([]Config{{Server: s.Addr, MaxIdle: 2, MaxCap: 4, ConnectionTimeout: time.Second}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(c.Close)
+		c.LoadLockTime = 1
+		return c
+	}
+	// Two clients stand for two processes.
+	c1, c2 := newClient(), newClient()
+	ctx := context.Background()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		_, err := c1.GetOrLoad(ctx, "key", 100, func(context.Context) ([]byte, error) {
+			close(started)
+			<-release
+			return []byte("v1"), nil
+		})
+		done <- err
+	}()
+	<-started
+	go func() {
+		time.Sleep(3 * loadLockPoll)
+		close(release)
+	}()
+	value, err := c2.GetOrLoad(ctx, "key", 100, func(context.Context) ([]byte, error) {
+		return []byte("v2"), nil
+	})
+	if err != nil || string(value) != "v1" {
+		t.Errorf("GetOrLoad while another process holds the lock = %q, %v, want v1", value, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("GetOrLoad holding the lock: %v", err)
+	}
+	if _, err := c1.Get("key" + loadLockSuffix); err != ErrCacheMiss {
+		t.Errorf("Get of the lock after the load = %v, want ErrCacheMiss", err)
+	}
+
+	// A lock whose owner never stores the value is waited for until it
+	// expires.
+	if err := c1.Add(&Item{Key: "orphan" + loadLockSuffix, Value: []byte{'1'}, Expiration: 1}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	value, err = c2.GetOrLoad(ctx, "orphan", 100, func(context.Context) ([]byte, error) {
+		return []byte("v2"), nil
+	})
+	if err != nil || string(value) != "v2" {
+		t.Errorf("GetOrLoad with an orphan lock = %q, %v, want v2", value, err)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("GetOrLoad with an orphan lock returned after %v, want LoadLockTime", d)
+	}
+}
+
+func TestGetMultiOrLoad(t *testing.T) {
+	for _, protocol := range []Protocol{ProtocolBinary, ProtocolText, ProtocolMeta} {
+		t.Run(protocol.String(), func(t *testing.T) {
+			s := memtest.NewUnstartedServer()
+			s.MaxItemSize = 100
+			if err := s.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			logger := &recordingLogger{}
+			c, err := New([]Config{{Server: s.Addr, MaxIdle: 2, MaxCap: 4, ConnectionTimeout: time.Second, Protocol: protocol, Logger: logger}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			testGetMultiOrLoad(t, c, logger)
+		})
+	}
+}
+
+func testGetMultiOrLoad(t *testing.T, c *Client, logger *recordingLogger) {
+	if err := c.Set(&Item{Key: "a", Value: []byte("cached")}); err != nil {
+		t.Fatal(err)
+	}
+	var calls [][]string
+	loader := func(_ context.Context, missing []string) (map[string][]byte, error) {
+		calls = append(calls, missing)
+		values := map[string][]byte{"unrequested": []byte("x")}
+		for _, key := range missing {
+			if key != "absent" {
+				values[key] = []byte("loaded " + key)
+			}
+		}
+		return values, nil
+	}
+	values, err := c.GetMultiOrLoad([]string{"a", "b", "c", "b", "absent"}, 100, loader)
+	if err != nil {
+		t.Fatalf("GetMultiOrLoad: %v", err)
+	}
+	want := map[string]string{"a": "cached", "b": "loaded b", "c": "loaded c"}
+	if len(values) != len(want) {
+		t.Errorf("GetMultiOrLoad = %q, want %q", values, want)
+	}
+	for key, value := range want {
+		if string(values[key]) != value {
+			t.Errorf("GetMultiOrLoad value of %s = %q, want %q", key, values[key], value)
+		}
+	}
+	if len(calls) != 1 || len(calls[0]) != 3 {
+		t.Errorf("loader called with %q, want a single call with b, c and absent", calls)
+	}
+	items, err := c.GetMulti([]string{"b", "c", "absent", "unrequested"})
+	if err != nil || len(items) != 2 || string(items["b"].Value) != "loaded b" || string(items["c"].Value) != "loaded c" {
+		t.Errorf("GetMulti of the loaded keys = %v, %v, want b and c", items, err)
+	}
+
+	calls = nil
+	if _, err := c.GetMultiOrLoad([]string{"a", "b"}, 100, loader); err != nil || calls != nil {
+		t.Errorf("GetMultiOrLoad of cached keys = %v, loader called with %q, want no call", err, calls)
+	}
+	loadErr := errors.New("load failed")
+	if _, err := c.GetMultiOrLoad([]string{"d"}, 100, func(context.Context, []string) (map[string][]byte, error) {
+		return nil, loadErr
+	}); err != loadErr {
+		t.Errorf("GetMultiOrLoad with a failing loader = %v, want %v", err, loadErr)
+	}
+
+	// Failing to store a value doesn't fail the call, nor the stores of
+	// the other values.
+	big := make([]byte, 200)
+	values, err = c.GetMultiOrLoad([]string{"small1", "big", "small2"}, 100, func(context.Context, []string) (map[string][]byte, error) {
+		return map[string][]byte{"small1": []byte("1"), "big": big, "small2": []byte("2")}, nil
+	})
+	if err != nil || len(values["big"]) != len(big) || len(values) != 3 {
+		t.Errorf("GetMultiOrLoad with a value too large to store = %v, want the loaded values", err)
+	}
+	if n := logger.count(LevelWarn, "memcache: storing loaded value"); n != 1 {
+		t.Errorf("%d write back failures logged, want 1", n)
+	}
+	for _, key := range []string{"small1", "small2"} {
+		if item, err := c.Get(key); err != nil || len(item.Value) != 1 {
+			t.Errorf("Get(%q) after a batch with a value too large = %v, want it stored", key, err)
+		}
+	}
+
+	// A key being loaded by GetOrLoad is waited for instead of loaded.
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.GetOrLoad(context.Background(), "slow", 100, func(context.Context) ([]byte, error) {
+			close(started)
+			<-release
+			return []byte("slow value"), nil
+		})
+	}()
+	<-started
+	calls = nil
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	values, err = c.GetMultiOrLoad([]string{"slow", "e"}, 100, loader)
+	if err != nil || string(values["slow"]) != "slow value" || string(values["e"]) != "loaded e" {
+		t.Errorf("GetMultiOrLoad with a key being loaded = %q, %v, want slow value and loaded e", values, err)
+	}
+	if len(calls) != 1 || len(calls[0]) != 1 || calls[0][0] != "e" {
+		t.Errorf("loader called with %q, want e only", calls)
+	}
+	<-done
+}
+
+func TestGetOrLoadLockOwnership(t *testing.T) {
+	for _, protocol := range []Protocol{ProtocolBinary, ProtocolText, ProtocolMeta} {
+		t.Run(protocol.String(), func(t *testing.T) {
+			testGetOrLoadLockOwnership(t, protocol)
+		})
+	}
+}
+
+func testGetOrLoadLockOwnership(t *testing.T, protocol Protocol) {
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	s := memtest.NewUnstartedServer()
+	s.Clock = clock.Now
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := New([]Config{{Server: s.Addr, MaxIdle: 2, MaxCap: 4, ConnectionTimeout: time.Second, Protocol: protocol}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.LoadLockTime = 1
+	ctx := context.Background()
+
+	// A lock which expired during the load and was taken by another
+	// process is left to it.
+	value, err := c.GetOrLoad(ctx, "key", 100, func(context.Context) ([]byte, error) {
+		clock.Advance(2 * time.Second)
+		if err := c.Add(&Item{Key: "key" + loadLockSuffix, Value: []byte("other"), Expiration: 1}); err != nil {
+			t.Errorf("Add of the expired lock: %v", err)
+		}
+		return []byte("loaded"), nil
+	})
+	if err != nil || string(value) != "loaded" {
+		t.Fatalf("GetOrLoad = %q, %v, want loaded", value, err)
+	}
+	if item, err := c.Get("key" + loadLockSuffix); err != nil || string(item.Value) != "other" {
+		t.Errorf("Get of the lock taken by another process = %+v, %v, want it kept", item, err)
+	}
+
+	if protocol == ProtocolMeta {
+		// memtest can't make an mg miss through a fault.
+		return
+	}
+	// A value stored before the lock is taken isn't loaded again.
+	if err := c.Set(&Item{Key: "stored", Value: []byte("stored")}); err != nil {
+		t.Fatal(err)
+	}
+	s.InjectFault(memtest.Fault{Command: "get", Key: "stored", Times: 1, Status: memtest.StatusKeyNotFound})
+	value, err = c.GetOrLoad(ctx, "stored", 100, func(context.Context) ([]byte, error) {
+		t.Error("loader called for a value stored before the lock was taken")
+		return nil, nil
+	})
+	if err != nil || string(value) != "stored" {
+		t.Errorf("GetOrLoad of a value stored meanwhile = %q, %v, want stored", value, err)
+	}
+	if _, err := c.Get("stored" + loadLockSuffix); err != ErrCacheMiss {
+		t.Errorf("Get of the released lock = %v, want ErrCacheMiss", err)
+	}
+}
+
+func TestGetMultiOrLoadServerDown(t *testing.T) {
+	s1, s2 := memtest.NewServer(), memtest.NewServer()
+	defer s1.Close()
+	c, err := New([]Config{
+		{Server: s1.Addr, MaxIdle: 1, MaxCap: 2, ConnectionTimeout: time.Second},
+		{Server: s2.Addr, MaxIdle: 1, MaxCap: 2, ConnectionTimeout: time.Second},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s2.Close()
+
+	var up, down []string
+	for i := 0; len(up) < 2 || len(down) < 2; i++ {
+		key := "key" + strconv.Itoa(i)
+		index, err := c.servers.PickServerIndex(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.servers.Name(index) == s2.Addr {
+			down = append(down, key)
+		} else {
+			up = append(up, key)
+		}
+	}
+	var calls [][]string
+	values, err := c.GetMultiOrLoad(append(up, down...), 100, func(_ context.Context, missing []string) (map[string][]byte, error) {
+		calls = append(calls, missing)
+		values := make(map[string][]byte)
+		for _, key := range missing {
+			values[key] = []byte("loaded")
+		}
+		return values, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), down[0]) || !strings.Contains(err.Error(), down[1]) {
+		t.Errorf("GetMultiOrLoad with a server down = %v, want an error for %q", err, down)
+	}
+	if len(calls) != 1 || len(calls[0]) != len(up) {
+		t.Errorf("loader called with %q, want only %q", calls, up)
+	}
+	if len(values) != len(up) || string(values[up[0]]) != "loaded" {
+		t.Errorf("GetMultiOrLoad values = %q, want those of %q", values, up)
+	}
+}
@@ -0,0 +1,94 @@
+package memcache
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives the diagnostic messages of a Client: connections being
+// opened and closed, authentication failures, servers becoming
+// unreachable and protocol errors. Messages are followed by alternating
+// keys and values, like in log/slog, and *slog.Logger implements Logger.
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// LogLevel is the severity of a message given to a Logger.
+type LogLevel int
+
+// Log levels, with the same values as the slog ones.
+const (
+	LevelDebug LogLevel = -4
+	LevelInfo  LogLevel = 0
+	LevelWarn  LogLevel = 4
+	LevelError LogLevel = 8
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// NewStdLogger returns a Logger writing the messages of at least the
+// given level to l, as "LEVEL msg key=value...".
+func NewStdLogger(l *log.Logger, level LogLevel) Logger {
+	return &stdLogger{l: l, level: level}
+}
+
+type stdLogger struct {
+	l     *log.Logger
+	level LogLevel
+}
+
+func (s *stdLogger) Debug(msg string, args ...any) { s.log(LevelDebug, msg, args) }
+func (s *stdLogger) Info(msg string, args ...any)  { s.log(LevelInfo, msg, args) }
+func (s *stdLogger) Warn(msg string, args ...any)  { s.log(LevelWarn, msg, args) }
+func (s *stdLogger) Error(msg string, args ...any) { s.log(LevelError, msg, args) }
+
+func (s *stdLogger) log(level LogLevel, msg string, args []any) {
+	if level < s.level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		b.WriteByte(' ')
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, "!BADKEY=%v", args[i])
+			break
+		}
+		fmt.Fprintf(&b, "%v=%v", args[i], args[i+1])
+	}
+	_ = s.l.Output(3, b.String())
+}
+
+// nopLogger discards every message, it's used when Config.Logger is nil.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+func (c Config) logger() Logger {
+	if c.Logger == nil {
+		return nopLogger{}
+	}
+	return c.Logger
+}
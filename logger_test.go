@@ -0,0 +1,120 @@
+package memcache
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type logRecord struct {
+	level LogLevel
+	msg   string
+	args  []any
+}
+
+type recordingLogger struct {
+	mu      sync.Mutex
+	records []logRecord
+}
+
+func (l *recordingLogger) log(level LogLevel, msg string, args []any) {
+	l.mu.Lock()
+	l.records = append(l.records, logRecord{level, msg, args})
+	l.mu.Unlock()
+}
+
+func (l *recordingLogger) Debug(msg string, args ...any) { l.log(LevelDebug, msg, args) }
+func (l *recordingLogger) Info(msg string, args ...any)  { l.log(LevelInfo, msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...any)  { l.log(LevelWarn, msg, args) }
+func (l *recordingLogger) Error(msg string, args ...any) { l.log(LevelError, msg, args) }
+
+// count returns how many messages msg were logged with the given level.
+func (l *recordingLogger) count(level LogLevel, msg string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, r := range l.records {
+		if r.level == level && r.msg == msg {
+			n++
+		}
+	}
+	return n
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0), LevelInfo)
+	l.Debug("hidden")
+	l.Info("shown", "server", "a:1", "n", 2)
+	l.Error("odd", "key")
+	want := "INFO shown server=a:1 n=2\nERROR odd !BADKEY=key\n"
+	if buf.String() != want {
+		t.Errorf("output = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	var dials int32
+	c, err := New([]Config{{
+		Server:         "stub:11211",
+		MaxIdle:        1,
+		MaxCap:         1,
+		User:           "user",
+		Password:       "pencil",
+		SASLMechanisms: []string{"PLAIN"},
+		Logger:         logger,
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// The first two connections are rejected.
+			status, value := uint16(respOk), "Authenticated"
+			if atomic.AddInt32(&dials, 1) <= 2 {
+				status, value = respAuthErr, "Auth failure."
+			}
+			client, server := net.Pipe()
+			go serveSASL(t, server, "PLAIN", []saslExchange{{"\x00user\x00pencil", status, value}})
+			return client, nil
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Get("foo"); err == nil {
+			t.Fatal("Get with rejected credentials: want error, got nil")
+		}
+	}
+	if n := logger.count(LevelError, "memcache: authentication failed"); n != 2 {
+		t.Errorf("logged %d authentication failures, want 2", n)
+	}
+	if n := logger.count(LevelError, "memcache: server unreachable"); n != 1 {
+		t.Errorf("logged server unreachable %d times, want once", n)
+	}
+
+	// The server closes the connection once authenticated.
+	if _, err := c.Get("foo"); err == nil {
+		t.Fatal("Get on closed connection: want error, got nil")
+	}
+	if n := logger.count(LevelInfo, "memcache: server reachable again"); n != 1 {
+		t.Errorf("logged recovery %d times, want once", n)
+	}
+	if n := logger.count(LevelWarn, "memcache: closing connection after error"); n != 1 {
+		t.Errorf("logged %d closed connections, want 1", n)
+	}
+
+	// Nothing but the configured server name and errors is logged.
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	for _, r := range logger.records {
+		for i := 0; i < len(r.args); i += 2 {
+			if key := r.args[i]; key != "server" && key != "error" && key != "reason" {
+				t.Errorf("%s logged with %v", r.msg, key)
+			}
+		}
+	}
+}
@@ -3,9 +3,11 @@ package memcache
 
 import (
 	"bytes"
+	"context"
 	"errors"
-	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func legalKey(key string) bool {
@@ -35,39 +37,130 @@ func New(config []Config) (*Client, error) {
 func NewFromServers(servers *ServerList) *Client {
 	return &Client{
 		servers: servers,
+		status:  make([]serverHealth, servers.PoolLen()),
 	}
 }
 
 // Client is a memcache client.
 // It is safe for unlocked use by multiple concurrent goroutines.
+// Requests to different servers never contend with each other: every
+// server has its own connection pool and the server list is immutable.
+//
+// The Meta methods, GetOrRefresh, SetRefreshed and Invalidate send meta
+// commands, which memcached doesn't take over the default binary
+// protocol: they fail with ErrMetaUnsupported for the keys of servers
+// not configured with ProtocolMeta or ProtocolText.
 type Client struct {
-	mu      sync.Mutex
+	// Observer, if set, is notified of every request and connection
+	// checkout. It should be set before the Client is used.
+	Observer Observer
+
+	// HotKeys, if set, counts a sample of the requested keys to find
+	// the most requested ones. It should be set before the Client is
+	// used.
+	HotKeys *HotKeyTracker
+
+	// SlowOpThreshold, if positive, is the duration above which
+	// requests are reported to OnSlowOp, with the time spent in each
+	// of their phases. Batch operations are reported per server.
+	SlowOpThreshold time.Duration
+
+	// OnSlowOp is called with the requests slower than SlowOpThreshold.
+	// If it's nil they're logged as warnings to the server Logger. It
+	// should be set before the Client is used.
+	OnSlowOp func(SlowOp)
+
+	// Tracer, if set, creates a span for every operation, with a child
+	// span per server for those involving several servers, like
+	// GetMulti. It should be set before the Client is used.
+	Tracer Tracer
+
+	// LoadLockTime, if positive, makes GetOrLoad deduplicate the loads
+	// of concurrent processes too: the loader only runs after adding a
+	// lock item expiring after LoadLockTime seconds, and the callers
+	// finding the lock taken wait up to that time for the value to be
+	// stored instead. It should be longer than the loads, since a lock
+	// which expired may be taken by another process.
+	LoadLockTime int32
+
 	servers *ServerList
+	loads   loadGroup
+	status  []serverHealth
+	closed  int32
 }
 
-// Close closes all currently open connections.
+// Close closes all currently open connections. Requests in flight when
+// Close is called finish normally, after which their connections are
+// closed too. Any request made after Close returns ErrClientClosed.
 func (c *Client) Close() {
-	c.mu.Lock()
-	c.servers.Release()
-	c.mu.Unlock()
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		c.servers.Release()
+	}
+}
+
+func (c *Client) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) != 0
 }
 
-func (c *Client) getConnection(index uint32) (net.Conn, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return c.servers.GetConnection(index)
+// getConnection checks out a connection to the server at index. If ctx
+// has a deadline it's applied to the connection until it's returned.
+func (c *Client) getConnection(ctx context.Context, index uint32) (*poolConn, error) {
+	if c.isClosed() {
+		return nil, ErrClientClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	cn, err := c.servers.getConn(ctx, index)
+	if err == ErrPoolClosed && c.isClosed() {
+		err = ErrClientClosed
+	}
+	if err == nil {
+		if deadline, ok := ctx.Deadline(); ok {
+			if err = cn.SetDeadline(deadline); err != nil {
+				_ = c.closeConnection(index, cn, err)
+				cn = nil
+			} else {
+				cn.hasDeadline = true
+			}
+		}
+	}
+	if c.Observer != nil {
+		c.Observer.ObservePool(PoolEvent{
+			Server:   c.servers.Name(index),
+			Duration: time.Since(start),
+			Err:      err,
+		})
+	}
+	return cn, err
 }
 
-func (c *Client) putConnection(index uint32, conn net.Conn) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return c.servers.PutConnection(index, conn)
+func (c *Client) putConnection(index uint32, conn *poolConn) error {
+	if conn.hasDeadline {
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			return c.closeConnection(index, conn, err)
+		}
+		conn.hasDeadline = false
+	}
+	return c.servers.putConn(index, conn)
 }
 
-func (c *Client) closeConnection(index uint32, conn net.Conn) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return c.servers.CloseConnection(index, conn)
+// closeConnection closes a connection which can't be reused after err,
+// a network or protocol error which left it in an unknown state.
+func (c *Client) closeConnection(index uint32, conn *poolConn, err error) error {
+	c.servers.logger(index).Warn("memcache: closing connection after error", "server", c.servers.Name(index), "error", err)
+	return c.servers.closeConn(index, conn)
+}
+
+// PoolStats returns the connection pool statistics of every server, in
+// the order they were configured.
+func (c *Client) PoolStats() []PoolStats {
+	stats := make([]PoolStats, c.servers.PoolLen())
+	for i := range stats {
+		stats[i] = c.servers.PoolStats(uint32(i))
+	}
+	return stats
 }
 
 // Item is an item to be got or stored in a memcached server.
@@ -91,48 +184,70 @@ type Item struct {
 	casid uint64
 }
 
+// releaseConnection returns cn to the pool of the server of req once a
+// command completed with err, or closes it if err left it in an unknown
+// state.
+func (c *Client) releaseConnection(req *request, cn *poolConn, err error) {
+	req.released()
+	index := req.serverIndex
+	if resumableError(err) {
+		_ = c.putConnection(index, cn)
+	} else {
+		_ = c.closeConnection(index, cn, err)
+	}
+}
+
 // Get gets the item for the given key. ErrCacheMiss is returned for a
 // memcache cache miss. The key must be at most 250 bytes in length.
-func (c *Client) Get(key string) (*Item, error) {
-	serverIndex, err := c.servers.PickServerIndex(key)
-	if err != nil {
-		return nil, err
-	}
-	cn, err := c.getConnection(serverIndex)
-	if err != nil {
-		return nil, err
-	}
-	err = sendConnCommand(cn, key, cmdGet, nil, 0, nil)
-	if err != nil {
-		_ = c.closeConnection(serverIndex, cn)
-		return nil, err
-	}
+func (c *Client) Get(key string) (item *Item, err error) {
+	return c.GetContext(context.Background(), key)
+}
 
-	hdr, k, extras, value, err := parseResponse(key, cn)
+// GetContext is like Get. The context bounds the wait for a connection
+// and the request itself, and carries the parent span for tracing.
+func (c *Client) GetContext(ctx context.Context, key string) (item *Item, err error) {
+	return c.getOne(ctx, OpGet, key, func(cn *poolConn, req *request) (*Item, error) {
+		return cn.codec.get(cn, req, key)
+	})
+}
 
-	switch err {
-	case nil, ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrBadIncrDec:
-		_ = c.putConnection(serverIndex, cn)
-	default:
-		_ = c.closeConnection(serverIndex, cn)
-	}
+// GetAndTouch gets the item for the given key like Get, updating its
+// expiration time, in the same format as Item.Expiration.
+func (c *Client) GetAndTouch(key string, expiration int32) (item *Item, err error) {
+	return c.GetAndTouchContext(context.Background(), key, expiration)
+}
 
+// GetAndTouchContext is like GetAndTouch, with a context as in
+// GetContext.
+func (c *Client) GetAndTouchContext(ctx context.Context, key string, expiration int32) (item *Item, err error) {
+	return c.getOne(ctx, OpGetAndTouch, key, func(cn *poolConn, req *request) (*Item, error) {
+		return cn.codec.getAndTouch(cn, req, key, expiration)
+	})
+}
+
+// getOne runs the retrieval op for key, with get doing the protocol
+// work over a connection to its server.
+func (c *Client) getOne(ctx context.Context, op, key string, get func(*poolConn, *request) (*Item, error)) (item *Item, err error) {
+	serverIndex, err := c.pickServer(key)
 	if err != nil {
 		return nil, err
 	}
-	var flags uint32
-	if len(extras) > 0 {
-		flags = bUint32(extras)
-	}
-	if key == "" && len(k) > 0 {
-		key = string(k)
+	ctx, req := c.startRequest(ctx, op, serverIndex, key)
+	defer func() {
+		hits, size := 0, 0
+		if item != nil {
+			hits, size = 1, len(item.Value)
+		}
+		req.end(hits, size, err)
+	}()
+	cn, err := c.getConnection(ctx, serverIndex)
+	if err != nil {
+		return nil, err
 	}
-	return &Item{
-		Key:   key,
-		Value: value,
-		Flags: flags,
-		casid: bUint64(hdr[16:24]),
-	}, nil
+	req.acquired(cn)
+	item, err = get(cn, &req)
+	c.releaseConnection(&req, cn, err)
+	return item, err
 }
 
 // GetMulti is a batch version of Get. The returned map from keys to
@@ -140,92 +255,110 @@ func (c *Client) Get(key string) (*Item, error) {
 // cache misses. Each key must be at most 250 bytes in length.
 // If no error is returned, the returned map will also be non-nil.
 func (c *Client) GetMulti(keys []string) (map[string]*Item, error) {
+	return c.GetMultiContext(context.Background(), keys)
+}
+
+// GetMultiContext is like GetMulti. The context bounds the wait for
+// connections and the requests themselves, and carries the parent span
+// for tracing.
+func (c *Client) GetMultiContext(ctx context.Context, keys []string) (map[string]*Item, error) {
+	items, _, _, err := c.getMulti(ctx, keys)
+	return items, err
+}
+
+// getMulti is GetMultiContext, also returning the keys not got from the
+// servers which failed, along with their errors. Those keys are missing
+// from items, like the ones not found.
+func (c *Client) getMulti(ctx context.Context, keys []string) (items map[string]*Item, failed []string, errs []error, err error) {
+	if c.isClosed() {
+		return nil, nil, nil, ErrClientClosed
+	}
 	keyMap := make(map[uint32][]string)
 	for _, key := range keys {
-		serverIndex, err := c.servers.PickServerIndex(key)
+		serverIndex, err := c.pickServer(key)
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
 		}
 		keyMap[serverIndex] = append(keyMap[serverIndex], key)
 	}
 
 	mu := sync.Mutex{}
-	items := make(map[string]*Item)
+	items = make(map[string]*Item)
 	wg := sync.WaitGroup{}
 
+	if c.Tracer != nil {
+		var span Span
+		ctx, span = c.startSpan(ctx, spanPrefix+OpGetMulti, OpGetMulti, len(keys))
+		defer func() {
+			span.SetAttributes(Attribute{AttrHits, len(items)}, Attribute{AttrMisses, len(keys) - len(items)})
+			span.End()
+		}()
+	}
+
 	wg.Add(len(keyMap))
 	for addr, keys := range keyMap {
 		go func(serverIndex uint32, keys []string) {
 			defer wg.Done()
-			cn, err := c.servers.GetConnection(serverIndex)
+			ctx, req := c.startServerRequest(ctx, OpGetMulti, serverIndex, keys)
+			hits, size, err := c.getMultiFromServer(ctx, &req, serverIndex, keys, func(it *Item) {
+				mu.Lock()
+				items[it.Key] = it
+				mu.Unlock()
+			})
+			req.end(hits, size, err)
 			if err != nil {
-				return
-			}
-			for _, k := range keys {
-				if err = sendConnCommand(cn, k, cmdGetKQ, nil, 0, nil); err != nil {
-					switch err {
-					case nil, ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrBadIncrDec:
-						_ = c.putConnection(serverIndex, cn)
-					default:
-						_ = c.closeConnection(serverIndex, cn)
-					}
-					return
-				}
-			}
-			if err = sendConnCommand(cn, "", cmdNoop, nil, 0, nil); err != nil {
-				switch err {
-				case nil, ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrBadIncrDec:
-					_ = c.putConnection(serverIndex, cn)
-				default:
-					_ = c.closeConnection(serverIndex, cn)
-				}
-				return
-			}
-			for {
-				hdr, k, extras, value, err := parseResponse("", cn)
-				if err != nil {
-					break
-				}
-				if len(k) == 0 {
-					break
-				}
-
-				var flags uint32
-				if len(extras) > 0 {
-					flags = bUint32(extras)
-				}
-
 				mu.Lock()
-				items[string(k)] = &Item{
-					Key:   string(k),
-					Value: value,
-					Flags: flags,
-					casid: bUint64(hdr[16:24]),
+				for _, key := range keys {
+					if _, ok := items[key]; !ok {
+						failed = append(failed, key)
+						errs = append(errs, err)
+					}
 				}
 				mu.Unlock()
 			}
-			switch err {
-			case nil, ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrBadIncrDec:
-				_ = c.putConnection(serverIndex, cn)
-			default:
-				_ = c.closeConnection(serverIndex, cn)
-			}
 		}(addr, keys)
 	}
 	wg.Wait()
 
-	return items, nil
+	return items, failed, errs, nil
+}
+
+// getMultiFromServer gets keys from the given server and calls found
+// for every hit. It returns the number of hits and their total size.
+func (c *Client) getMultiFromServer(ctx context.Context, req *request, serverIndex uint32, keys []string, found func(*Item)) (hits, size int, err error) {
+	cn, err := c.getConnection(ctx, serverIndex)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.acquired(cn)
+	err = cn.codec.getMulti(cn, req, keys, func(it *Item) {
+		found(it)
+		hits++
+		size += len(it.Value)
+	})
+	c.releaseConnection(req, cn, err)
+	return hits, size, err
 }
 
 // Set writes the given item, unconditionally.
 func (c *Client) Set(item *Item) error {
-	return c.populateOne(cmdSet, item, 0)
+	return c.populateOne(context.Background(), cmdSet, item, 0)
+}
+
+// SetContext is like Set, with a context as in GetContext.
+func (c *Client) SetContext(ctx context.Context, item *Item) error {
+	return c.populateOne(ctx, cmdSet, item, 0)
 }
 
 // Add writes the given item, if no value already exists for its
 // key. ErrNotStored is returned if that condition is not met.
 func (c *Client) Add(item *Item) error {
-	return c.populateOne(cmdAdd, item, 0)
+	return c.populateOne(context.Background(), cmdAdd, item, 0)
+}
+
+// AddContext is like Add, with a context as in GetContext.
+func (c *Client) AddContext(ctx context.Context, item *Item) error {
+	return c.populateOne(ctx, cmdAdd, item, 0)
 }
 
 // CompareAndSwap writes the given item that was previously returned
@@ -236,70 +369,93 @@ func (c *Client) Add(item *Item) error {
 // calls. ErrNotStored is returned if the value was evicted in between
 // the calls.
 func (c *Client) CompareAndSwap(item *Item) error {
-	return c.populateOne(cmdSet, item, item.casid)
+	return c.populateOne(context.Background(), cmdSet, item, item.casid)
 }
 
-func (c *Client) populateOne(cmd command, item *Item, casid uint64) error {
-	extras := make([]byte, 8)
-	putUint32(extras, item.Flags)
-	putUint32(extras[4:8], uint32(item.Expiration))
+// CompareAndSwapContext is like CompareAndSwap, with a context as in
+// GetContext.
+func (c *Client) CompareAndSwapContext(ctx context.Context, item *Item) error {
+	return c.populateOne(ctx, cmdSet, item, item.casid)
+}
 
-	serverIndex, err := c.servers.PickServerIndex(item.Key)
+func (c *Client) populateOne(ctx context.Context, cmd command, item *Item, casid uint64) (err error) {
+	serverIndex, err := c.pickServer(item.Key)
 	if err != nil {
 		return err
 	}
-	cn, err := c.getConnection(serverIndex)
-	if err != nil {
-		return err
+	op := OpSet
+	if cmd == cmdAdd {
+		op = OpAdd
+	} else if casid != 0 {
+		op = OpCAS
 	}
-
-	err = sendConnCommand(cn, item.Key, cmd, item.Value, casid, extras)
+	ctx, req := c.startRequest(ctx, op, serverIndex, item.Key)
+	defer func() {
+		req.end(0, len(item.Value), err)
+	}()
+	cn, err := c.getConnection(ctx, serverIndex)
 	if err != nil {
-		_ = c.closeConnection(serverIndex, cn)
-		return err
-	}
-
-	hdr, _, _, _, err := parseResponse(item.Key, cn)
-
-	switch err {
-	case nil, ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrBadIncrDec:
-		_ = c.putConnection(serverIndex, cn)
-	default:
-		_ = c.closeConnection(serverIndex, cn)
 		return err
 	}
-
-	item.casid = bUint64(hdr[16:24])
-	return nil
+	req.acquired(cn)
+	err = cn.codec.store(cn, &req, cmd, item, casid)
+	c.releaseConnection(&req, cn, err)
+	return err
 }
 
 // Delete deletes the item with the provided key. The error ErrCacheMiss is
 // returned if the item didn't already exist in the cache.
 func (c *Client) Delete(key string) error {
-	serverIndex, err := c.servers.PickServerIndex(key)
-	if err != nil {
-		return err
-	}
-	cn, err := c.getConnection(serverIndex)
-	if err != nil {
-		return err
-	}
-	err = sendConnCommand(cn, key, cmdDelete, nil, 0, nil)
+	return c.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete, with a context as in GetContext.
+func (c *Client) DeleteContext(ctx context.Context, key string) (err error) {
+	return c.keyCommand(ctx, OpDelete, key, func(cn *poolConn, req *request) error {
+		return cn.codec.delete(cn, req, key, 0)
+	})
+}
+
+// deleteCAS deletes item only if it wasn't modified since it was got.
+// ErrCASConflict is returned if it was.
+func (c *Client) deleteCAS(ctx context.Context, item *Item) error {
+	return c.keyCommand(ctx, OpDelete, item.Key, func(cn *poolConn, req *request) error {
+		return cn.codec.delete(cn, req, item.Key, item.casid)
+	})
+}
+
+// Touch updates the expiration time of the item with the provided key,
+// in the same format as Item.Expiration. The error ErrCacheMiss is
+// returned if the item isn't in the cache.
+func (c *Client) Touch(key string, expiration int32) error {
+	return c.TouchContext(context.Background(), key, expiration)
+}
+
+// TouchContext is like Touch, with a context as in GetContext.
+func (c *Client) TouchContext(ctx context.Context, key string, expiration int32) error {
+	return c.keyCommand(ctx, OpTouch, key, func(cn *poolConn, req *request) error {
+		return cn.codec.touch(cn, req, key, expiration)
+	})
+}
+
+// keyCommand runs op, a command on key without a result, with run doing
+// the protocol work over a connection to its server.
+func (c *Client) keyCommand(ctx context.Context, op, key string, run func(*poolConn, *request) error) (err error) {
+	serverIndex, err := c.pickServer(key)
 	if err != nil {
-		_ = c.closeConnection(serverIndex, cn)
 		return err
 	}
-
+	ctx, req := c.startRequest(ctx, op, serverIndex, key)
+	defer func() {
+		req.end(0, 0, err)
+	}()
+	cn, err := c.getConnection(ctx, serverIndex)
 	if err != nil {
 		return err
 	}
-	_, _, _, _, err = parseResponse(key, cn)
-	switch err {
-	case nil, ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrBadIncrDec:
-		_ = c.putConnection(serverIndex, cn)
-	default:
-		_ = c.closeConnection(serverIndex, cn)
-	}
+	req.acquired(cn)
+	err = run(cn, &req)
+	c.releaseConnection(&req, cn, err)
 	return err
 }
 
@@ -309,7 +465,12 @@ func (c *Client) Delete(key string) error {
 // memcached must be an decimal number, or an error will be returned.
 // On 64-bit overflow, the new value wraps around.
 func (c *Client) Increment(key string, delta uint64) (newValue uint64, err error) {
-	return c.incrDecr(cmdIncr, key, delta)
+	return c.incrDecr(context.Background(), cmdIncr, key, delta, 0, noAutoCreate)
+}
+
+// IncrementContext is like Increment, with a context as in GetContext.
+func (c *Client) IncrementContext(ctx context.Context, key string, delta uint64) (newValue uint64, err error) {
+	return c.incrDecr(ctx, cmdIncr, key, delta, 0, noAutoCreate)
 }
 
 // Decrement atomically decrements key by delta. The return value is
@@ -319,91 +480,313 @@ func (c *Client) Increment(key string, delta uint64) (newValue uint64, err error
 // On underflow, the new value is capped at zero and does not wrap
 // around.
 func (c *Client) Decrement(key string, delta uint64) (newValue uint64, err error) {
-	return c.incrDecr(cmdDecr, key, delta)
+	return c.incrDecr(context.Background(), cmdDecr, key, delta, 0, noAutoCreate)
+}
+
+// DecrementContext is like Decrement, with a context as in GetContext.
+func (c *Client) DecrementContext(ctx context.Context, key string, delta uint64) (newValue uint64, err error) {
+	return c.incrDecr(ctx, cmdDecr, key, delta, 0, noAutoCreate)
+}
+
+// IncrementWithDefault atomically increments key by delta. If the key
+// does not exist it is created with the value initial and the given
+// expiration, in the same format as Item.Expiration but not negative:
+// ErrNegativeExpiration is returned for those. The return value is the
+// new value after being incremented or an error.
+func (c *Client) IncrementWithDefault(key string, delta, initial uint64, expiration int32) (newValue uint64, err error) {
+	return c.IncrementWithDefaultContext(context.Background(), key, delta, initial, expiration)
 }
 
-func (c *Client) incrDecr(cmd command, key string, delta uint64) (uint64, error) {
-	extras := make([]byte, 20)
-	putUint64(extras, delta)
-	// Set expiration to 0xfffffff, so the command fails if the key
-	// does not exist.
-	for ii := 16; ii < 20; ii++ {
-		extras[ii] = 0xff
+// IncrementWithDefaultContext is like IncrementWithDefault, with a context
+// as in GetContext.
+func (c *Client) IncrementWithDefaultContext(ctx context.Context, key string, delta, initial uint64, expiration int32) (newValue uint64, err error) {
+	exp, err := createExpiration(expiration)
+	if err != nil {
+		return 0, err
 	}
+	return c.incrDecr(ctx, cmdIncr, key, delta, initial, exp)
+}
+
+// DecrementWithDefault atomically decrements key by delta. If the key
+// does not exist it is created with the value initial and the given
+// expiration, in the same format as Item.Expiration but not negative:
+// ErrNegativeExpiration is returned for those. The return value is the
+// new value after being decremented or an error.
+func (c *Client) DecrementWithDefault(key string, delta, initial uint64, expiration int32) (newValue uint64, err error) {
+	return c.DecrementWithDefaultContext(context.Background(), key, delta, initial, expiration)
+}
 
-	serverIndex, err := c.servers.PickServerIndex(key)
+// DecrementWithDefaultContext is like DecrementWithDefault, with a context
+// as in GetContext.
+func (c *Client) DecrementWithDefaultContext(ctx context.Context, key string, delta, initial uint64, expiration int32) (newValue uint64, err error) {
+	exp, err := createExpiration(expiration)
 	if err != nil {
 		return 0, err
 	}
-	cn, err := c.getConnection(serverIndex)
+	return c.incrDecr(ctx, cmdDecr, key, delta, initial, exp)
+}
+
+// IncrementQ increments every key in keys by delta using quiet commands,
+// pipelined per server. Missing keys are created with the value initial
+// and the given expiration, as with IncrementWithDefault, but the new
+// values are not returned.
+func (c *Client) IncrementQ(keys []string, delta, initial uint64, expiration int32) error {
+	return c.IncrementQContext(context.Background(), keys, delta, initial, expiration)
+}
+
+// IncrementQContext is like IncrementQ, with a context as in GetContext.
+func (c *Client) IncrementQContext(ctx context.Context, keys []string, delta, initial uint64, expiration int32) error {
+	exp, err := createExpiration(expiration)
+	if err != nil {
+		return err
+	}
+	return c.incrDecrQ(ctx, cmdIncrementQ, keys, delta, initial, exp)
+}
+
+// DecrementQ decrements every key in keys by delta using quiet commands,
+// pipelined per server. Missing keys are created with the value initial
+// and the given expiration, as with DecrementWithDefault, but the new
+// values are not returned.
+func (c *Client) DecrementQ(keys []string, delta, initial uint64, expiration int32) error {
+	return c.DecrementQContext(context.Background(), keys, delta, initial, expiration)
+}
+
+// DecrementQContext is like DecrementQ, with a context as in GetContext.
+func (c *Client) DecrementQContext(ctx context.Context, keys []string, delta, initial uint64, expiration int32) error {
+	exp, err := createExpiration(expiration)
+	if err != nil {
+		return err
+	}
+	return c.incrDecrQ(ctx, cmdDecrementQ, keys, delta, initial, exp)
+}
+
+// noAutoCreate is the incr/decr expiration which makes the command
+// fail if the key does not exist, rather than creating it.
+const noAutoCreate = 0xffffffff
+
+// createExpiration checks the expiration of the keys created by incr or
+// decr. A negative one, which the binary protocol would read as
+// noAutoCreate or as a time far in the future, is rejected.
+func createExpiration(expiration int32) (uint32, error) {
+	if expiration < 0 {
+		return 0, ErrNegativeExpiration
+	}
+	return uint32(expiration), nil
+}
+
+func (c *Client) incrDecr(ctx context.Context, cmd command, key string, delta, initial uint64, expiration uint32) (newValue uint64, err error) {
+	serverIndex, err := c.pickServer(key)
 	if err != nil {
 		return 0, err
 	}
-	err = sendConnCommand(cn, key, cmd, nil, 0, extras)
+	op := OpIncrement
+	if cmd == cmdDecr {
+		op = OpDecrement
+	}
+	ctx, req := c.startRequest(ctx, op, serverIndex, key)
+	defer func() {
+		req.end(0, 0, err)
+	}()
+	cn, err := c.getConnection(ctx, serverIndex)
 	if err != nil {
-		_ = c.closeConnection(serverIndex, cn)
 		return 0, err
 	}
+	req.acquired(cn)
+	newValue, err = cn.codec.incrDecr(cn, &req, cmd, key, delta, initial, expiration)
+	c.releaseConnection(&req, cn, err)
+	return newValue, err
+}
+
+func (c *Client) incrDecrQ(ctx context.Context, cmd command, keys []string, delta, initial uint64, expiration uint32) error {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+
+	keyMap := make(map[uint32][]string)
+	for _, key := range keys {
+		serverIndex, err := c.pickServer(key)
+		if err != nil {
+			return err
+		}
+		keyMap[serverIndex] = append(keyMap[serverIndex], key)
+	}
+
+	mu := sync.Mutex{}
+	var failed []string
+	var errs []error
+	wg := sync.WaitGroup{}
 
-	_, _, _, value, err := parseResponse(key, cn)
-	switch err {
-	case nil, ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrBadIncrDec:
-		_ = c.putConnection(serverIndex, cn)
-	default:
-		_ = c.closeConnection(serverIndex, cn)
+	op := OpIncrement + "_q"
+	if cmd == cmdDecrementQ {
+		op = OpDecrement + "_q"
 	}
+	if c.Tracer != nil {
+		var span Span
+		ctx, span = c.startSpan(ctx, spanPrefix+op, op, len(keys))
+		defer span.End()
+	}
+
+	wg.Add(len(keyMap))
+	for addr, keys := range keyMap {
+		go func(serverIndex uint32, keys []string) {
+			defer wg.Done()
+			ctx, req := c.startServerRequest(ctx, op, serverIndex, keys)
+			keyErrs := c.incrDecrQServer(ctx, &req, serverIndex, cmd, keys, delta, initial, expiration)
+			var err error
+			for _, err = range keyErrs {
+				if err != nil {
+					break
+				}
+			}
+			req.end(0, 0, err)
+			if len(keyErrs) == 0 {
+				return
+			}
+			mu.Lock()
+			for ii, key := range keys {
+				if keyErrs[ii] != nil {
+					failed = append(failed, key)
+					errs = append(errs, keyErrs[ii])
+				}
+			}
+			mu.Unlock()
+		}(addr, keys)
+	}
+	wg.Wait()
+
+	return failuresError("failed to update some keys: ", failed, errs)
+}
+
+// incrDecrQServer runs the quiet incr/decr of keys on the given server.
+// The returned slice is either nil or has one entry per key.
+func (c *Client) incrDecrQServer(ctx context.Context, req *request, serverIndex uint32, cmd command, keys []string, delta, initial uint64, expiration uint32) []error {
+	fail := func(err error) []error {
+		errs := make([]error, len(keys))
+		for ii := range errs {
+			errs[ii] = err
+		}
+		return errs
+	}
+
+	cn, err := c.getConnection(ctx, serverIndex)
 	if err != nil {
-		return 0, err
+		return fail(err)
+	}
+	req.acquired(cn)
+	errs, err := cn.codec.incrDecrQ(cn, req, cmd, keys, delta, initial, expiration)
+	c.releaseConnection(req, cn, err)
+	if err != nil {
+		return fail(err)
 	}
-	return bUint64(value), nil
+	return errs
 }
 
 // Flush removes all the items in the cache after expiration seconds. If
 // expiration is <= 0, it removes all the items right now.
 func (c *Client) Flush(expiration int) error {
+	return c.FlushContext(context.Background(), expiration)
+}
+
+// FlushContext is like Flush, with a context as in GetContext.
+func (c *Client) FlushContext(ctx context.Context, expiration int) error {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
 	var failed []string
 	var errs []error
 
-	var extras []byte
-	if expiration > 0 {
-		extras = make([]byte, 4)
-		putUint32(extras, uint32(expiration))
+	if c.Tracer != nil {
+		var span Span
+		ctx, span = c.startSpan(ctx, spanPrefix+OpFlush, OpFlush, 0)
+		defer span.End()
 	}
-
 	for serverIndex := uint32(0); serverIndex < c.servers.PoolLen(); serverIndex++ {
-		connection, err := c.getConnection(serverIndex)
+		ctx, req := c.startServerRequest(ctx, OpFlush, serverIndex, nil)
+		err := c.flushServer(ctx, &req, serverIndex, expiration)
+		req.end(0, 0, err)
 		if err != nil {
 			failed = append(failed, c.servers.Name(serverIndex))
 			errs = append(errs, err)
-			continue
 		}
-		cn := connection.(net.Conn)
-		if err = sendConnCommand(cn, "", cmdFlush, nil, 0, extras); err == nil {
-			_, _, _, _, err = parseResponse("", cn)
+	}
+	return failuresError("failed to flush some servers: ", failed, errs)
+}
+
+// failuresError returns an error listing the failed keys or servers
+// along with their errors, or nil if nothing failed.
+func failuresError(msg string, failed []string, errs []error) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.WriteString(msg)
+	for ii, name := range failed {
+		if ii > 0 {
+			buf.WriteString(", ")
 		}
+		buf.WriteString(name)
+		buf.WriteString(": ")
+		buf.WriteString(errs[ii].Error())
+	}
+	return errors.New(buf.String())
+}
+
+func (c *Client) flushServer(ctx context.Context, req *request, serverIndex uint32, expiration int) error {
+	cn, err := c.getConnection(ctx, serverIndex)
+	if err != nil {
+		return err
+	}
+	req.acquired(cn)
+	err = cn.codec.flush(cn, req, expiration)
+	c.releaseConnection(req, cn, err)
+	return err
+}
+
+// Stats returns the statistics of every server, keyed by server address
+// and then by statistic name. Servers which fail are left out and make
+// the returned error non-nil.
+func (c *Client) Stats() (map[string]map[string]string, error) {
+	return c.StatsContext(context.Background())
+}
+
+// StatsContext is like Stats, with a context as in GetContext.
+func (c *Client) StatsContext(ctx context.Context) (map[string]map[string]string, error) {
+	if c.isClosed() {
+		return nil, ErrClientClosed
+	}
+	var failed []string
+	var errs []error
+	stats := make(map[string]map[string]string)
+
+	if c.Tracer != nil {
+		var span Span
+		ctx, span = c.startSpan(ctx, spanPrefix+OpStats, OpStats, 0)
+		defer span.End()
+	}
+	for serverIndex := uint32(0); serverIndex < c.servers.PoolLen(); serverIndex++ {
+		ctx, req := c.startServerRequest(ctx, OpStats, serverIndex, nil)
+		s, err := c.statsServer(ctx, &req, serverIndex)
+		req.end(0, 0, err)
 		if err != nil {
 			failed = append(failed, c.servers.Name(serverIndex))
 			errs = append(errs, err)
+			continue
 		}
-		switch err {
-		case nil, ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrBadIncrDec:
-			_ = c.putConnection(serverIndex, cn)
-		default:
-			_ = c.closeConnection(serverIndex, cn)
-		}
+		stats[c.servers.Name(serverIndex)] = s
 	}
-	if len(failed) > 0 {
-		var buf bytes.Buffer
-		buf.WriteString("failed to flush some servers: ")
-		for ii, addr := range failed {
-			if ii > 0 {
-				buf.WriteString(", ")
-			}
-			buf.WriteString(addr)
-			buf.WriteString(": ")
-			buf.WriteString(errs[ii].Error())
-		}
-		return errors.New(buf.String())
+	return stats, failuresError("failed to get stats from some servers: ", failed, errs)
+}
+
+func (c *Client) statsServer(ctx context.Context, req *request, serverIndex uint32) (map[string]string, error) {
+	cn, err := c.getConnection(ctx, serverIndex)
+	if err != nil {
+		return nil, err
+	}
+	req.acquired(cn)
+	stats, err := cn.codec.stats(cn, req)
+	c.releaseConnection(req, cn, err)
+	if err == nil && len(stats) == 0 {
+		err = ErrNoStats
 	}
-	return nil
+	return stats, err
 }
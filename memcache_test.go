@@ -2,13 +2,18 @@
 package memcache
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/dev-lazarev/memcache/memtest"
 )
 
 var testConfig = Config{
@@ -22,61 +27,258 @@ var testConfig = Config{
 	ConnectionTimeout: 100 * time.Millisecond,
 }
 
-const testServer = "my_user:my_password@"
-
 func (c *Client) totalOpen() int {
 	return c.servers.Count()
 }
 
+// newLocalhostServer returns a client of the server at $MEMCACHED_SERVER
+// if it's set, flushing it first, or of an in-memory memtest server.
 func newLocalhostServer(tb testing.TB) *Client {
-	c, err := net.Dial("tcp", testConfig.Server)
-	if err != nil {
-		tb.Skip(fmt.Sprintf("skipping test; no server running at %s", testServer))
-		return nil
+	config := testConfig
+	if addr := os.Getenv("MEMCACHED_SERVER"); addr != "" {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			tb.Skip(fmt.Sprintf("skipping test; no server running at %s", addr))
+			return nil
+		}
+		c.Write([]byte("flush_all\r\n"))
+		c.Close()
+		config.Server = addr
+	} else {
+		s := memtest.NewUnstartedServer()
+		s.User, s.Password = config.User, config.Password
+		if err := s.Start(); err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(func() { s.Close() })
+		config.Server = s.Addr
 	}
-	c.Write([]byte("flush_all\r\n"))
-	c.Close()
-	client, err := New([]Config{testConfig})
+	client, err := New([]Config{config})
 	if err != nil {
 		tb.Fatal(err)
 	}
+	tb.Cleanup(client.Close)
 	return client
 }
 
-func newUnixServer(tb testing.TB) (*exec.Cmd, *Client) {
-	sock := fmt.Sprintf("/tmp/test-gomemcache-%d.sock", os.Getpid())
-	os.Remove(sock)
-	cmd := exec.Command("memcached", "-s", sock)
-	if err := cmd.Start(); err != nil {
-		tb.Skip("skipping test; couldn't find memcached")
-		return nil, nil
-	}
-
-	// Wait a bit for the socket to appear.
-	for i := 0; i < 10; i++ {
-		if _, err := os.Stat(sock); err == nil {
-			break
-		}
-		time.Sleep(time.Duration(25*i) * time.Millisecond)
+// newUnixServer returns a client of an in-memory memtest server listening
+// on a unix socket.
+func newUnixServer(tb testing.TB) *Client {
+	sock := filepath.Join(tb.TempDir(), "memcached.sock")
+	s := memtest.NewUnstartedServer()
+	s.User, s.Password = testConfig.User, testConfig.Password
+	if err := s.StartUnix(sock); err != nil {
+		tb.Fatal(err)
 	}
-	testConfig.Server = sock
-	c, err := New([]Config{testConfig})
+	tb.Cleanup(func() { s.Close() })
+	config := testConfig
+	config.Server = s.Addr
+	c, err := New([]Config{config})
 	if err != nil {
 		tb.Fatal(err)
 	}
-	return cmd, c
+	tb.Cleanup(c.Close)
+	return c
 }
 
 func TestLocalhost(t *testing.T) {
 	testWithClient(t, newLocalhostServer(t))
 }
 
-// Run the memcached binary as a child process and connect to its unix socket.
 func TestUnixSocket(t *testing.T) {
-	cmd, c := newUnixServer(t)
-	defer cmd.Wait()
-	defer cmd.Process.Kill()
+	testWithClient(t, newUnixServer(t))
+}
+
+func TestTextProtocol(t *testing.T) {
+	s := memtest.NewUnstartedServer()
+	s.User, s.Password = testConfig.User, testConfig.Password
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	config := testConfig
+	config.Server = s.Addr
+	config.Protocol = ProtocolText
+	// Check every reused connection, to exercise the text noop.
+	config.PingIdleAfter = time.Nanosecond
+	c, err := New([]Config{config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
 	testWithClient(t, c)
+
+	config.Password = "wrong"
+	config.InitialCap = 0
+	c, err = New([]Config{config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Get("foo"); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("Get with a wrong password = %v, want an authentication error", err)
+	}
+}
+
+// TestCompareAndSwap checks that a failed CAS over the binary protocol
+// reports the errors documented by CompareAndSwap, not those of add.
+func TestCompareAndSwap(t *testing.T) {
+	c := newLocalhostServer(t)
+	if err := c.Set(&Item{Key: "cas", Value: []byte("v1")}); err != nil {
+		t.Fatal(err)
+	}
+	it, err := c.Get("cas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := *it
+	it.Value = []byte("v2")
+	if err := c.CompareAndSwap(it); err != nil {
+		t.Fatalf("CompareAndSwap: %v", err)
+	}
+	stale.Value = []byte("stale")
+	if err := c.CompareAndSwap(&stale); err != ErrCASConflict {
+		t.Errorf("CompareAndSwap of a modified item = %v, want ErrCASConflict", err)
+	}
+	if err := c.Delete("cas"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CompareAndSwap(it); err != ErrNotStored {
+		t.Errorf("CompareAndSwap of a deleted item = %v, want ErrNotStored", err)
+	}
+}
+
+func TestDialer(t *testing.T) {
+	var network, addr string
+	c, err := New([]Config{{
+		Server:            "memcached.invalid:11211",
+		MaxIdle:           1,
+		MaxCap:            1,
+		ConnectionTimeout: time.Second,
+		Dialer: func(ctx context.Context, n, a string) (net.Conn, error) {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Error("Dialer context has no deadline")
+			}
+			network, addr = n, a
+			client, server := net.Pipe()
+			go serveStubConn(server)
+			return client, nil
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Get("foo"); err != nil {
+		t.Fatalf("Get through Dialer: %v", err)
+	}
+	if network != "tcp" || addr != "memcached.invalid:11211" {
+		t.Errorf("Dialer called with %q, %q, want tcp, memcached.invalid:11211", network, addr)
+	}
+
+	dialErr := errors.New("dial failed")
+	c, err = New([]Config{{
+		Server:  "memcached.invalid:11211",
+		MaxIdle: 1,
+		MaxCap:  1,
+		Dialer: func(ctx context.Context, n, a string) (net.Conn, error) {
+			return nil, dialErr
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Get("foo"); err != dialErr {
+		t.Errorf("Get with failing Dialer = %v, want %v", err, dialErr)
+	}
+}
+
+// newStubClient returns a Client connected through net.Pipe to stub
+// servers answering with serveStubConn.
+func newStubClient(t *testing.T, config Config) *Client {
+	if config.Server == "" {
+		config.Server = "stub:11211"
+	}
+	config.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go serveStubConn(server)
+		return client, nil
+	}
+	c, err := New([]Config{config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestConcurrentMaxCap(t *testing.T) {
+	c := newStubClient(t, Config{MaxIdle: 1, MaxCap: 1})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := c.Get("foo"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if st := c.PoolStats()[0]; st.Open != 1 || st.InUse != 0 {
+		t.Errorf("PoolStats() = %+v, want a single idle connection", st)
+	}
+}
+
+func TestClose(t *testing.T) {
+	c := newStubClient(t, Config{MaxIdle: 2, MaxCap: 4})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				_, err := c.Get("foo")
+				if err == ErrClientClosed {
+					return
+				}
+				if err != nil {
+					t.Errorf("Get during Close: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	wg.Wait()
+	c.Close()
+
+	if st := c.PoolStats()[0]; st.Open != 0 {
+		t.Errorf("open connections after Close = %d, want 0", st.Open)
+	}
+	if _, err := c.Get("foo"); err != ErrClientClosed {
+		t.Errorf("Get after Close = %v, want %v", err, ErrClientClosed)
+	}
+	if _, err := c.GetMulti([]string{"foo", "bar"}); err != ErrClientClosed {
+		t.Errorf("GetMulti after Close = %v, want %v", err, ErrClientClosed)
+	}
+	if err := c.Set(&Item{Key: "foo"}); err != ErrClientClosed {
+		t.Errorf("Set after Close = %v, want %v", err, ErrClientClosed)
+	}
+	if _, err := c.Increment("foo", 1); err != ErrClientClosed {
+		t.Errorf("Increment after Close = %v, want %v", err, ErrClientClosed)
+	}
+	if err := c.IncrementQ([]string{"foo"}, 1, 0, 0); err != ErrClientClosed {
+		t.Errorf("IncrementQ after Close = %v, want %v", err, ErrClientClosed)
+	}
+	if err := c.Flush(0); err != ErrClientClosed {
+		t.Errorf("Flush after Close = %v, want %v", err, ErrClientClosed)
+	}
 }
 
 func testWithClient(t *testing.T, c *Client) {
@@ -145,6 +347,33 @@ func testWithClient(t *testing.T, c *Client) {
 		t.Errorf("GetMulti: bar: got %q, want %q", g, e)
 	}
 
+	// Touch
+	err = c.Touch("bar", 60)
+	checkErr(err, "Touch(bar): %v", err)
+	if err := c.Touch("not-exists", 60); err != ErrCacheMiss {
+		t.Errorf("Touch(not-exists): want %v, got %v", ErrCacheMiss, err)
+	}
+	it, err = c.GetAndTouch("bar", 60)
+	checkErr(err, "GetAndTouch(bar): %v", err)
+	if string(it.Value) != "barval" {
+		t.Errorf("GetAndTouch(bar) Value = %q, want barval", it.Value)
+	}
+	if _, err := c.GetAndTouch("not-exists", 60); err != ErrCacheMiss {
+		t.Errorf("GetAndTouch(not-exists): want %v, got %v", ErrCacheMiss, err)
+	}
+
+	// Stats
+	stats, err := c.Stats()
+	checkErr(err, "Stats: %v", err)
+	if len(stats) != 1 {
+		t.Errorf("Stats: got %d servers, want 1", len(stats))
+	}
+	for server, s := range stats {
+		if s["version"] == "" || s["curr_items"] == "" {
+			t.Errorf("Stats: %s: got %v, want version and curr_items", server, s)
+		}
+	}
+
 	// Delete
 	err = c.Delete("foo")
 	checkErr(err, "Delete: %v", err)
@@ -171,11 +400,40 @@ func testWithClient(t *testing.T, c *Client) {
 	if err != ErrCacheMiss {
 		t.Fatalf("increment post-delete: want ErrCacheMiss, got %v", err)
 	}
+	n, err = c.IncrementWithDefault("num", 1, 10, 0)
+	checkErr(err, "IncrementWithDefault missing num: %v", err)
+	if n != 10 {
+		t.Fatalf("IncrementWithDefault missing num: want=10, got=%d", n)
+	}
+	n, err = c.IncrementWithDefault("num", 5, 10, 0)
+	checkErr(err, "IncrementWithDefault num + 5: %v", err)
+	if n != 15 {
+		t.Fatalf("IncrementWithDefault num + 5: want=15, got=%d", n)
+	}
+	n, err = c.DecrementWithDefault("num", 20, 10, 0)
+	checkErr(err, "DecrementWithDefault num - 20: %v", err)
+	if n != 0 {
+		t.Fatalf("DecrementWithDefault num - 20: want=0, got=%d", n)
+	}
+	err = c.IncrementQ([]string{"num", "num2"}, 3, 7, 0)
+	checkErr(err, "IncrementQ: %v", err)
+	err = c.DecrementQ([]string{"num2"}, 1, 0, 0)
+	checkErr(err, "DecrementQ: %v", err)
+	for key, want := range map[string]string{"num": "3", "num2": "6"} {
+		it, err := c.Get(key)
+		checkErr(err, "get(%s) after IncrementQ: %v", key, err)
+		if string(it.Value) != want {
+			t.Fatalf("get(%s) after IncrementQ: want=%s, got=%s", key, want, it.Value)
+		}
+	}
 	mustSet(&Item{Key: "num", Value: []byte("not-numeric")})
 	n, err = c.Increment("num", 1)
 	if err != ErrBadIncrDec {
 		t.Fatalf("increment non-number: want %v, got %v", ErrBadIncrDec, err)
 	}
+	if err := c.IncrementQ([]string{"num", "num2"}, 1, 0, 0); err == nil {
+		t.Fatalf("IncrementQ non-number: want error, got nil")
+	}
 	// Invalid key
 	if err := c.Set(&Item{Key: strings.Repeat("f", 251), Value: []byte("bar")}); err != ErrMalformedKey {
 		t.Errorf("expecting ErrMalformedKey when using key too long, got nil")
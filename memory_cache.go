@@ -0,0 +1,421 @@
+package memcache
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryCache is a Cache keeping its items in memory, meant to replace
+// a Client in tests. It follows the semantics of a Client talking to a
+// single memcached server, errors included: expirations, CAS values,
+// incr/decr on decimal values and delayed flushes. Its methods are safe
+// for concurrent use. The zero value is an empty MemoryCache ready to
+// use.
+type MemoryCache struct {
+	// Clock returns the current time, used to evaluate expirations. It
+	// defaults to time.Now.
+	Clock func() time.Time
+
+	mu    sync.Mutex
+	items map[string]*memoryItem
+	cas   uint64
+}
+
+type memoryItem struct {
+	value   []byte
+	flags   uint32
+	casid   uint64
+	expires time.Time
+}
+
+// maxRelativeExpiration is the largest expiration, in seconds, which is
+// relative to the current time rather than a Unix time.
+const maxRelativeExpiration = 60 * 60 * 24 * 30
+
+// NewMemoryCache returns an empty MemoryCache.
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{items: make(map[string]*memoryItem)}
+}
+
+func (m *MemoryCache) now() time.Time {
+	if m.Clock != nil {
+		return m.Clock()
+	}
+	return time.Now()
+}
+
+// expiresAt converts an expiration in the format of Item.Expiration to
+// a time, the zero time meaning it never expires.
+func (m *MemoryCache) expiresAt(expiration int64) time.Time {
+	switch {
+	case expiration == 0:
+		return time.Time{}
+	case expiration < 0:
+		return m.now().Add(-time.Second)
+	case expiration <= maxRelativeExpiration:
+		return m.now().Add(time.Duration(expiration) * time.Second)
+	}
+	return time.Unix(expiration, 0)
+}
+
+// lookup returns the live item for key, removing it if it expired. m.mu
+// must be held.
+func (m *MemoryCache) lookup(key string) *memoryItem {
+	it := m.items[key]
+	if it == nil {
+		return nil
+	}
+	if !it.expires.IsZero() && !m.now().Before(it.expires) {
+		delete(m.items, key)
+		return nil
+	}
+	return it
+}
+
+// store saves it under key with a new CAS value. m.mu must be held.
+func (m *MemoryCache) store(key string, it *memoryItem) {
+	m.cas++
+	it.casid = m.cas
+	if m.items == nil {
+		m.items = make(map[string]*memoryItem)
+	}
+	m.items[key] = it
+}
+
+// Get is like Client.Get.
+func (m *MemoryCache) Get(key string) (*Item, error) {
+	return m.GetContext(context.Background(), key)
+}
+
+// GetContext is like Client.GetContext.
+func (m *MemoryCache) GetContext(ctx context.Context, key string) (*Item, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !legalKey(key) {
+		return nil, ErrMalformedKey
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	it := m.lookup(key)
+	if it == nil {
+		return nil, ErrCacheMiss
+	}
+	return it.item(key), nil
+}
+
+// GetAndTouch is like Client.GetAndTouch.
+func (m *MemoryCache) GetAndTouch(key string, expiration int32) (*Item, error) {
+	return m.GetAndTouchContext(context.Background(), key, expiration)
+}
+
+// GetAndTouchContext is like Client.GetAndTouchContext.
+func (m *MemoryCache) GetAndTouchContext(ctx context.Context, key string, expiration int32) (*Item, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !legalKey(key) {
+		return nil, ErrMalformedKey
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	it := m.lookup(key)
+	if it == nil {
+		return nil, ErrCacheMiss
+	}
+	it.expires = m.expiresAt(int64(expiration))
+	return it.item(key), nil
+}
+
+func (it *memoryItem) item(key string) *Item {
+	return &Item{
+		Key:   key,
+		Value: append([]byte(nil), it.value...),
+		Flags: it.flags,
+		casid: it.casid,
+	}
+}
+
+// GetMulti is like Client.GetMulti.
+func (m *MemoryCache) GetMulti(keys []string) (map[string]*Item, error) {
+	return m.GetMultiContext(context.Background(), keys)
+}
+
+// GetMultiContext is like Client.GetMultiContext.
+func (m *MemoryCache) GetMultiContext(ctx context.Context, keys []string) (map[string]*Item, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	items := make(map[string]*Item)
+	for _, key := range keys {
+		if it := m.lookup(key); it != nil {
+			items[key] = it.item(key)
+		}
+	}
+	return items, nil
+}
+
+// Set is like Client.Set.
+func (m *MemoryCache) Set(item *Item) error {
+	return m.SetContext(context.Background(), item)
+}
+
+// SetContext is like Client.SetContext.
+func (m *MemoryCache) SetContext(ctx context.Context, item *Item) error {
+	return m.populate(ctx, item, false, 0)
+}
+
+// Add is like Client.Add.
+func (m *MemoryCache) Add(item *Item) error {
+	return m.AddContext(context.Background(), item)
+}
+
+// AddContext is like Client.AddContext.
+func (m *MemoryCache) AddContext(ctx context.Context, item *Item) error {
+	return m.populate(ctx, item, true, 0)
+}
+
+// CompareAndSwap is like Client.CompareAndSwap.
+func (m *MemoryCache) CompareAndSwap(item *Item) error {
+	return m.CompareAndSwapContext(context.Background(), item)
+}
+
+// CompareAndSwapContext is like Client.CompareAndSwapContext.
+func (m *MemoryCache) CompareAndSwapContext(ctx context.Context, item *Item) error {
+	return m.populate(ctx, item, false, item.casid)
+}
+
+func (m *MemoryCache) populate(ctx context.Context, item *Item, add bool, casid uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !legalKey(item.Key) {
+		return ErrMalformedKey
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur := m.lookup(item.Key)
+	switch {
+	case add && cur != nil:
+		return ErrNotStored
+	case casid != 0 && cur == nil:
+		return ErrNotStored
+	case casid != 0 && cur.casid != casid:
+		return ErrCASConflict
+	}
+	it := &memoryItem{
+		value:   append([]byte(nil), item.Value...),
+		flags:   item.Flags,
+		expires: m.expiresAt(int64(item.Expiration)),
+	}
+	m.store(item.Key, it)
+	item.casid = it.casid
+	return nil
+}
+
+// Delete is like Client.Delete.
+func (m *MemoryCache) Delete(key string) error {
+	return m.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Client.DeleteContext.
+func (m *MemoryCache) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !legalKey(key) {
+		return ErrMalformedKey
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lookup(key) == nil {
+		return ErrCacheMiss
+	}
+	delete(m.items, key)
+	return nil
+}
+
+// Touch is like Client.Touch.
+func (m *MemoryCache) Touch(key string, expiration int32) error {
+	return m.TouchContext(context.Background(), key, expiration)
+}
+
+// TouchContext is like Client.TouchContext.
+func (m *MemoryCache) TouchContext(ctx context.Context, key string, expiration int32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !legalKey(key) {
+		return ErrMalformedKey
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	it := m.lookup(key)
+	if it == nil {
+		return ErrCacheMiss
+	}
+	it.expires = m.expiresAt(int64(expiration))
+	return nil
+}
+
+// Increment is like Client.Increment.
+func (m *MemoryCache) Increment(key string, delta uint64) (uint64, error) {
+	return m.IncrementContext(context.Background(), key, delta)
+}
+
+// IncrementContext is like Client.IncrementContext.
+func (m *MemoryCache) IncrementContext(ctx context.Context, key string, delta uint64) (uint64, error) {
+	return m.incrDecr(ctx, true, key, delta, 0, noAutoCreate)
+}
+
+// Decrement is like Client.Decrement.
+func (m *MemoryCache) Decrement(key string, delta uint64) (uint64, error) {
+	return m.DecrementContext(context.Background(), key, delta)
+}
+
+// DecrementContext is like Client.DecrementContext.
+func (m *MemoryCache) DecrementContext(ctx context.Context, key string, delta uint64) (uint64, error) {
+	return m.incrDecr(ctx, false, key, delta, 0, noAutoCreate)
+}
+
+// IncrementWithDefault is like Client.IncrementWithDefault.
+func (m *MemoryCache) IncrementWithDefault(key string, delta, initial uint64, expiration int32) (uint64, error) {
+	return m.IncrementWithDefaultContext(context.Background(), key, delta, initial, expiration)
+}
+
+// IncrementWithDefaultContext is like Client.IncrementWithDefaultContext.
+func (m *MemoryCache) IncrementWithDefaultContext(ctx context.Context, key string, delta, initial uint64, expiration int32) (uint64, error) {
+	exp, err := createExpiration(expiration)
+	if err != nil {
+		return 0, err
+	}
+	return m.incrDecr(ctx, true, key, delta, initial, exp)
+}
+
+// DecrementWithDefault is like Client.DecrementWithDefault.
+func (m *MemoryCache) DecrementWithDefault(key string, delta, initial uint64, expiration int32) (uint64, error) {
+	return m.DecrementWithDefaultContext(context.Background(), key, delta, initial, expiration)
+}
+
+// DecrementWithDefaultContext is like Client.DecrementWithDefaultContext.
+func (m *MemoryCache) DecrementWithDefaultContext(ctx context.Context, key string, delta, initial uint64, expiration int32) (uint64, error) {
+	exp, err := createExpiration(expiration)
+	if err != nil {
+		return 0, err
+	}
+	return m.incrDecr(ctx, false, key, delta, initial, exp)
+}
+
+// IncrementQ is like Client.IncrementQ.
+func (m *MemoryCache) IncrementQ(keys []string, delta, initial uint64, expiration int32) error {
+	return m.IncrementQContext(context.Background(), keys, delta, initial, expiration)
+}
+
+// IncrementQContext is like Client.IncrementQContext.
+func (m *MemoryCache) IncrementQContext(ctx context.Context, keys []string, delta, initial uint64, expiration int32) error {
+	exp, err := createExpiration(expiration)
+	if err != nil {
+		return err
+	}
+	return m.incrDecrQ(ctx, true, keys, delta, initial, exp)
+}
+
+// DecrementQ is like Client.DecrementQ.
+func (m *MemoryCache) DecrementQ(keys []string, delta, initial uint64, expiration int32) error {
+	return m.DecrementQContext(context.Background(), keys, delta, initial, expiration)
+}
+
+// DecrementQContext is like Client.DecrementQContext.
+func (m *MemoryCache) DecrementQContext(ctx context.Context, keys []string, delta, initial uint64, expiration int32) error {
+	exp, err := createExpiration(expiration)
+	if err != nil {
+		return err
+	}
+	return m.incrDecrQ(ctx, false, keys, delta, initial, exp)
+}
+
+func (m *MemoryCache) incrDecrQ(ctx context.Context, incr bool, keys []string, delta, initial uint64, expiration uint32) error {
+	var failed []string
+	var errs []error
+	for _, key := range keys {
+		if _, err := m.incrDecr(ctx, incr, key, delta, initial, expiration); err != nil {
+			if err == ctx.Err() {
+				return err
+			}
+			failed = append(failed, key)
+			errs = append(errs, err)
+		}
+	}
+	return failuresError("failed to update some keys: ", failed, errs)
+}
+
+func (m *MemoryCache) incrDecr(ctx context.Context, incr bool, key string, delta, initial uint64, expiration uint32) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if !legalKey(key) {
+		return 0, ErrMalformedKey
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur := m.lookup(key)
+	if cur == nil {
+		if expiration == noAutoCreate {
+			return 0, ErrCacheMiss
+		}
+		it := &memoryItem{
+			value:   []byte(strconv.FormatUint(initial, 10)),
+			expires: m.expiresAt(int64(int32(expiration))),
+		}
+		m.store(key, it)
+		return initial, nil
+	}
+	n, err := strconv.ParseUint(string(cur.value), 10, 64)
+	if err != nil {
+		return 0, ErrBadIncrDec
+	}
+	switch {
+	case incr:
+		n += delta
+	case delta > n:
+		n = 0
+	default:
+		n -= delta
+	}
+	it := &memoryItem{
+		value:   []byte(strconv.FormatUint(n, 10)),
+		flags:   cur.flags,
+		expires: cur.expires,
+	}
+	m.store(key, it)
+	return n, nil
+}
+
+// Flush is like Client.Flush.
+func (m *MemoryCache) Flush(expiration int) error {
+	return m.FlushContext(context.Background(), expiration)
+}
+
+// FlushContext is like Client.FlushContext.
+func (m *MemoryCache) FlushContext(ctx context.Context, expiration int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if expiration <= 0 {
+		m.items = make(map[string]*memoryItem)
+		return nil
+	}
+	at := m.expiresAt(int64(expiration))
+	for _, it := range m.items {
+		if it.expires.IsZero() || it.expires.After(at) {
+			it.expires = at
+		}
+	}
+	return nil
+}
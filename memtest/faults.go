@@ -0,0 +1,189 @@
+package memtest
+
+import "time"
+
+// FaultAction is the way a Fault corrupts the response to a request.
+type FaultAction int
+
+const (
+	// FaultNone leaves the response untouched, which is useful along
+	// with Fault.Delay or Fault.Status.
+	FaultNone FaultAction = iota
+
+	// FaultCloseConnection closes the connection without answering.
+	FaultCloseConnection
+
+	// FaultTruncateHeader writes the first half of the response header
+	// and closes the connection.
+	FaultTruncateHeader
+
+	// FaultDropMidBody writes the response header and half of its body,
+	// and closes the connection.
+	FaultDropMidBody
+
+	// FaultBadMagic replaces the magic byte of the response header with
+	// an invalid one.
+	FaultBadMagic
+
+	// FaultWrongOpaque answers with an opaque value different from the
+	// request's.
+	FaultWrongOpaque
+
+	// FaultWrongKey answers with a key different from the requested
+	// one, for the responses carrying a key such as getk's.
+	FaultWrongKey
+)
+
+// Fault describes how the Server misbehaves for the matching requests.
+// Faults applying to a quiet request only show if the request gets a
+// response. Text protocol commands match the names of their binary
+// counterparts, such as get for gets or stat for stats, and are only
+// affected by Delay, Status and FaultCloseConnection. So are meta
+// commands, matching get for mg, set for ms, delete for md, incr for
+// ma and noop for mn.
+type Fault struct {
+	// Command restricts the fault to a command: get, gat, set, add,
+	// replace, append, prepend, delete, incr, decr, touch, flush, noop,
+	// version, stat, quit or sasl. Quiet variants match the same name.
+	// An empty Command matches every request, authentication included.
+	Command string
+
+	// Key restricts the fault to the requests for Key, if not empty.
+	Key string
+
+	// Times is the number of requests the fault applies to, after which
+	// it's removed. Zero applies it to every matching request.
+	Times int
+
+	// Delay is waited before handling the request. Responses to the
+	// previous requests of the connection are written first.
+	Delay time.Duration
+
+	// Status, if not zero, is answered instead of executing the
+	// request, such as StatusBusy.
+	Status uint16
+
+	// Action corrupts the response or the connection.
+	Action FaultAction
+}
+
+var commandNames = map[uint8]string{
+	opGet: "get", opGetQ: "get", opGetK: "get", opGetKQ: "get",
+	opGAT: "gat", opGATQ: "gat", opGATK: "gat", opGATKQ: "gat",
+	opSet: "set", opSetQ: "set",
+	opAdd: "add", opAddQ: "add",
+	opReplace: "replace", opReplaceQ: "replace",
+	opAppend: "append", opAppendQ: "append",
+	opPrepend: "prepend", opPrependQ: "prepend",
+	opDelete: "delete", opDeleteQ: "delete",
+	opIncrement: "incr", opIncrementQ: "incr",
+	opDecrement: "decr", opDecrementQ: "decr",
+	opTouch: "touch",
+	opFlush: "flush", opFlushQ: "flush",
+	opNoop:    "noop",
+	opVersion: "version",
+	opStat:    "stat",
+	opQuit:    "quit", opQuitQ: "quit",
+	opSASLList: "sasl", opSASLAuth: "sasl", opSASLStep: "sasl",
+}
+
+// InjectFault makes the server misbehave as described by f. Faults are
+// matched in the order they were injected, and at most one applies to
+// a request.
+func (s *Server) InjectFault(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes all the injected faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// fault returns the fault applying to req, if any, consuming one of its
+// Times.
+func (s *Server) fault(req *request) *Fault {
+	return s.match(commandNames[req.opcode], string(req.key))
+}
+
+// match returns the fault applying to a request for command and key,
+// if any, consuming one of its Times.
+func (s *Server) match(command, key string) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.faults {
+		if f.Command != "" && f.Command != command {
+			continue
+		}
+		if f.Key != "" && f.Key != key {
+			continue
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+// handleFault executes req under the fault f. It returns false if the
+// connection must be closed.
+func (c *serverConn) handleFault(req *request, f *Fault) bool {
+	if !c.delay(f) || f.Action == FaultCloseConnection {
+		return false
+	}
+	c.fault = f
+	defer func() { c.fault = nil }()
+	if f.Status != 0 {
+		c.writeStatus(req, f.Status)
+		return !c.broken
+	}
+	return c.handle(req) && !c.broken
+}
+
+// delay waits for the Delay of f, once the pending responses are
+// written. It returns false if the connection must be closed.
+func (c *serverConn) delay(f *Fault) bool {
+	if f.Delay <= 0 {
+		return true
+	}
+	if c.w.Flush() != nil {
+		return false
+	}
+	t := time.NewTimer(f.Delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-c.server.done:
+		return false
+	}
+}
+
+// writeFaulty writes a response corrupted by c.fault. hdr and body are
+// the response as it would otherwise be written.
+func (c *serverConn) writeFaulty(hdr, body []byte) {
+	switch c.fault.Action {
+	case FaultTruncateHeader:
+		c.w.Write(hdr[:len(hdr)/2])
+		c.broken = true
+		return
+	case FaultDropMidBody:
+		c.w.Write(hdr)
+		c.w.Write(body[:len(body)/2])
+		c.broken = true
+		return
+	case FaultBadMagic:
+		hdr[0] = 0
+	case FaultWrongOpaque:
+		hdr[15]++
+	}
+	c.w.Write(hdr)
+	c.w.Write(body)
+}
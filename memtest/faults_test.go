@@ -0,0 +1,92 @@
+package memtest
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestFaultStatus(t *testing.T) {
+	s := newTestServer(t)
+	c := dial(t, s)
+	s.InjectFault(Fault{Command: "set", Key: "foo", Times: 1, Status: StatusBusy})
+
+	checkStatus(t, "set other key", c.set(opSet, 0, "bar", "v", 0, 0), StatusOK)
+	checkStatus(t, "faulty set", c.set(opSet, 0, "foo", "v", 0, 0), StatusBusy)
+	checkStatus(t, "get", c.get("foo"), StatusKeyNotFound)
+	checkStatus(t, "set after fault", c.set(opSet, 0, "foo", "v", 0, 0), StatusOK)
+}
+
+func TestFaultDelay(t *testing.T) {
+	s := newTestServer(t)
+	c := dial(t, s)
+	s.InjectFault(Fault{Command: "get", Delay: 50 * time.Millisecond})
+
+	start := time.Now()
+	checkStatus(t, "get", c.get("foo"), StatusKeyNotFound)
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("get answered after %v, want at least 50ms", d)
+	}
+	s.ClearFaults()
+	start = time.Now()
+	c.get("foo")
+	if d := time.Since(start); d >= 50*time.Millisecond {
+		t.Errorf("get answered after %v once faults were cleared", d)
+	}
+}
+
+func TestFaultCorruption(t *testing.T) {
+	s := newTestServer(t)
+	c := dial(t, s)
+	c.set(opSet, 0, "foo", "bar", 0, 0)
+
+	s.InjectFault(Fault{Times: 1, Action: FaultWrongOpaque})
+	c.send(opGet, 7, 0, nil, []byte("foo"), nil)
+	if r := c.recv(); r.opaque == 7 {
+		t.Error("opaque not changed by FaultWrongOpaque")
+	}
+
+	s.InjectFault(Fault{Times: 1, Action: FaultWrongKey})
+	if r := c.do(opGetK, 0, nil, []byte("foo"), nil); string(r.key) == "foo" {
+		t.Error("key not changed by FaultWrongKey")
+	}
+
+	s.InjectFault(Fault{Times: 1, Action: FaultBadMagic})
+	c.send(opGet, 0, 0, nil, []byte("foo"), nil)
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(c.conn, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr[0] == respMagic {
+		t.Error("magic not changed by FaultBadMagic")
+	}
+}
+
+func TestFaultConnection(t *testing.T) {
+	for _, test := range []struct {
+		action FaultAction
+		want   int // bytes read before the connection is closed
+	}{
+		{FaultCloseConnection, 0},
+		{FaultTruncateHeader, 12},
+		{FaultDropMidBody, 24 + (4+3)/2},
+	} {
+		s := newTestServer(t)
+		c := dial(t, s)
+		c.set(opSet, 0, "foo", "bar", 0, 0)
+		s.InjectFault(Fault{Command: "get", Action: test.action})
+		c.send(opGet, 0, 0, nil, []byte("foo"), nil)
+		c.conn.SetReadDeadline(time.Now().Add(time.Second))
+		b, err := io.ReadAll(c.conn)
+		if err != nil {
+			t.Fatalf("action %d: %v", test.action, err)
+		}
+		if len(b) != test.want {
+			t.Errorf("action %d: read %d bytes before close, want %d", test.action, len(b), test.want)
+		}
+		if s.Len() != 1 {
+			t.Errorf("action %d: Len = %d, want 1", test.action, s.Len())
+		}
+	}
+}
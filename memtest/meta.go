@@ -0,0 +1,461 @@
+package memtest
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metaCommands are the names matched by the faults applying to the meta
+// commands.
+var metaCommands = map[string]string{
+	"mg": "get",
+	"ms": "set",
+	"md": "delete",
+	"ma": "incr",
+	"mn": "noop",
+}
+
+// metaFlagLetters are the flags understood by each meta command.
+var metaFlagLetters = map[string]string{
+	"mg": "cfhklOqstvNRT",
+	"ms": "cCFIkMOqT",
+	"md": "CIkOqT",
+	"ma": "cCDJkMNOqtTv",
+}
+
+// metaQuiet are the codes which the q flag suppresses, by command.
+var metaQuiet = map[string]string{
+	"mg": "EN HD",
+	"ms": "HD",
+	"md": "HD NF",
+	"ma": "HD NF",
+}
+
+// metaFlags are the flag tokens of a meta command, such as "v" or "T30".
+type metaFlags []string
+
+func (f metaFlags) token(b byte) (string, bool) {
+	for _, t := range f {
+		if t[0] == b {
+			return t[1:], true
+		}
+	}
+	return "", false
+}
+
+func (f metaFlags) has(b byte) bool {
+	_, ok := f.token(b)
+	return ok
+}
+
+// number returns the numeric token of flag b, or def if it's not set.
+// ok is false if the token is malformed.
+func (f metaFlags) number(b byte, def uint64, bitSize int) (n uint64, ok bool) {
+	t, set := f.token(b)
+	if !set {
+		return def, true
+	}
+	n, err := strconv.ParseUint(t, 10, bitSize)
+	return n, err == nil
+}
+
+// expiration returns the expiration token of flag b, which may be
+// negative, or zero if it's not set. ok is false if it's malformed.
+func (f metaFlags) expiration(b byte) (exp uint32, ok bool) {
+	t, set := f.token(b)
+	if !set {
+		return 0, true
+	}
+	n, err := strconv.ParseInt(t, 10, 32)
+	return uint32(n), err == nil
+}
+
+// metaResult is the answer to a meta command.
+type metaResult struct {
+	// code is the status, or a whole error line.
+	code  string
+	flags []string
+	// value is written after a VA code.
+	value []byte
+}
+
+func metaError(status uint16) *metaResult {
+	return &metaResult{code: textError(status)}
+}
+
+// echo adds the return flags which only depend on the request.
+func (r *metaResult) echo(key string, flags metaFlags) *metaResult {
+	for _, t := range flags {
+		switch t[0] {
+		case 'k':
+			r.flags = append(r.flags, "k"+key)
+		case 'O':
+			r.flags = append(r.flags, t)
+		}
+	}
+	return r
+}
+
+// serveMeta handles a meta command. It returns false if the connection
+// must be closed.
+func (c *serverConn) serveMeta(fields []string) bool {
+	cmd := fields[0]
+	if cmd == "mn" {
+		if f := c.server.match(metaCommands[cmd], ""); f != nil {
+			if !c.delay(f) || f.Action == FaultCloseConnection {
+				return false
+			}
+			if f.Status != 0 {
+				c.writeText(textError(f.Status), false)
+				return true
+			}
+		}
+		c.writeText("MN", false)
+		return true
+	}
+	if len(fields) < 2 || cmd == "ms" && len(fields) < 3 {
+		c.writeText(textError(StatusInvalidArgs), false)
+		return cmd != "ms"
+	}
+	key, flags := fields[1], metaFlags(fields[2:])
+	var data []byte
+	if cmd == "ms" {
+		var ok bool
+		if data, ok = c.readBlock(fields[2]); !ok {
+			return false
+		}
+		flags = flags[1:]
+	}
+	if len(key) > 250 {
+		c.writeText(textError(StatusInvalidArgs), false)
+		return true
+	}
+	for _, t := range flags {
+		if !strings.Contains(metaFlagLetters[cmd], t[:1]) {
+			c.writeText("CLIENT_ERROR invalid flag", false)
+			return true
+		}
+	}
+	if f := c.server.match(metaCommands[cmd], key); f != nil {
+		if !c.delay(f) || f.Action == FaultCloseConnection {
+			return false
+		}
+		if f.Status != 0 {
+			c.writeText(textError(f.Status), false)
+			return true
+		}
+	}
+	var r *metaResult
+	switch cmd {
+	case "mg":
+		r = c.metaGet(key, flags)
+	case "ms":
+		r = c.metaSet(key, data, flags)
+	case "md":
+		r = c.metaDelete(key, flags)
+	case "ma":
+		r = c.metaArithmetic(key, flags)
+	}
+	if flags.has('q') && strings.Contains(metaQuiet[cmd], r.code) {
+		return true
+	}
+	line := r.code
+	if r.code == "VA" {
+		line += " " + strconv.Itoa(len(r.value))
+	}
+	for _, f := range r.flags {
+		line += " " + f
+	}
+	c.writeText(line, false)
+	if r.code == "VA" {
+		c.w.Write(r.value)
+		c.w.WriteString("\r\n")
+	}
+	return true
+}
+
+func (c *serverConn) metaGet(key string, flags metaFlags) *metaResult {
+	recache, ok := flags.number('R', 0, 32)
+	if !ok {
+		return metaError(StatusInvalidArgs)
+	}
+	vivify, ok := flags.expiration('N')
+	if !ok {
+		return metaError(StatusInvalidArgs)
+	}
+	touch, ok := flags.expiration('T')
+	if !ok {
+		return metaError(StatusInvalidArgs)
+	}
+	s := c.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.cmdGet++
+	now := s.now()
+	var win, stale, pending bool
+	it := s.lookup(key)
+	switch {
+	case it == nil && !flags.has('N'):
+		s.stats.getMisses++
+		return (&metaResult{code: "EN"}).echo(key, flags)
+	case it == nil:
+		// Create an empty item, whose value the caller is expected to
+		// store.
+		s.stats.getMisses++
+		it = &item{expires: s.expiresAt(vivify), won: true}
+		s.store(key, it)
+		win = true
+	default:
+		s.stats.getHits++
+		switch {
+		case it.stale:
+			stale = true
+			win, pending = !it.won, it.won
+			it.won = true
+		case it.won:
+			pending = true
+		case recache > 0 && !it.expires.IsZero() && it.expires.Sub(now) < time.Duration(recache)*time.Second:
+			win, it.won = true, true
+		}
+	}
+	if flags.has('T') {
+		s.stats.cmdTouch++
+		it.expires = s.expiresAt(touch)
+	}
+
+	r := &metaResult{code: "HD"}
+	if flags.has('v') {
+		r.code, r.value = "VA", append([]byte(nil), it.value...)
+	}
+	for _, t := range flags {
+		switch t[0] {
+		case 'f':
+			r.flags = append(r.flags, "f"+strconv.FormatUint(uint64(it.flags), 10))
+		case 'c':
+			r.flags = append(r.flags, "c"+strconv.FormatUint(it.cas, 10))
+		case 's':
+			r.flags = append(r.flags, "s"+strconv.Itoa(len(it.value)))
+		case 't':
+			ttl := int64(-1)
+			if !it.expires.IsZero() {
+				ttl = int64(it.expires.Sub(now) / time.Second)
+			}
+			r.flags = append(r.flags, "t"+strconv.FormatInt(ttl, 10))
+		case 'l':
+			r.flags = append(r.flags, "l"+strconv.FormatInt(int64(now.Sub(it.accessed)/time.Second), 10))
+		case 'h':
+			h := "h0"
+			if it.fetched {
+				h = "h1"
+			}
+			r.flags = append(r.flags, h)
+		}
+	}
+	r.echo(key, flags)
+	if win {
+		r.flags = append(r.flags, "W")
+	}
+	if stale {
+		r.flags = append(r.flags, "X")
+	}
+	if pending {
+		r.flags = append(r.flags, "Z")
+	}
+	it.accessed, it.fetched = now, true
+	return r
+}
+
+func (c *serverConn) metaSet(key string, data []byte, flags metaFlags) *metaResult {
+	itemFlags, ok := flags.number('F', 0, 32)
+	if !ok {
+		return metaError(StatusInvalidArgs)
+	}
+	exp, ok := flags.expiration('T')
+	if !ok {
+		return metaError(StatusInvalidArgs)
+	}
+	cas, ok := flags.number('C', 0, 64)
+	if !ok {
+		return metaError(StatusInvalidArgs)
+	}
+	mode, _ := flags.token('M')
+	mode = strings.ToUpper(mode)
+	if mode == "" {
+		mode = "S"
+	}
+	if len(mode) != 1 || !strings.Contains("SEARP", mode) {
+		return metaError(StatusInvalidArgs)
+	}
+	s := c.server
+	if len(data) > s.maxItemSize() {
+		return metaError(StatusValueTooLarge)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.cmdSet++
+	cur := s.lookup(key)
+	var stale bool
+	if flags.has('C') {
+		switch {
+		case cur == nil:
+			return (&metaResult{code: "NF"}).echo(key, flags)
+		case cur.cas == cas:
+		case flags.has('I') && cas < cur.cas:
+			// An invalidation racing with the caller's store: keep the
+			// value, but as stale.
+			stale = true
+		default:
+			return (&metaResult{code: "EX"}).echo(key, flags)
+		}
+	}
+	it := &item{
+		value:   append([]byte(nil), data...),
+		flags:   uint32(itemFlags),
+		expires: s.expiresAt(exp),
+		stale:   stale,
+	}
+	switch mode {
+	case "E":
+		if cur != nil {
+			return (&metaResult{code: "NS"}).echo(key, flags)
+		}
+	case "R":
+		if cur == nil {
+			return (&metaResult{code: "NS"}).echo(key, flags)
+		}
+	case "A", "P":
+		if cur == nil {
+			return (&metaResult{code: "NS"}).echo(key, flags)
+		}
+		if len(cur.value)+len(data) > s.maxItemSize() {
+			return metaError(StatusValueTooLarge)
+		}
+		if mode == "A" {
+			it.value = append(append([]byte(nil), cur.value...), data...)
+		} else {
+			it.value = append(it.value, cur.value...)
+		}
+		it.flags, it.expires = cur.flags, cur.expires
+	}
+	s.store(key, it)
+	r := &metaResult{code: "HD"}
+	if flags.has('c') {
+		r.flags = append(r.flags, "c"+strconv.FormatUint(it.cas, 10))
+	}
+	return r.echo(key, flags)
+}
+
+func (c *serverConn) metaDelete(key string, flags metaFlags) *metaResult {
+	cas, ok := flags.number('C', 0, 64)
+	if !ok {
+		return metaError(StatusInvalidArgs)
+	}
+	exp, ok := flags.expiration('T')
+	if !ok {
+		return metaError(StatusInvalidArgs)
+	}
+	s := c.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur := s.lookup(key)
+	switch {
+	case cur == nil:
+		return (&metaResult{code: "NF"}).echo(key, flags)
+	case flags.has('C') && cur.cas != cas:
+		return (&metaResult{code: "EX"}).echo(key, flags)
+	case flags.has('I'):
+		// Keep the item, but as stale, with a new CAS so that the
+		// stores of the clients which got it before fail.
+		s.cas++
+		cur.cas = s.cas
+		cur.stale, cur.won = true, false
+		if flags.has('T') {
+			cur.expires = s.expiresAt(exp)
+		}
+	default:
+		delete(s.items, key)
+	}
+	return (&metaResult{code: "HD"}).echo(key, flags)
+}
+
+func (c *serverConn) metaArithmetic(key string, flags metaFlags) *metaResult {
+	delta, ok := flags.number('D', 1, 64)
+	if !ok {
+		return &metaResult{code: "CLIENT_ERROR invalid numeric delta argument"}
+	}
+	initial, ok := flags.number('J', 0, 64)
+	if !ok {
+		return metaError(StatusInvalidArgs)
+	}
+	cas, ok := flags.number('C', 0, 64)
+	if !ok {
+		return metaError(StatusInvalidArgs)
+	}
+	vivify, ok := flags.expiration('N')
+	if !ok {
+		return metaError(StatusInvalidArgs)
+	}
+	touch, ok := flags.expiration('T')
+	if !ok {
+		return metaError(StatusInvalidArgs)
+	}
+	var decr bool
+	switch mode, _ := flags.token('M'); mode {
+	case "", "I", "i", "+":
+	case "D", "d", "-":
+		decr = true
+	default:
+		return metaError(StatusInvalidArgs)
+	}
+	s := c.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	cur := s.lookup(key)
+	var it *item
+	switch {
+	case cur == nil && !flags.has('N'):
+		return (&metaResult{code: "NF"}).echo(key, flags)
+	case cur == nil:
+		it = &item{value: []byte(strconv.FormatUint(initial, 10)), expires: s.expiresAt(vivify)}
+	case flags.has('C') && cur.cas != cas:
+		return (&metaResult{code: "EX"}).echo(key, flags)
+	default:
+		v, err := strconv.ParseUint(string(cur.value), 10, 64)
+		if err != nil {
+			return metaError(StatusNonNumeric)
+		}
+		switch {
+		case !decr:
+			v += delta
+		case delta > v:
+			v = 0
+		default:
+			v -= delta
+		}
+		it = &item{value: []byte(strconv.FormatUint(v, 10)), flags: cur.flags, expires: cur.expires}
+	}
+	if flags.has('T') {
+		it.expires = s.expiresAt(touch)
+	}
+	s.store(key, it)
+
+	r := &metaResult{code: "HD"}
+	if flags.has('v') {
+		r.code, r.value = "VA", append([]byte(nil), it.value...)
+	}
+	for _, t := range flags {
+		switch t[0] {
+		case 'c':
+			r.flags = append(r.flags, "c"+strconv.FormatUint(it.cas, 10))
+		case 't':
+			ttl := int64(-1)
+			if !it.expires.IsZero() {
+				ttl = int64(it.expires.Sub(now) / time.Second)
+			}
+			r.flags = append(r.flags, "t"+strconv.FormatInt(ttl, 10))
+		}
+	}
+	return r.echo(key, flags)
+}
@@ -0,0 +1,90 @@
+package memtest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeta(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := NewUnstartedServer()
+	s.Clock = func() time.Time { return now }
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := dialText(t, s)
+
+	c.do("ms foo 3 F42 T100 c\r\nbar\r\n", "HD c1")
+	c.do("mg foo v f c t k Oabc\r\n", "VA 3 f42 c1 t100 kfoo Oabc", "bar")
+	c.do("mg missing v\r\n", "EN")
+	c.do("mg missing v q\r\nmn\r\n", "MN")
+	c.do("ms foo 1 ME\r\nx\r\n", "NS")
+	c.do("ms missing 1 MR\r\nx\r\n", "NS")
+	c.do("ms foo 3 MA c\r\nbaz\r\n", "HD c2")
+	c.do("ms foo 1 C1\r\nx\r\n", "EX")
+	c.do("ms missing 1 C1\r\nx\r\n", "NF")
+	c.do("mg foo s v\r\n", "VA 6 s6", "barbaz")
+
+	now = now.Add(5 * time.Second)
+	c.do("mg foo h l\r\n", "HD h1 l5")
+	c.do("ms fresh 1\r\nx\r\n", "HD")
+	c.do("mg fresh h\r\n", "HD h0")
+	c.do("mg fresh t T30\r\n", "HD t30")
+
+	c.do("ma n N0 J10 v\r\n", "VA 2", "10")
+	c.do("ma n D5 v\r\n", "VA 2", "15")
+	c.do("ma n MD D20 v\r\n", "VA 1", "0")
+	c.do("ma n\r\n", "HD")
+	c.do("ma missing\r\n", "NF")
+	c.do("ma foo\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+
+	c.do("md foo q\r\nmd foo\r\n", "NF")
+	c.do("mg foo Z\r\n", "CLIENT_ERROR invalid flag")
+	c.do("mn\r\n", "MN")
+}
+
+func TestMetaStaleWhileRevalidate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := NewUnstartedServer()
+	s.Clock = func() time.Time { return now }
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := dialText(t, s)
+
+	// A miss with N is won by the first client only.
+	c.do("mg key v c N30\r\n", "VA 0 c1 W", "")
+	c.do("mg key v c N30\r\n", "VA 0 c1 Z", "")
+	c.do("ms key 3 C1 T60\r\nold\r\n", "HD")
+	c.do("mg key v\r\n", "VA 3", "old")
+
+	// Invalidating the item keeps serving it, as stale.
+	c.do("md key I T30\r\n", "HD")
+	c.do("mg key v c\r\n", "VA 3 c3 W X", "old")
+	c.do("mg key v c\r\n", "VA 3 c3 X Z", "old")
+	// A store with the CAS from before the invalidation keeps the item
+	// stale, the winner's doesn't.
+	c.do("ms key 4 C2 I\r\nlate\r\n", "HD")
+	c.do("mg key v\r\n", "VA 4 W X", "late")
+	c.do("mg key c\r\n", "HD c4 X Z")
+	c.do("ms key 3 C4 T60\r\nnew\r\n", "HD")
+	c.do("mg key v\r\n", "VA 3", "new")
+
+	// R wins the recache of an item about to expire.
+	c.do("mg key R30\r\n", "HD")
+	now = now.Add(40 * time.Second)
+	c.do("mg key R30\r\n", "HD W")
+	c.do("mg key R30\r\n", "HD Z")
+}
+
+func TestMetaFault(t *testing.T) {
+	s := newTestServer(t)
+	c := dialText(t, s)
+	s.InjectFault(Fault{Command: "set", Times: 1, Status: StatusBusy})
+	c.do("ms foo 1\r\nx\r\n", "SERVER_ERROR Busy")
+	c.do("ms foo 1\r\nx\r\n", "HD")
+	s.InjectFault(Fault{Command: "noop", Times: 1, Status: StatusTemporaryError})
+	c.do("mn\r\n", "SERVER_ERROR Temporary failure")
+}
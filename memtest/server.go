@@ -0,0 +1,908 @@
+// Package memtest provides an in-memory memcached server speaking the
+// binary and text protocols, for use in tests.
+//
+// A Server keeps all items in memory and understands the storage,
+// retrieval, arithmetic, touch, flush, stat and SASL PLAIN commands,
+// including their quiet variants, as well as the mg, ms, md, ma and mn
+// meta commands. Text protocol clients authenticate with the "set"
+// command, as with memcached's -Y option. Expirations are evaluated
+// against a clock which tests can replace to simulate the passage of
+// time, and faults can be injected to test how clients handle slow,
+// failing or misbehaving servers.
+package memtest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is an in-memory memcached server. The zero value is not
+// usable, use NewServer or NewUnstartedServer.
+type Server struct {
+	// Addr is the address of the server once started, in the form
+	// accepted by memcache.Config.Server: host:port for TCP servers
+	// or the socket path for unix servers.
+	Addr string
+
+	// User and Password, when not empty, require clients to
+	// authenticate before issuing any command, using SASL PLAIN or,
+	// over the text protocol, a set of "User Password".
+	User     string
+	Password string
+
+	// Clock returns the current time and is used to evaluate item
+	// expirations. It defaults to time.Now.
+	Clock func() time.Time
+
+	// MaxItemSize is the maximum size of a value. Larger values are
+	// rejected with a "value too large" status. It defaults to 1MB.
+	MaxItemSize int
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu     sync.Mutex
+	items  map[string]*item
+	cas    uint64
+	conns  map[net.Conn]struct{}
+	closed bool
+	done   chan struct{}
+	stats  stats
+	faults []*Fault
+}
+
+type item struct {
+	value   []byte
+	flags   uint32
+	cas     uint64
+	expires time.Time
+
+	// accessed is the time of the last store or retrieval of the item,
+	// and fetched whether it was retrieved since it was stored.
+	accessed time.Time
+	fetched  bool
+
+	// stale is set once the item is invalidated with a meta command,
+	// and won once a meta get won the right to recache it.
+	stale bool
+	won   bool
+}
+
+type stats struct {
+	started     time.Time
+	connections uint64
+	cmdGet      uint64
+	cmdSet      uint64
+	cmdTouch    uint64
+	getHits     uint64
+	getMisses   uint64
+	totalItems  uint64
+}
+
+// NewServer starts and returns a new Server listening on a random TCP
+// port on the loopback interface. It panics if the server can't be
+// started. The caller should call Close when finished.
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	if err := s.Start(); err != nil {
+		panic(fmt.Sprintf("memtest: failed to start server: %v", err))
+	}
+	return s
+}
+
+// NewUnstartedServer returns a new Server but doesn't start it. The
+// caller may change its configuration before calling Start, StartUnix
+// or Serve.
+func NewUnstartedServer() *Server {
+	return &Server{
+		items: make(map[string]*item),
+		conns: make(map[net.Conn]struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// Start starts the server on a random TCP port on the loopback interface.
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.Addr = l.Addr().String()
+	s.start(l)
+	return nil
+}
+
+// StartUnix starts the server on the unix socket at path. An existing
+// file at path is removed first.
+func (s *Server) StartUnix(path string) error {
+	_ = os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	s.Addr = path
+	s.start(l)
+	return nil
+}
+
+func (s *Server) start(l net.Listener) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		_ = s.Serve(l)
+	}()
+}
+
+// Serve accepts connections on l, serving each one in its own goroutine,
+// until l is closed or the server is closed. l is closed right away if
+// the server already is.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	s.listener = l
+	if s.stats.started.IsZero() {
+		s.stats.started = s.now()
+	}
+	s.mu.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return err
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.ServeConn(conn)
+		}()
+	}
+}
+
+// ServeConn serves a single connection, such as one end of a net.Pipe,
+// until the client closes it or sends a quit command. The connection is
+// closed when ServeConn returns.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	if s.stats.started.IsZero() {
+		s.stats.started = s.now()
+	}
+	s.conns[conn] = struct{}{}
+	s.stats.connections++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	c := &serverConn{
+		server: s,
+		conn:   conn,
+		r:      bufio.NewReader(conn),
+		w:      bufio.NewWriter(conn),
+		authed: s.User == "" && s.Password == "",
+	}
+	c.serve()
+}
+
+// Close stops the server, closing its listener and all the open client
+// connections, and waits for the serving goroutines to exit.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// CloseClientConnections closes all the currently open client
+// connections, simulating a server restart without losing any items.
+func (s *Server) CloseClientConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Connections returns the number of currently open client connections.
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Flush removes all the items stored in the server.
+func (s *Server) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items = make(map[string]*item)
+}
+
+// Len returns the number of live items stored in the server.
+func (s *Server) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key := range s.items {
+		if s.lookup(key) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock()
+	}
+	return time.Now()
+}
+
+func (s *Server) maxItemSize() int {
+	if s.MaxItemSize > 0 {
+		return s.MaxItemSize
+	}
+	return 1 << 20
+}
+
+// expiresAt converts a protocol expiration into an absolute time, using
+// the same rules as memcached: zero means no expiration, values up to 30
+// days are relative to now and anything larger is a Unix timestamp.
+func (s *Server) expiresAt(exp uint32) time.Time {
+	if exp == 0 {
+		return time.Time{}
+	}
+	if int32(exp) < 0 {
+		return s.now().Add(-time.Second)
+	}
+	if exp <= 60*60*24*30 {
+		return s.now().Add(time.Duration(exp) * time.Second)
+	}
+	return time.Unix(int64(exp), 0)
+}
+
+// lookup returns the live item for key, evicting it if it expired.
+// s.mu must be held.
+func (s *Server) lookup(key string) *item {
+	it := s.items[key]
+	if it == nil {
+		return nil
+	}
+	if !it.expires.IsZero() && !s.now().Before(it.expires) {
+		delete(s.items, key)
+		return nil
+	}
+	return it
+}
+
+// store saves it under key, assigning it a new CAS value. s.mu must
+// be held.
+func (s *Server) store(key string, it *item) {
+	s.cas++
+	it.cas = s.cas
+	it.accessed = s.now()
+	s.items[key] = it
+	s.stats.totalItems++
+}
+
+// Binary protocol opcodes, see
+// https://github.com/memcached/memcached/wiki/BinaryProtocolRevamped
+const (
+	opGet        = 0x00
+	opSet        = 0x01
+	opAdd        = 0x02
+	opReplace    = 0x03
+	opDelete     = 0x04
+	opIncrement  = 0x05
+	opDecrement  = 0x06
+	opQuit       = 0x07
+	opFlush      = 0x08
+	opGetQ       = 0x09
+	opNoop       = 0x0a
+	opVersion    = 0x0b
+	opGetK       = 0x0c
+	opGetKQ      = 0x0d
+	opAppend     = 0x0e
+	opPrepend    = 0x0f
+	opStat       = 0x10
+	opSetQ       = 0x11
+	opAddQ       = 0x12
+	opReplaceQ   = 0x13
+	opDeleteQ    = 0x14
+	opIncrementQ = 0x15
+	opDecrementQ = 0x16
+	opQuitQ      = 0x17
+	opFlushQ     = 0x18
+	opAppendQ    = 0x19
+	opPrependQ   = 0x1a
+	opTouch      = 0x1c
+	opGAT        = 0x1d
+	opGATQ       = 0x1e
+	opSASLList   = 0x20
+	opSASLAuth   = 0x21
+	opSASLStep   = 0x22
+	opGATK       = 0x23
+	opGATKQ      = 0x24
+)
+
+// Response statuses, which can also be injected with a Fault.
+const (
+	StatusOK             = 0x00
+	StatusKeyNotFound    = 0x01
+	StatusKeyExists      = 0x02
+	StatusValueTooLarge  = 0x03
+	StatusInvalidArgs    = 0x04
+	StatusItemNotStored  = 0x05
+	StatusNonNumeric     = 0x06
+	StatusAuthError      = 0x20
+	StatusUnknownCommand = 0x81
+	StatusOutOfMemory    = 0x82
+	StatusNotSupported   = 0x83
+	StatusInternalError  = 0x84
+	StatusBusy           = 0x85
+	StatusTemporaryError = 0x86
+)
+
+const (
+	reqMagic  = 0x80
+	respMagic = 0x81
+
+	// Version is the version string reported by the server.
+	Version = "1.6.21-memtest"
+)
+
+var statusText = map[uint16]string{
+	StatusKeyNotFound:    "Not found",
+	StatusKeyExists:      "Data exists for key.",
+	StatusValueTooLarge:  "Too large.",
+	StatusInvalidArgs:    "Invalid arguments",
+	StatusItemNotStored:  "Not stored.",
+	StatusNonNumeric:     "Non-numeric server-side value for incr or decr",
+	StatusAuthError:      "Auth failure.",
+	StatusUnknownCommand: "Unknown command",
+	StatusOutOfMemory:    "Out of memory",
+	StatusNotSupported:   "Not supported",
+	StatusInternalError:  "Internal error",
+	StatusBusy:           "Busy",
+	StatusTemporaryError: "Temporary failure",
+}
+
+// request is a decoded binary protocol request.
+type request struct {
+	opcode uint8
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+type serverConn struct {
+	server *Server
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	authed bool
+
+	// fault corrupts the responses to the request being handled.
+	fault *Fault
+	// broken is set once a fault left the connection unusable.
+	broken bool
+
+	// text is set while a text protocol command runs through the binary
+	// handlers, whose responses are then captured in replies.
+	text    bool
+	replies []reply
+}
+
+func (c *serverConn) serve() {
+	for {
+		magic, err := c.r.Peek(1)
+		if err != nil {
+			return
+		}
+		var ok bool
+		if magic[0] != reqMagic {
+			ok = c.serveText()
+		} else {
+			req, err := c.readRequest()
+			if err != nil {
+				return
+			}
+			ok = c.exec(req)
+		}
+		if !ok {
+			c.w.Flush()
+			return
+		}
+		// Only flush once the pipeline is drained, so batches of
+		// quiet commands are answered in as few writes as possible.
+		if c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *serverConn) readRequest() (*request, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	kl := int(binary.BigEndian.Uint16(hdr[2:4]))
+	el := int(hdr[4])
+	total := int(binary.BigEndian.Uint32(hdr[8:12]))
+	if el+kl > total {
+		return nil, fmt.Errorf("memtest: invalid request lengths")
+	}
+	body := make([]byte, total)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return nil, err
+	}
+	return &request{
+		opcode: hdr[1],
+		opaque: binary.BigEndian.Uint32(hdr[12:16]),
+		cas:    binary.BigEndian.Uint64(hdr[16:24]),
+		extras: body[:el],
+		key:    body[el : el+kl],
+		value:  body[el+kl:],
+	}, nil
+}
+
+func (c *serverConn) writeResponse(req *request, status uint16, cas uint64, extras, key, value []byte) {
+	if c.broken {
+		return
+	}
+	if c.text {
+		c.replies = append(c.replies, reply{status, cas, extras, key, value})
+		return
+	}
+	if c.fault != nil && c.fault.Action == FaultWrongKey && len(key) > 0 {
+		key = append([]byte("wrong-"), key...)
+	}
+	var hdr [24]byte
+	hdr[0] = respMagic
+	hdr[1] = req.opcode
+	binary.BigEndian.PutUint16(hdr[2:4], uint16(len(key)))
+	hdr[4] = byte(len(extras))
+	binary.BigEndian.PutUint16(hdr[6:8], status)
+	binary.BigEndian.PutUint32(hdr[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(hdr[12:16], req.opaque)
+	binary.BigEndian.PutUint64(hdr[16:24], cas)
+	if c.fault != nil {
+		c.writeFaulty(hdr[:], append(append(append([]byte(nil), extras...), key...), value...))
+		return
+	}
+	c.w.Write(hdr[:])
+	c.w.Write(extras)
+	c.w.Write(key)
+	c.w.Write(value)
+}
+
+func (c *serverConn) writeStatus(req *request, status uint16) {
+	c.writeResponse(req, status, 0, nil, nil, []byte(statusText[status]))
+}
+
+// exec executes req, under the fault applying to it if any. It returns
+// false if the connection must be closed.
+func (c *serverConn) exec(req *request) bool {
+	if f := c.server.fault(req); f != nil {
+		return c.handleFault(req, f)
+	}
+	return c.handle(req)
+}
+
+// handle executes req and writes its response, if any. It returns false
+// if the connection must be closed.
+func (c *serverConn) handle(req *request) bool {
+	if !c.authed && req.opcode != opSASLList && req.opcode != opSASLAuth && req.opcode != opSASLStep {
+		c.writeStatus(req, StatusAuthError)
+		return true
+	}
+	if len(req.key) > 250 {
+		c.writeStatus(req, StatusInvalidArgs)
+		return true
+	}
+	switch req.opcode {
+	case opGet, opGetQ, opGetK, opGetKQ:
+		c.get(req, req.opcode == opGetQ || req.opcode == opGetKQ, req.opcode == opGetK || req.opcode == opGetKQ, false)
+	case opGAT, opGATQ, opGATK, opGATKQ:
+		c.get(req, req.opcode == opGATQ || req.opcode == opGATKQ, req.opcode == opGATK || req.opcode == opGATKQ, true)
+	case opSet, opSetQ, opAdd, opAddQ, opReplace, opReplaceQ:
+		c.set(req)
+	case opAppend, opAppendQ, opPrepend, opPrependQ:
+		c.concat(req)
+	case opDelete, opDeleteQ:
+		c.delete(req)
+	case opIncrement, opIncrementQ, opDecrement, opDecrementQ:
+		c.incrDecr(req)
+	case opTouch:
+		c.touch(req)
+	case opFlush, opFlushQ:
+		c.flush(req)
+	case opNoop:
+		c.writeResponse(req, StatusOK, 0, nil, nil, nil)
+	case opVersion:
+		c.writeResponse(req, StatusOK, 0, nil, nil, []byte(Version))
+	case opStat:
+		c.stat(req)
+	case opQuit:
+		c.writeResponse(req, StatusOK, 0, nil, nil, nil)
+		return false
+	case opQuitQ:
+		return false
+	case opSASLList:
+		c.writeResponse(req, StatusOK, 0, nil, nil, []byte("PLAIN"))
+	case opSASLAuth:
+		c.saslAuth(req)
+	case opSASLStep:
+		c.writeStatus(req, StatusAuthError)
+	default:
+		c.writeStatus(req, StatusUnknownCommand)
+	}
+	return true
+}
+
+func (c *serverConn) get(req *request, quiet, withKey, touch bool) {
+	if touch && len(req.extras) != 4 || !touch && len(req.extras) != 0 {
+		c.writeStatus(req, StatusInvalidArgs)
+		return
+	}
+	s := c.server
+	s.mu.Lock()
+	s.stats.cmdGet++
+	it := s.lookup(string(req.key))
+	if it == nil {
+		s.stats.getMisses++
+		s.mu.Unlock()
+		if !quiet {
+			if withKey {
+				c.writeResponse(req, StatusKeyNotFound, 0, nil, req.key, nil)
+			} else {
+				c.writeStatus(req, StatusKeyNotFound)
+			}
+		}
+		return
+	}
+	s.stats.getHits++
+	it.accessed, it.fetched = s.now(), true
+	if touch {
+		s.stats.cmdTouch++
+		it.expires = s.expiresAt(binary.BigEndian.Uint32(req.extras))
+	}
+	extras := make([]byte, 4)
+	binary.BigEndian.PutUint32(extras, it.flags)
+	value := append([]byte(nil), it.value...)
+	cas := it.cas
+	s.mu.Unlock()
+	var key []byte
+	if withKey {
+		key = req.key
+	}
+	c.writeResponse(req, StatusOK, cas, extras, key, value)
+}
+
+// checkCAS reports the status for a request carrying a CAS value
+// against the current item, or StatusOK if the request may proceed.
+func checkCAS(req *request, it *item) uint16 {
+	if req.cas == 0 {
+		return StatusOK
+	}
+	if it == nil {
+		return StatusKeyNotFound
+	}
+	if it.cas != req.cas {
+		return StatusKeyExists
+	}
+	return StatusOK
+}
+
+func (c *serverConn) set(req *request) {
+	if len(req.extras) != 8 {
+		c.writeStatus(req, StatusInvalidArgs)
+		return
+	}
+	quiet := req.opcode == opSetQ || req.opcode == opAddQ || req.opcode == opReplaceQ
+	if len(req.value) > c.server.maxItemSize() {
+		c.writeStatus(req, StatusValueTooLarge)
+		return
+	}
+	s := c.server
+	s.mu.Lock()
+	s.stats.cmdSet++
+	key := string(req.key)
+	cur := s.lookup(key)
+	status := checkCAS(req, cur)
+	if status == StatusOK {
+		switch req.opcode {
+		case opAdd, opAddQ:
+			if cur != nil {
+				status = StatusKeyExists
+			}
+		case opReplace, opReplaceQ:
+			if cur == nil {
+				status = StatusKeyNotFound
+			}
+		}
+	}
+	if status != StatusOK {
+		s.mu.Unlock()
+		c.writeStatus(req, status)
+		return
+	}
+	it := &item{
+		value:   append([]byte(nil), req.value...),
+		flags:   binary.BigEndian.Uint32(req.extras[0:4]),
+		expires: s.expiresAt(binary.BigEndian.Uint32(req.extras[4:8])),
+	}
+	s.store(key, it)
+	cas := it.cas
+	s.mu.Unlock()
+	if !quiet {
+		c.writeResponse(req, StatusOK, cas, nil, nil, nil)
+	}
+}
+
+func (c *serverConn) concat(req *request) {
+	if len(req.extras) != 0 {
+		c.writeStatus(req, StatusInvalidArgs)
+		return
+	}
+	quiet := req.opcode == opAppendQ || req.opcode == opPrependQ
+	s := c.server
+	s.mu.Lock()
+	s.stats.cmdSet++
+	key := string(req.key)
+	cur := s.lookup(key)
+	status := checkCAS(req, cur)
+	if status == StatusOK && cur == nil {
+		status = StatusItemNotStored
+	}
+	if status == StatusOK && len(cur.value)+len(req.value) > s.maxItemSize() {
+		status = StatusValueTooLarge
+	}
+	if status != StatusOK {
+		s.mu.Unlock()
+		c.writeStatus(req, status)
+		return
+	}
+	var value []byte
+	if req.opcode == opAppend || req.opcode == opAppendQ {
+		value = append(append(value, cur.value...), req.value...)
+	} else {
+		value = append(append(value, req.value...), cur.value...)
+	}
+	it := &item{value: value, flags: cur.flags, expires: cur.expires}
+	s.store(key, it)
+	cas := it.cas
+	s.mu.Unlock()
+	if !quiet {
+		c.writeResponse(req, StatusOK, cas, nil, nil, nil)
+	}
+}
+
+func (c *serverConn) delete(req *request) {
+	if len(req.extras) != 0 || len(req.value) != 0 {
+		c.writeStatus(req, StatusInvalidArgs)
+		return
+	}
+	s := c.server
+	s.mu.Lock()
+	key := string(req.key)
+	cur := s.lookup(key)
+	status := checkCAS(req, cur)
+	if status == StatusOK && cur == nil {
+		status = StatusKeyNotFound
+	}
+	if status == StatusOK {
+		delete(s.items, key)
+	}
+	s.mu.Unlock()
+	if status != StatusOK {
+		c.writeStatus(req, status)
+		return
+	}
+	if req.opcode == opDelete {
+		c.writeResponse(req, StatusOK, 0, nil, nil, nil)
+	}
+}
+
+func (c *serverConn) incrDecr(req *request) {
+	if len(req.extras) != 20 || len(req.value) != 0 {
+		c.writeStatus(req, StatusInvalidArgs)
+		return
+	}
+	quiet := req.opcode == opIncrementQ || req.opcode == opDecrementQ
+	incr := req.opcode == opIncrement || req.opcode == opIncrementQ
+	delta := binary.BigEndian.Uint64(req.extras[0:8])
+	initial := binary.BigEndian.Uint64(req.extras[8:16])
+	exp := binary.BigEndian.Uint32(req.extras[16:20])
+
+	s := c.server
+	s.mu.Lock()
+	key := string(req.key)
+	cur := s.lookup(key)
+	status := checkCAS(req, cur)
+	var n uint64
+	if status == StatusOK {
+		switch {
+		case cur == nil && exp == 0xffffffff:
+			status = StatusKeyNotFound
+		case cur == nil:
+			n = initial
+			it := &item{value: []byte(strconv.FormatUint(n, 10)), expires: s.expiresAt(exp)}
+			s.store(key, it)
+			cur = it
+		default:
+			v, err := strconv.ParseUint(string(cur.value), 10, 64)
+			if err != nil {
+				status = StatusNonNumeric
+				break
+			}
+			if incr {
+				n = v + delta
+			} else if delta > v {
+				n = 0
+			} else {
+				n = v - delta
+			}
+			it := &item{value: []byte(strconv.FormatUint(n, 10)), flags: cur.flags, expires: cur.expires}
+			s.store(key, it)
+			cur = it
+		}
+	}
+	var cas uint64
+	if cur != nil {
+		cas = cur.cas
+	}
+	s.mu.Unlock()
+	if status != StatusOK {
+		c.writeStatus(req, status)
+		return
+	}
+	if !quiet {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, n)
+		c.writeResponse(req, StatusOK, cas, nil, nil, value)
+	}
+}
+
+func (c *serverConn) touch(req *request) {
+	if len(req.extras) != 4 {
+		c.writeStatus(req, StatusInvalidArgs)
+		return
+	}
+	s := c.server
+	s.mu.Lock()
+	s.stats.cmdTouch++
+	it := s.lookup(string(req.key))
+	var cas uint64
+	if it != nil {
+		it.expires = s.expiresAt(binary.BigEndian.Uint32(req.extras))
+		cas = it.cas
+	}
+	s.mu.Unlock()
+	if it == nil {
+		c.writeStatus(req, StatusKeyNotFound)
+		return
+	}
+	c.writeResponse(req, StatusOK, cas, nil, nil, nil)
+}
+
+func (c *serverConn) flush(req *request) {
+	var delay uint32
+	switch len(req.extras) {
+	case 0:
+	case 4:
+		delay = binary.BigEndian.Uint32(req.extras)
+	default:
+		c.writeStatus(req, StatusInvalidArgs)
+		return
+	}
+	s := c.server
+	s.mu.Lock()
+	if delay == 0 {
+		s.items = make(map[string]*item)
+	} else {
+		at := s.expiresAt(delay)
+		for _, it := range s.items {
+			if it.expires.IsZero() || it.expires.After(at) {
+				it.expires = at
+			}
+		}
+	}
+	s.mu.Unlock()
+	if req.opcode == opFlush {
+		c.writeResponse(req, StatusOK, 0, nil, nil, nil)
+	}
+}
+
+func (c *serverConn) stat(req *request) {
+	s := c.server
+	s.mu.Lock()
+	now := s.now()
+	currItems := 0
+	for key := range s.items {
+		if s.lookup(key) != nil {
+			currItems++
+		}
+	}
+	stats := [][2]string{
+		{"pid", strconv.Itoa(os.Getpid())},
+		{"uptime", strconv.FormatInt(int64(now.Sub(s.stats.started)/time.Second), 10)},
+		{"time", strconv.FormatInt(now.Unix(), 10)},
+		{"version", Version},
+		{"curr_connections", strconv.Itoa(len(s.conns))},
+		{"total_connections", strconv.FormatUint(s.stats.connections, 10)},
+		{"cmd_get", strconv.FormatUint(s.stats.cmdGet, 10)},
+		{"cmd_set", strconv.FormatUint(s.stats.cmdSet, 10)},
+		{"cmd_touch", strconv.FormatUint(s.stats.cmdTouch, 10)},
+		{"get_hits", strconv.FormatUint(s.stats.getHits, 10)},
+		{"get_misses", strconv.FormatUint(s.stats.getMisses, 10)},
+		{"curr_items", strconv.Itoa(currItems)},
+		{"total_items", strconv.FormatUint(s.stats.totalItems, 10)},
+	}
+	s.mu.Unlock()
+	for _, kv := range stats {
+		if len(req.key) > 0 && string(req.key) != kv[0] {
+			continue
+		}
+		c.writeResponse(req, StatusOK, 0, nil, []byte(kv[0]), []byte(kv[1]))
+	}
+	c.writeResponse(req, StatusOK, 0, nil, nil, nil)
+}
+
+func (c *serverConn) saslAuth(req *request) {
+	if string(req.key) != "PLAIN" {
+		c.writeStatus(req, StatusAuthError)
+		return
+	}
+	// PLAIN: [authzid] NUL authcid NUL passwd
+	parts := strings.Split(string(req.value), "\x00")
+	if len(parts) != 3 || parts[1] != c.server.User || parts[2] != c.server.Password {
+		c.writeStatus(req, StatusAuthError)
+		return
+	}
+	c.authed = true
+	c.writeResponse(req, StatusOK, 0, nil, nil, []byte("Authenticated"))
+}
@@ -0,0 +1,367 @@
+package memtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type response struct {
+	opcode uint8
+	status uint16
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+// testConn is a minimal binary protocol client.
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func dial(t *testing.T, s *Server) *testConn {
+	t.Helper()
+	network := "tcp"
+	if filepath.IsAbs(s.Addr) {
+		network = "unix"
+	}
+	conn, err := net.Dial(network, s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn}
+}
+
+func (c *testConn) send(opcode uint8, opaque uint32, cas uint64, extras, key, value []byte) {
+	c.t.Helper()
+	var hdr [24]byte
+	hdr[0] = reqMagic
+	hdr[1] = opcode
+	binary.BigEndian.PutUint16(hdr[2:4], uint16(len(key)))
+	hdr[4] = byte(len(extras))
+	binary.BigEndian.PutUint32(hdr[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(hdr[12:16], opaque)
+	binary.BigEndian.PutUint64(hdr[16:24], cas)
+	msg := append(append(append(hdr[:], extras...), key...), value...)
+	if _, err := c.conn.Write(msg); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testConn) recv() *response {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	var hdr [24]byte
+	if _, err := io.ReadFull(c.conn, hdr[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	if hdr[0] != respMagic {
+		c.t.Fatalf("bad magic %#x", hdr[0])
+	}
+	body := make([]byte, binary.BigEndian.Uint32(hdr[8:12]))
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		c.t.Fatal(err)
+	}
+	kl, el := int(binary.BigEndian.Uint16(hdr[2:4])), int(hdr[4])
+	return &response{
+		opcode: hdr[1],
+		status: binary.BigEndian.Uint16(hdr[6:8]),
+		opaque: binary.BigEndian.Uint32(hdr[12:16]),
+		cas:    binary.BigEndian.Uint64(hdr[16:24]),
+		extras: body[:el],
+		key:    body[el : el+kl],
+		value:  body[el+kl:],
+	}
+}
+
+func (c *testConn) do(opcode uint8, cas uint64, extras, key, value []byte) *response {
+	c.t.Helper()
+	c.send(opcode, 0, cas, extras, key, value)
+	return c.recv()
+}
+
+func (c *testConn) set(opcode uint8, cas uint64, key, value string, flags, exp uint32) *response {
+	c.t.Helper()
+	extras := make([]byte, 8)
+	binary.BigEndian.PutUint32(extras[0:4], flags)
+	binary.BigEndian.PutUint32(extras[4:8], exp)
+	return c.do(opcode, cas, extras, []byte(key), []byte(value))
+}
+
+func (c *testConn) get(key string) *response {
+	c.t.Helper()
+	return c.do(opGet, 0, nil, []byte(key), nil)
+}
+
+func (c *testConn) incrDecr(opcode uint8, key string, delta, initial uint64, exp uint32) *response {
+	c.t.Helper()
+	extras := make([]byte, 20)
+	binary.BigEndian.PutUint64(extras[0:8], delta)
+	binary.BigEndian.PutUint64(extras[8:16], initial)
+	binary.BigEndian.PutUint32(extras[16:20], exp)
+	return c.do(opcode, 0, extras, []byte(key), nil)
+}
+
+func uint32Extras(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func checkStatus(t *testing.T, what string, r *response, want uint16) {
+	t.Helper()
+	if r.status != want {
+		t.Fatalf("%s: status = %#x (%q), want %#x", what, r.status, r.value, want)
+	}
+}
+
+func newTestServer(t *testing.T) *Server {
+	s := NewServer()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestStorage(t *testing.T) {
+	c := dial(t, newTestServer(t))
+
+	r := c.set(opSet, 0, "foo", "bar", 42, 0)
+	checkStatus(t, "set", r, StatusOK)
+	cas := r.cas
+	r = c.get("foo")
+	checkStatus(t, "get", r, StatusOK)
+	if string(r.value) != "bar" || binary.BigEndian.Uint32(r.extras) != 42 || r.cas != cas {
+		t.Errorf("get = %q flags %x cas %d, want bar, 42, %d", r.value, r.extras, r.cas, cas)
+	}
+	checkStatus(t, "get miss", c.get("missing"), StatusKeyNotFound)
+
+	checkStatus(t, "add existing", c.set(opAdd, 0, "foo", "baz", 0, 0), StatusKeyExists)
+	checkStatus(t, "add", c.set(opAdd, 0, "new", "v", 0, 0), StatusOK)
+	checkStatus(t, "replace missing", c.set(opReplace, 0, "missing", "v", 0, 0), StatusKeyNotFound)
+	checkStatus(t, "replace", c.set(opReplace, 0, "new", "w", 0, 0), StatusOK)
+
+	checkStatus(t, "cas conflict", c.set(opSet, cas+100, "foo", "x", 0, 0), StatusKeyExists)
+	checkStatus(t, "cas missing", c.set(opSet, cas, "missing", "x", 0, 0), StatusKeyNotFound)
+	checkStatus(t, "cas", c.set(opSet, cas, "foo", "bar", 0, 0), StatusOK)
+
+	checkStatus(t, "append", c.do(opAppend, 0, nil, []byte("foo"), []byte(">")), StatusOK)
+	checkStatus(t, "prepend", c.do(opPrepend, 0, nil, []byte("foo"), []byte("<")), StatusOK)
+	checkStatus(t, "append missing", c.do(opAppend, 0, nil, []byte("missing"), []byte(">")), StatusItemNotStored)
+	if r := c.get("foo"); string(r.value) != "<bar>" {
+		t.Errorf("get after append/prepend = %q, want <bar>", r.value)
+	}
+
+	checkStatus(t, "delete", c.do(opDelete, 0, nil, []byte("foo"), nil), StatusOK)
+	checkStatus(t, "delete missing", c.do(opDelete, 0, nil, []byte("foo"), nil), StatusKeyNotFound)
+
+	s := NewUnstartedServer()
+	s.MaxItemSize = 4
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c = dial(t, s)
+	checkStatus(t, "set too large", c.set(opSet, 0, "big", "12345", 0, 0), StatusValueTooLarge)
+}
+
+func TestIncrDecr(t *testing.T) {
+	c := dial(t, newTestServer(t))
+
+	r := c.incrDecr(opIncrement, "n", 5, 10, 0xffffffff)
+	checkStatus(t, "incr missing without default", r, StatusKeyNotFound)
+	r = c.incrDecr(opIncrement, "n", 5, 10, 0)
+	checkStatus(t, "incr with default", r, StatusOK)
+	if v := binary.BigEndian.Uint64(r.value); v != 10 {
+		t.Errorf("incr with default = %d, want 10", v)
+	}
+	r = c.incrDecr(opIncrement, "n", 5, 0, 0)
+	if v := binary.BigEndian.Uint64(r.value); v != 15 {
+		t.Errorf("incr = %d, want 15", v)
+	}
+	r = c.incrDecr(opDecrement, "n", 20, 0, 0)
+	if v := binary.BigEndian.Uint64(r.value); v != 0 {
+		t.Errorf("decr below zero = %d, want 0", v)
+	}
+	if r := c.get("n"); string(r.value) != "0" {
+		t.Errorf("get after decr = %q, want 0", r.value)
+	}
+	c.set(opSet, 0, "s", "abc", 0, 0)
+	checkStatus(t, "incr non numeric", c.incrDecr(opIncrement, "s", 1, 0, 0), StatusNonNumeric)
+}
+
+func TestExpiration(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Unix(1700000000, 0)
+	advance := func(d time.Duration) {
+		mu.Lock()
+		now = now.Add(d)
+		mu.Unlock()
+	}
+	s := NewUnstartedServer()
+	s.Clock = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := dial(t, s)
+
+	c.set(opSet, 0, "relative", "v", 0, 10)
+	c.set(opSet, 0, "absolute", "v", 0, uint32(now.Unix()+20))
+	c.set(opSet, 0, "touched", "v", 0, 10)
+	c.set(opSet, 0, "forever", "v", 0, 0)
+	checkStatus(t, "touch", c.do(opTouch, 0, uint32Extras(30), []byte("touched"), nil), StatusOK)
+	checkStatus(t, "touch missing", c.do(opTouch, 0, uint32Extras(30), []byte("missing"), nil), StatusKeyNotFound)
+
+	advance(10 * time.Second)
+	checkStatus(t, "get expired", c.get("relative"), StatusKeyNotFound)
+	checkStatus(t, "get absolute", c.get("absolute"), StatusOK)
+	checkStatus(t, "get touched", c.get("touched"), StatusOK)
+
+	advance(10 * time.Second)
+	checkStatus(t, "get absolute expired", c.get("absolute"), StatusKeyNotFound)
+	r := c.do(opGAT, 0, uint32Extras(5), []byte("touched"), nil)
+	checkStatus(t, "gat", r, StatusOK)
+	if string(r.value) != "v" {
+		t.Errorf("gat = %q, want v", r.value)
+	}
+
+	advance(5 * time.Second)
+	checkStatus(t, "get after gat", c.get("touched"), StatusKeyNotFound)
+	checkStatus(t, "get without expiration", c.get("forever"), StatusOK)
+
+	checkStatus(t, "flush with delay", c.do(opFlush, 0, uint32Extras(60), nil, nil), StatusOK)
+	checkStatus(t, "get before delayed flush", c.get("forever"), StatusOK)
+	advance(time.Minute)
+	checkStatus(t, "get after delayed flush", c.get("forever"), StatusKeyNotFound)
+	if n := s.Len(); n != 0 {
+		t.Errorf("Len = %d, want 0", n)
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	c := dial(t, newTestServer(t))
+
+	extras := make([]byte, 8)
+	c.send(opSetQ, 1, 0, extras, []byte("a"), []byte("1"))
+	c.send(opSetQ, 2, 0, extras, []byte("b"), []byte("2"))
+	c.send(opAddQ, 3, 0, extras, []byte("a"), []byte("x"))
+	c.send(opGetKQ, 4, 0, nil, []byte("missing"), nil)
+	c.send(opGetKQ, 5, 0, nil, []byte("b"), nil)
+	c.send(opDeleteQ, 6, 0, nil, []byte("a"), nil)
+	c.send(opNoop, 7, 0, nil, nil, nil)
+
+	r := c.recv()
+	if r.opaque != 3 || r.status != StatusKeyExists {
+		t.Errorf("first response = opaque %d status %#x, want the failed addq", r.opaque, r.status)
+	}
+	r = c.recv()
+	if r.opaque != 5 || string(r.key) != "b" || string(r.value) != "2" {
+		t.Errorf("second response = opaque %d %q=%q, want getkq b=2", r.opaque, r.key, r.value)
+	}
+	if r = c.recv(); r.opaque != 7 || r.opcode != opNoop {
+		t.Errorf("last response = opaque %d opcode %#x, want the noop", r.opaque, r.opcode)
+	}
+	checkStatus(t, "get after deleteq", c.get("a"), StatusKeyNotFound)
+}
+
+func TestStat(t *testing.T) {
+	c := dial(t, newTestServer(t))
+	c.set(opSet, 0, "foo", "bar", 0, 0)
+	c.get("foo")
+	c.get("missing")
+
+	stats := make(map[string]string)
+	c.send(opStat, 0, 0, nil, nil, nil)
+	for {
+		r := c.recv()
+		checkStatus(t, "stat", r, StatusOK)
+		if len(r.key) == 0 {
+			break
+		}
+		stats[string(r.key)] = string(r.value)
+	}
+	for key, want := range map[string]string{
+		"version":    Version,
+		"cmd_get":    "2",
+		"get_hits":   "1",
+		"get_misses": "1",
+		"curr_items": "1",
+	} {
+		if stats[key] != want {
+			t.Errorf("stat %s = %q, want %q", key, stats[key], want)
+		}
+	}
+}
+
+func TestSASL(t *testing.T) {
+	s := NewUnstartedServer()
+	s.User, s.Password = "user", "secret"
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := dial(t, s)
+
+	checkStatus(t, "get before auth", c.get("foo"), StatusAuthError)
+	r := c.do(opSASLList, 0, nil, nil, nil)
+	if !bytes.Equal(r.value, []byte("PLAIN")) {
+		t.Errorf("mechanisms = %q, want PLAIN", r.value)
+	}
+	checkStatus(t, "bad password", c.do(opSASLAuth, 0, nil, []byte("PLAIN"), []byte("\x00user\x00wrong")), StatusAuthError)
+	checkStatus(t, "auth", c.do(opSASLAuth, 0, nil, []byte("PLAIN"), []byte("\x00user\x00secret")), StatusOK)
+	checkStatus(t, "get after auth", c.get("foo"), StatusKeyNotFound)
+}
+
+func TestUnixSocket(t *testing.T) {
+	s := NewUnstartedServer()
+	if err := s.StartUnix(filepath.Join(t.TempDir(), "memcached.sock")); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := dial(t, s)
+	checkStatus(t, "set", c.set(opSet, 0, "foo", "bar", 0, 0), StatusOK)
+	r := c.do(opVersion, 0, nil, nil, nil)
+	if string(r.value) != Version {
+		t.Errorf("version = %q, want %q", r.value, Version)
+	}
+}
+
+func TestCloseClientConnections(t *testing.T) {
+	s := newTestServer(t)
+	c := dial(t, s)
+	c.set(opSet, 0, "foo", "bar", 0, 0)
+	s.CloseClientConnections()
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection still open after CloseClientConnections")
+	}
+	c = dial(t, s)
+	checkStatus(t, "get after reconnect", c.get("foo"), StatusOK)
+}
+
+func TestServeAfterClose(t *testing.T) {
+	s := NewUnstartedServer()
+	s.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(l); err != net.ErrClosed {
+		t.Errorf("Serve after Close = %v, want net.ErrClosed", err)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("listener still open after Serve on a closed server")
+	}
+}
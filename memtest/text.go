@@ -0,0 +1,384 @@
+package memtest
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// reply is a binary protocol response captured while running a text
+// protocol command.
+type reply struct {
+	status uint16
+	cas    uint64
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+// textErrors are the text protocol answers to the statuses which have no
+// command specific meaning.
+var textErrors = map[uint16]string{
+	StatusInvalidArgs:    "CLIENT_ERROR bad command line format",
+	StatusValueTooLarge:  "SERVER_ERROR object too large for cache",
+	StatusNonNumeric:     "CLIENT_ERROR cannot increment or decrement non-numeric value",
+	StatusAuthError:      "CLIENT_ERROR unauthenticated",
+	StatusUnknownCommand: "ERROR",
+}
+
+func textError(status uint16) string {
+	if s, ok := textErrors[status]; ok {
+		return s
+	}
+	return "SERVER_ERROR " + statusText[status]
+}
+
+// call runs req through the binary protocol handlers, faults included,
+// and returns its responses. ok is false if the connection must be
+// closed.
+func (c *serverConn) call(req *request) (replies []reply, ok bool) {
+	c.text = true
+	c.replies = nil
+	ok = c.exec(req)
+	c.text = false
+	replies, c.replies = c.replies, nil
+	return replies, ok && len(replies) > 0
+}
+
+// serveText handles a text protocol command. It returns false if the
+// connection must be closed.
+func (c *serverConn) serveText() bool {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		c.w.WriteString("ERROR\r\n")
+		return true
+	}
+	noreply := len(fields) > 1 && fields[len(fields)-1] == "noreply"
+	if noreply {
+		fields = fields[:len(fields)-1]
+	}
+	if !c.authed {
+		return c.textAuth(fields)
+	}
+	switch fields[0] {
+	case "get", "gets":
+		return c.textGet(fields[1:], fields[0] == "gets", nil)
+	case "gat", "gats":
+		if len(fields) < 3 {
+			break
+		}
+		exp, ok := parseExpiration(fields[1])
+		if !ok {
+			break
+		}
+		return c.textGet(fields[2:], fields[0] == "gats", exp)
+	case "set", "add", "replace", "append", "prepend", "cas":
+		out, ok := c.textStore(fields)
+		if !ok {
+			return false
+		}
+		c.writeText(out, noreply)
+		return true
+	case "delete":
+		if len(fields) != 2 {
+			break
+		}
+		out, ok := c.textSimple(&request{opcode: opDelete, key: []byte(fields[1])}, "DELETED")
+		if !ok {
+			return false
+		}
+		c.writeText(out, noreply)
+		return true
+	case "incr", "decr":
+		if len(fields) != 3 {
+			break
+		}
+		out, ok := c.textIncrDecr(fields)
+		if !ok {
+			return false
+		}
+		c.writeText(out, noreply)
+		return true
+	case "touch":
+		if len(fields) != 3 {
+			break
+		}
+		exp, ok := parseExpiration(fields[2])
+		if !ok {
+			break
+		}
+		out, ok := c.textSimple(&request{opcode: opTouch, key: []byte(fields[1]), extras: exp}, "TOUCHED")
+		if !ok {
+			return false
+		}
+		c.writeText(out, noreply)
+		return true
+	case "flush_all":
+		req := &request{opcode: opFlush}
+		if len(fields) == 2 {
+			var ok bool
+			if req.extras, ok = parseExpiration(fields[1]); !ok {
+				break
+			}
+		} else if len(fields) > 2 {
+			break
+		}
+		out, ok := c.textSimple(req, "OK")
+		if !ok {
+			return false
+		}
+		c.writeText(out, noreply)
+		return true
+	case "stats":
+		return c.textStats()
+	case "version":
+		replies, ok := c.call(&request{opcode: opVersion})
+		if !ok {
+			return false
+		}
+		if replies[0].status != StatusOK {
+			c.writeText(textError(replies[0].status), false)
+		} else {
+			c.writeText("VERSION "+string(replies[0].value), false)
+		}
+		return true
+	case "mg", "ms", "md", "ma", "mn":
+		return c.serveMeta(fields)
+	case "quit":
+		return false
+	default:
+		c.writeText("ERROR", false)
+		return true
+	}
+	// The command's arguments are invalid.
+	c.writeText(textError(StatusInvalidArgs), false)
+	return true
+}
+
+func (c *serverConn) writeText(line string, noreply bool) {
+	if !noreply {
+		c.w.WriteString(line)
+		c.w.WriteString("\r\n")
+	}
+}
+
+// textAuth handles a command of an unauthenticated connection, which
+// must be a set whose data is the user and password.
+func (c *serverConn) textAuth(fields []string) bool {
+	if fields[0] != "set" {
+		c.writeText(textError(StatusAuthError), false)
+		return true
+	}
+	data, ok := c.readData(fields)
+	if !ok {
+		return false
+	}
+	if string(data) != c.server.User+" "+c.server.Password {
+		c.writeText("CLIENT_ERROR authentication failure", false)
+		return true
+	}
+	c.authed = true
+	c.writeText("STORED", false)
+	return true
+}
+
+// readData reads the data block of a storage command, whose length is
+// in fields[4]. It returns false, after answering, if the connection
+// must be closed.
+func (c *serverConn) readData(fields []string) ([]byte, bool) {
+	if len(fields) < 5 {
+		c.writeText(textError(StatusInvalidArgs), false)
+		return nil, false
+	}
+	return c.readBlock(fields[4])
+}
+
+// readBlock reads a data block of size bytes, followed by CRLF. It
+// returns false, after answering, if the connection must be closed.
+func (c *serverConn) readBlock(size string) ([]byte, bool) {
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 0 {
+		c.writeText(textError(StatusInvalidArgs), false)
+		return nil, false
+	}
+	data := make([]byte, n+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, false
+	}
+	if string(data[n:]) != "\r\n" {
+		c.writeText("CLIENT_ERROR bad data chunk", false)
+		return nil, false
+	}
+	return data[:n], true
+}
+
+// parseExpiration returns the expiration extras for a text protocol
+// expiration, which may be negative.
+func parseExpiration(s string) ([]byte, bool) {
+	exp, err := strconv.ParseInt(s, 10, 32)
+	if err != nil {
+		return nil, false
+	}
+	extras := make([]byte, 4)
+	binary.BigEndian.PutUint32(extras, uint32(exp))
+	return extras, true
+}
+
+// textGet answers get, gets and, if exp is set, gat and gats.
+func (c *serverConn) textGet(keys []string, withCAS bool, exp []byte) bool {
+	if len(keys) == 0 {
+		c.writeText("ERROR", false)
+		return true
+	}
+	for _, key := range keys {
+		req := &request{opcode: opGet, key: []byte(key)}
+		if exp != nil {
+			req.opcode, req.extras = opGAT, exp
+		}
+		replies, ok := c.call(req)
+		if !ok {
+			return false
+		}
+		r := replies[0]
+		switch r.status {
+		case StatusOK:
+			c.w.WriteString("VALUE " + key + " " + strconv.FormatUint(uint64(binary.BigEndian.Uint32(r.extras)), 10) + " " + strconv.Itoa(len(r.value)))
+			if withCAS {
+				c.w.WriteString(" " + strconv.FormatUint(r.cas, 10))
+			}
+			c.w.WriteString("\r\n")
+			c.w.Write(r.value)
+			c.w.WriteString("\r\n")
+		case StatusKeyNotFound:
+		default:
+			c.writeText(textError(r.status), false)
+			return true
+		}
+	}
+	c.writeText("END", false)
+	return true
+}
+
+// textStore answers the storage commands.
+func (c *serverConn) textStore(fields []string) (string, bool) {
+	data, ok := c.readData(fields)
+	if !ok {
+		return "", false
+	}
+	cas := fields[0] == "cas"
+	if cas && len(fields) != 6 || !cas && len(fields) != 5 {
+		return textError(StatusInvalidArgs), true
+	}
+	flags, err := strconv.ParseUint(fields[2], 10, 32)
+	if err != nil {
+		return textError(StatusInvalidArgs), true
+	}
+	exp, ok := parseExpiration(fields[3])
+	if !ok {
+		return textError(StatusInvalidArgs), true
+	}
+	req := &request{key: []byte(fields[1]), value: data}
+	switch fields[0] {
+	case "set", "cas":
+		req.opcode = opSet
+	case "add":
+		req.opcode = opAdd
+	case "replace":
+		req.opcode = opReplace
+	case "append":
+		req.opcode = opAppend
+	case "prepend":
+		req.opcode = opPrepend
+	}
+	if req.opcode != opAppend && req.opcode != opPrepend {
+		req.extras = make([]byte, 8)
+		binary.BigEndian.PutUint32(req.extras, uint32(flags))
+		copy(req.extras[4:], exp)
+	}
+	if cas {
+		if req.cas, err = strconv.ParseUint(fields[5], 10, 64); err != nil {
+			return textError(StatusInvalidArgs), true
+		}
+	}
+	replies, ok := c.call(req)
+	if !ok {
+		return "", false
+	}
+	switch status := replies[0].status; {
+	case status == StatusOK:
+		return "STORED", true
+	case status == StatusKeyExists && cas:
+		return "EXISTS", true
+	case status == StatusKeyNotFound && cas:
+		return "NOT_FOUND", true
+	case status == StatusKeyExists, status == StatusKeyNotFound, status == StatusItemNotStored:
+		return "NOT_STORED", true
+	default:
+		return textError(status), true
+	}
+}
+
+// textSimple answers a command replying with done on success and
+// NOT_FOUND for a missing key.
+func (c *serverConn) textSimple(req *request, done string) (string, bool) {
+	replies, ok := c.call(req)
+	if !ok {
+		return "", false
+	}
+	switch status := replies[0].status; status {
+	case StatusOK:
+		return done, true
+	case StatusKeyNotFound:
+		return "NOT_FOUND", true
+	default:
+		return textError(status), true
+	}
+}
+
+func (c *serverConn) textIncrDecr(fields []string) (string, bool) {
+	delta, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return "CLIENT_ERROR invalid numeric delta argument", true
+	}
+	req := &request{opcode: opIncrement, key: []byte(fields[1]), extras: make([]byte, 20)}
+	if fields[0] == "decr" {
+		req.opcode = opDecrement
+	}
+	binary.BigEndian.PutUint64(req.extras, delta)
+	binary.BigEndian.PutUint32(req.extras[16:], 0xffffffff)
+	replies, ok := c.call(req)
+	if !ok {
+		return "", false
+	}
+	switch r := replies[0]; r.status {
+	case StatusOK:
+		return strconv.FormatUint(binary.BigEndian.Uint64(r.value), 10), true
+	case StatusKeyNotFound:
+		return "NOT_FOUND", true
+	default:
+		return textError(r.status), true
+	}
+}
+
+func (c *serverConn) textStats() bool {
+	replies, ok := c.call(&request{opcode: opStat})
+	if !ok {
+		return false
+	}
+	for _, r := range replies {
+		if r.status != StatusOK {
+			c.writeText(textError(r.status), false)
+			return true
+		}
+		if len(r.key) > 0 {
+			c.writeText("STAT "+string(r.key)+" "+string(r.value), false)
+		}
+	}
+	c.writeText("END", false)
+	return true
+}
@@ -0,0 +1,114 @@
+package memtest
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+// textSession sends text protocol commands to s, checking their answers.
+type textSession struct {
+	t *testing.T
+	c *testConn
+	r *bufio.Reader
+}
+
+func dialText(t *testing.T, s *Server) *textSession {
+	c := dial(t, s)
+	return &textSession{t: t, c: c, r: bufio.NewReader(c.conn)}
+}
+
+// do sends cmd and checks that the answer is the lines of want.
+func (s *textSession) do(cmd string, want ...string) {
+	s.t.Helper()
+	if _, err := s.c.conn.Write([]byte(cmd)); err != nil {
+		s.t.Fatal(err)
+	}
+	for _, w := range want {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			s.t.Fatalf("%q: %v", cmd, err)
+		}
+		if line != w+"\r\n" {
+			s.t.Fatalf("%q answered %q, want %q", cmd, line, w)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	s := newTestServer(t)
+	c := dialText(t, s)
+
+	c.do("set foo 42 0 3\r\nbar\r\n", "STORED")
+	c.do("get foo missing\r\n", "VALUE foo 42 3", "bar", "END")
+	c.do("add foo 0 0 1\r\nx\r\n", "NOT_STORED")
+	c.do("replace missing 0 0 1\r\nx\r\n", "NOT_STORED")
+	c.do("append foo 0 0 3\r\nbaz\r\n", "STORED")
+	c.do("gets foo\r\n", "VALUE foo 42 6 2", "barbaz", "END")
+	c.do("cas foo 0 0 1 1\r\nx\r\n", "EXISTS")
+	c.do("cas foo 0 0 1 2\r\nx\r\n", "STORED")
+	c.do("cas missing 0 0 1 2\r\nx\r\n", "NOT_FOUND")
+	c.do("set quiet 0 0 1 noreply\r\nq\r\n")
+	c.do("gat 100 quiet\r\n", "VALUE quiet 0 1", "q", "END")
+	c.do("touch quiet 100\r\n", "TOUCHED")
+	c.do("touch missing 100\r\n", "NOT_FOUND")
+
+	c.do("set n 0 0 2\r\n10\r\n", "STORED")
+	c.do("incr n 5\r\n", "15")
+	c.do("decr n 20\r\n", "0")
+	c.do("incr missing 1\r\n", "NOT_FOUND")
+	c.do("incr foo 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+
+	c.do("delete foo\r\n", "DELETED")
+	c.do("delete foo\r\n", "NOT_FOUND")
+	c.do("get "+strings.Repeat("k", 251)+"\r\n", "CLIENT_ERROR bad command line format")
+	c.do("version\r\n", "VERSION "+Version)
+	c.do("bogus\r\n", "ERROR")
+	c.do("flush_all\r\n", "OK")
+	c.do("get n\r\n", "END")
+
+	if _, err := c.c.conn.Write([]byte("stats\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	stats := make(map[string]string)
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "END\r\n" {
+			break
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "STAT" {
+			t.Fatalf("stats answered %q", line)
+		}
+		stats[fields[1]] = fields[2]
+	}
+	if stats["version"] != Version || stats["cmd_touch"] != "3" {
+		t.Errorf("stats = %v, want version %s and cmd_touch 3", stats, Version)
+	}
+}
+
+func TestTextAuth(t *testing.T) {
+	s := NewUnstartedServer()
+	s.User, s.Password = "user", "secret"
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := dialText(t, s)
+
+	c.do("get foo\r\n", "CLIENT_ERROR unauthenticated")
+	c.do("set auth 0 0 10\r\nuser wrong\r\n", "CLIENT_ERROR authentication failure")
+	c.do("set auth 0 0 11\r\nuser secret\r\n", "STORED")
+	c.do("get foo\r\n", "END")
+}
+
+func TestTextFault(t *testing.T) {
+	s := newTestServer(t)
+	c := dialText(t, s)
+	s.InjectFault(Fault{Command: "set", Times: 1, Status: StatusBusy})
+	c.do("set foo 0 0 1\r\nx\r\n", "SERVER_ERROR Busy")
+	c.do("set foo 0 0 1\r\nx\r\n", "STORED")
+}
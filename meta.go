@@ -0,0 +1,720 @@
+package memcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// ErrMetaUnsupported is returned by the Meta methods of a Client, and by
+// GetOrRefresh, SetRefreshed and Invalidate, for keys stored on a server
+// configured with ProtocolBinary. memcached fixes the protocol of a
+// connection with its first command, and a binary connection can't carry
+// meta commands, which text and meta connections can.
+var ErrMetaUnsupported = errors.New("memcache: meta commands need a server using ProtocolMeta or ProtocolText")
+
+// metaCodec speaks the meta protocol. Unlike the text protocol it gets
+// the CAS ID of stored items, and pipelines retrievals with opaque
+// tokens. Flush, stats and authentication, which have no meta command,
+// are the text protocol's.
+type metaCodec struct {
+	textCodec
+}
+
+// metaReply is the response to a meta command.
+type metaReply struct {
+	// code is the two letter status: VA, HD, EN, NF, NS, EX or MN.
+	code  string
+	flags []string
+	value []byte
+}
+
+// flag returns the token of the return flag f, and whether it's set.
+func (r *metaReply) flag(f byte) (string, bool) {
+	for _, t := range r.flags {
+		if t[0] == f {
+			return t[1:], true
+		}
+	}
+	return "", false
+}
+
+// uintFlag returns the value of the numeric return flag f, zero if it's
+// not set.
+func (r *metaReply) uintFlag(f byte, bitSize int) (uint64, error) {
+	t, ok := r.flag(f)
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(t, 10, bitSize)
+	if err != nil {
+		return 0, protocolError("malformed %c flag %q in %s reply", f, t, r.code)
+	}
+	return n, nil
+}
+
+// unexpected returns the error for a reply whose code makes no sense for
+// the command.
+func (r *metaReply) unexpected(cmd string) error {
+	return protocolError("unexpected %s reply to %s", r.code, cmd)
+}
+
+// readMeta reads the response to a meta command, with its value if any.
+func readMeta(cn *poolConn) (*metaReply, error) {
+	r := cn.reader()
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	fields := bytes.Fields(line)
+	if len(fields) == 0 || len(fields[0]) != 2 {
+		return nil, textError(line)
+	}
+	reply := &metaReply{code: string(fields[0])}
+	switch reply.code {
+	case "VA":
+		if len(fields) < 2 {
+			return nil, protocolError("malformed value reply %q", line)
+		}
+		size, err := strconv.Atoi(string(fields[1]))
+		if err != nil || size < 0 {
+			return nil, protocolError("malformed value reply %q", line)
+		}
+		if size > cn.maxBody {
+			return nil, protocolError("value of %d bytes exceeds the limit of %d", size, cn.maxBody)
+		}
+		for _, f := range fields[2:] {
+			reply.flags = append(reply.flags, string(f))
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(value, crlf) {
+			return nil, protocolError("value not terminated by CRLF")
+		}
+		reply.value = value[:size]
+	case "HD", "EN", "NF", "NS", "EX", "MN":
+		for _, f := range fields[1:] {
+			reply.flags = append(reply.flags, string(f))
+		}
+	default:
+		return nil, textError(line)
+	}
+	return reply, nil
+}
+
+// writeMeta buffers the meta command cmd on key, followed by args.
+func writeMeta(buf *bytes.Buffer, cmd, key string, args ...string) {
+	buf.WriteString(cmd)
+	if key != "" {
+		buf.WriteString(" " + key)
+	}
+	for _, a := range args {
+		buf.WriteString(" " + a)
+	}
+	buf.WriteString("\r\n")
+}
+
+// metaCall sends the meta command cmd on key and reads its reply.
+func metaCall(cn *poolConn, req *request, cmd, key string, args ...string) (*metaReply, error) {
+	if !legalKey(key) {
+		return nil, ErrMalformedKey
+	}
+	var buf bytes.Buffer
+	writeMeta(&buf, cmd, key, args...)
+	if err := writeText(cn, req, &buf); err != nil {
+		return nil, err
+	}
+	return readMeta(cn)
+}
+
+// item returns the item in a reply to mg, requested with the f and c
+// flags.
+func (r *metaReply) item(key string) (*Item, error) {
+	flags, err := r.uintFlag('f', 32)
+	if err != nil {
+		return nil, err
+	}
+	casid, err := r.uintFlag('c', 64)
+	if err != nil {
+		return nil, err
+	}
+	return &Item{Key: key, Value: r.value, Flags: uint32(flags), casid: casid}, nil
+}
+
+func (metaCodec) get(cn *poolConn, req *request, key string) (*Item, error) {
+	return metaRetrieve(cn, req, key, "v", "f", "c")
+}
+
+func (metaCodec) getAndTouch(cn *poolConn, req *request, key string, expiration int32) (*Item, error) {
+	return metaRetrieve(cn, req, key, "v", "f", "c", "T"+expirationText(uint32(expiration)))
+}
+
+func metaRetrieve(cn *poolConn, req *request, key string, args ...string) (*Item, error) {
+	reply, err := metaCall(cn, req, "mg", key, args...)
+	if err != nil {
+		return nil, err
+	}
+	switch reply.code {
+	case "VA":
+		return reply.item(key)
+	case "EN":
+		return nil, ErrCacheMiss
+	}
+	return nil, reply.unexpected("mg")
+}
+
+// getMulti pipelines a quiet mg for each key, whose opaque token is the
+// key's index, terminated by a meta noop. Misses aren't answered.
+// Illegal keys are skipped, as misses.
+func (metaCodec) getMulti(cn *poolConn, req *request, keys []string, found func(*Item)) error {
+	var buf bytes.Buffer
+	for ii, key := range keys {
+		if legalKey(key) {
+			writeMeta(&buf, "mg", key, "v", "f", "c", "q", "O"+strconv.Itoa(ii))
+		}
+	}
+	writeMeta(&buf, "mn", "")
+	if err := writeText(cn, req, &buf); err != nil {
+		return err
+	}
+	for {
+		reply, err := readMeta(cn)
+		if err != nil {
+			return err
+		}
+		switch reply.code {
+		case "MN":
+			return nil
+		case "VA":
+		default:
+			return reply.unexpected("mg")
+		}
+		o, _ := reply.flag('O')
+		ii, err := strconv.Atoi(o)
+		if err != nil || ii < 0 || ii >= len(keys) {
+			return protocolError("mg reply with unknown opaque %q", o)
+		}
+		it, err := reply.item(keys[ii])
+		if err != nil {
+			return err
+		}
+		found(it)
+	}
+}
+
+// metaStore stores item with ms and the given flags, updating its CAS
+// ID.
+func metaStore(cn *poolConn, req *request, item *Item, args ...string) error {
+	if !legalKey(item.Key) {
+		return ErrMalformedKey
+	}
+	var buf bytes.Buffer
+	writeMetaStore(&buf, item, args...)
+	if err := writeText(cn, req, &buf); err != nil {
+		return err
+	}
+	return readMetaStore(cn, item)
+}
+
+// writeMetaStore buffers the ms of item, with the given flags.
+func writeMetaStore(buf *bytes.Buffer, item *Item, args ...string) {
+	args = append([]string{
+		strconv.Itoa(len(item.Value)),
+		"T" + expirationText(uint32(item.Expiration)),
+		"F" + strconv.FormatUint(uint64(item.Flags), 10),
+		"c",
+	}, args...)
+	writeMeta(buf, "ms", item.Key, args...)
+	buf.Write(item.Value)
+	buf.Write(crlf)
+}
+
+// readMetaStore reads the answer to the ms of item, updating its CAS ID.
+func readMetaStore(cn *poolConn, item *Item) error {
+	reply, err := readMeta(cn)
+	if err != nil {
+		return err
+	}
+	switch reply.code {
+	case "HD":
+		casid, err := reply.uintFlag('c', 64)
+		if err != nil {
+			return err
+		}
+		item.casid = casid
+		return nil
+	case "NS", "NF":
+		return ErrNotStored
+	case "EX":
+		return ErrCASConflict
+	}
+	return reply.unexpected("ms")
+}
+
+func (metaCodec) store(cn *poolConn, req *request, cmd command, item *Item, casid uint64) error {
+	var args []string
+	if casid != 0 {
+		args = append(args, "C"+strconv.FormatUint(casid, 10))
+	}
+	if cmd == cmdAdd {
+		args = append(args, "M"+string(MetaModeAdd))
+	}
+	return metaStore(cn, req, item, args...)
+}
+
+// setQ pipelines an ms for each item. They aren't quiet, so that the
+// errors answered without an opaque token are matched to their item by
+// their position.
+func (metaCodec) setQ(cn *poolConn, req *request, items []*Item) ([]error, error) {
+	return textPipeline(cn, req, items, func(buf *bytes.Buffer, item *Item) {
+		writeMetaStore(buf, item)
+	}, func(item *Item) error {
+		return readMetaStore(cn, item)
+	})
+}
+
+// metaDelete deletes key with md and the given flags.
+func metaDelete(cn *poolConn, req *request, key string, args ...string) error {
+	reply, err := metaCall(cn, req, "md", key, args...)
+	if err != nil {
+		return err
+	}
+	switch reply.code {
+	case "HD":
+		return nil
+	case "NF":
+		return ErrCacheMiss
+	case "EX":
+		return ErrCASConflict
+	}
+	return reply.unexpected("md")
+}
+
+func (metaCodec) delete(cn *poolConn, req *request, key string, casid uint64) error {
+	if casid != 0 {
+		return metaDelete(cn, req, key, "C"+strconv.FormatUint(casid, 10))
+	}
+	return metaDelete(cn, req, key)
+}
+
+func (metaCodec) touch(cn *poolConn, req *request, key string, expiration int32) error {
+	reply, err := metaCall(cn, req, "mg", key, "T"+expirationText(uint32(expiration)))
+	if err != nil {
+		return err
+	}
+	switch reply.code {
+	case "HD":
+		return nil
+	case "EN":
+		return ErrCacheMiss
+	}
+	return reply.unexpected("mg")
+}
+
+// metaArithmeticArgs returns the ma flags of an incr or decr by delta,
+// creating missing keys unless expiration is noAutoCreate.
+func metaArithmeticArgs(decr bool, delta, initial uint64, expiration uint32) []string {
+	args := []string{"D" + strconv.FormatUint(delta, 10)}
+	if decr {
+		args = append(args, "MD")
+	}
+	if expiration != noAutoCreate {
+		args = append(args, "N"+expirationText(expiration), "J"+strconv.FormatUint(initial, 10))
+	}
+	return args
+}
+
+// metaArithmetic runs ma on key with the given flags and returns the new
+// value.
+func metaArithmetic(cn *poolConn, req *request, key string, args ...string) (uint64, error) {
+	reply, err := metaCall(cn, req, "ma", key, append(args, "v")...)
+	if err != nil {
+		return 0, err
+	}
+	switch reply.code {
+	case "VA":
+		n, err := strconv.ParseUint(string(reply.value), 10, 64)
+		if err != nil {
+			return 0, protocolError("malformed ma value %q", reply.value)
+		}
+		return n, nil
+	case "NF":
+		return 0, ErrCacheMiss
+	case "NS":
+		return 0, ErrNotStored
+	case "EX":
+		return 0, ErrCASConflict
+	}
+	return 0, reply.unexpected("ma")
+}
+
+func (metaCodec) incrDecr(cn *poolConn, req *request, cmd command, key string, delta, initial uint64, expiration uint32) (uint64, error) {
+	return metaArithmetic(cn, req, key, metaArithmeticArgs(cmd == cmdDecr, delta, initial, expiration)...)
+}
+
+// incrDecrQ pipelines an ma for each key. They aren't quiet, so that
+// the errors answered without an opaque token, such as those for non
+// numeric values, are matched to their key by their position.
+func (metaCodec) incrDecrQ(cn *poolConn, req *request, cmd command, keys []string, delta, initial uint64, expiration uint32) ([]error, error) {
+	var errs []error
+	setErr := func(ii int, err error) {
+		if errs == nil {
+			errs = make([]error, len(keys))
+		}
+		errs[ii] = err
+	}
+	args := metaArithmeticArgs(cmd == cmdDecrementQ, delta, initial, expiration)
+	var buf bytes.Buffer
+	var sent []int
+	for ii, key := range keys {
+		if !legalKey(key) {
+			setErr(ii, ErrMalformedKey)
+			continue
+		}
+		writeMeta(&buf, "ma", key, args...)
+		sent = append(sent, ii)
+	}
+	if len(sent) == 0 {
+		return errs, nil
+	}
+	if err := writeText(cn, req, &buf); err != nil {
+		return nil, err
+	}
+	for _, ii := range sent {
+		reply, err := readMeta(cn)
+		if err == nil {
+			switch reply.code {
+			case "HD":
+			case "NF":
+				err = ErrCacheMiss
+			case "NS":
+				err = ErrNotStored
+			default:
+				err = reply.unexpected("ma")
+			}
+		}
+		if !resumableError(err) {
+			return nil, err
+		}
+		if err != nil {
+			setErr(ii, err)
+		}
+	}
+	return errs, nil
+}
+
+func (metaCodec) noop(cn *poolConn) error {
+	if _, err := cn.Write([]byte("mn\r\n")); err != nil {
+		return err
+	}
+	reply, err := readMeta(cn)
+	if err != nil {
+		return err
+	}
+	if reply.code != "MN" {
+		return reply.unexpected("mn")
+	}
+	return nil
+}
+
+// MetaGetOptions are the flags of a meta get.
+type MetaGetOptions struct {
+	// NoValue skips the item value, for requests only interested in its
+	// metadata.
+	NoValue bool
+
+	// TTL, LastAccess and HitBefore request the corresponding fields of
+	// MetaItem.
+	TTL        bool
+	LastAccess bool
+	HitBefore  bool
+
+	// Touch updates the expiration time of the item to Expiration.
+	Touch bool
+
+	// Vivify creates an empty item with Expiration on a miss, and lets
+	// the caller win the right to store its value, as reported by
+	// MetaItem.Won. Other clients get the empty item until then.
+	Vivify bool
+
+	// Expiration is the expiration time set by Touch and given to items
+	// created by Vivify, in the same format as Item.Expiration.
+	Expiration int32
+
+	// Recache, if positive, makes the caller win the right to refresh
+	// the item if its remaining TTL is lower, in seconds.
+	Recache int32
+}
+
+func (o MetaGetOptions) args() []string {
+	args := []string{"f", "c"}
+	if !o.NoValue {
+		args = append(args, "v")
+	}
+	if o.TTL {
+		args = append(args, "t")
+	}
+	if o.LastAccess {
+		args = append(args, "l")
+	}
+	if o.HitBefore {
+		args = append(args, "h")
+	}
+	if o.Touch {
+		args = append(args, "T"+expirationText(uint32(o.Expiration)))
+	}
+	if o.Vivify {
+		args = append(args, "N"+expirationText(uint32(o.Expiration)))
+	}
+	if o.Recache > 0 {
+		args = append(args, "R"+strconv.Itoa(int(o.Recache)))
+	}
+	return args
+}
+
+// MetaItem is an item got with a meta get, along with its metadata. It
+// can be given to CompareAndSwap.
+type MetaItem struct {
+	Item
+
+	// TTL is the remaining time to live of the item in seconds, or -1
+	// if it doesn't expire. It's only set if requested.
+	TTL int32
+
+	// LastAccess is the number of seconds since the item was last
+	// accessed. It's only set if requested.
+	LastAccess int32
+
+	// HitBefore reports whether the item was got before. It's only set
+	// if requested.
+	HitBefore bool
+
+	// Won reports whether the caller won the right to store a new value
+	// for the item, which is missing, stale or close to expiring.
+	Won bool
+
+	// Stale reports whether the item was invalidated. Its value is
+	// outdated.
+	Stale bool
+
+	// WinPending reports that another client won the right to store a
+	// new value for the item and hasn't done it yet.
+	WinPending bool
+}
+
+func metaGet(cn *poolConn, req *request, key string, opts MetaGetOptions) (*MetaItem, error) {
+	reply, err := metaCall(cn, req, "mg", key, opts.args()...)
+	if err != nil {
+		return nil, err
+	}
+	switch reply.code {
+	case "VA", "HD":
+	case "EN":
+		return nil, ErrCacheMiss
+	default:
+		return nil, reply.unexpected("mg")
+	}
+	it, err := reply.item(key)
+	if err != nil {
+		return nil, err
+	}
+	mi := &MetaItem{Item: *it}
+	if t, ok := reply.flag('t'); ok {
+		ttl, err := strconv.ParseInt(t, 10, 32)
+		if err != nil {
+			return nil, protocolError("malformed t flag %q in mg reply", t)
+		}
+		mi.TTL = int32(ttl)
+	}
+	la, err := reply.uintFlag('l', 31)
+	if err != nil {
+		return nil, err
+	}
+	mi.LastAccess = int32(la)
+	h, _ := reply.flag('h')
+	mi.HitBefore = h == "1"
+	_, mi.Won = reply.flag('W')
+	_, mi.Stale = reply.flag('X')
+	_, mi.WinPending = reply.flag('Z')
+	return mi, nil
+}
+
+// MetaMode is the mode of a meta set.
+type MetaMode byte
+
+const (
+	// MetaModeSet stores the item unconditionally, the default.
+	MetaModeSet MetaMode = 'S'
+	// MetaModeAdd stores the item only if its key is missing.
+	MetaModeAdd MetaMode = 'E'
+	// MetaModeReplace stores the item only if its key exists.
+	MetaModeReplace MetaMode = 'R'
+	// MetaModeAppend and MetaModePrepend add the value after or before
+	// the one of an existing item, keeping its flags and expiration.
+	MetaModeAppend  MetaMode = 'A'
+	MetaModePrepend MetaMode = 'P'
+)
+
+// MetaSetOptions are the flags of a meta set.
+type MetaSetOptions struct {
+	// Mode is the storage mode, MetaModeSet if zero.
+	Mode MetaMode
+
+	// CompareAndSwap only stores the item if it wasn't modified since it
+	// was got, as with Client.CompareAndSwap.
+	CompareAndSwap bool
+
+	// Invalidate, along with CompareAndSwap, stores an item whose CAS ID
+	// is older than the current one anyway, but marks it as stale.
+	Invalidate bool
+}
+
+// MetaDeleteOptions are the flags of a meta delete.
+type MetaDeleteOptions struct {
+	// Invalidate marks the item as stale instead of deleting it, so the
+	// next meta get with Vivify or Recache wins the right to refresh it
+	// while the others still get the stale value.
+	Invalidate bool
+
+	// Expiration, if not zero, is the new expiration time of the item
+	// marked as stale by Invalidate, in the same format as
+	// Item.Expiration.
+	Expiration int32
+}
+
+// MetaArithmeticOptions are the flags of a meta arithmetic command.
+type MetaArithmeticOptions struct {
+	// Decrement decrements the value instead of incrementing it.
+	Decrement bool
+
+	// Delta is the amount to add or subtract.
+	Delta uint64
+
+	// Create makes missing keys be created with Initial and Expiration,
+	// as IncrementWithDefault does. Expiration can't be negative.
+	Create     bool
+	Initial    uint64
+	Expiration int32
+}
+
+// metaRequest runs the meta command op on key, with run doing the
+// protocol work over a connection to its server and returning the hits
+// and bytes to report. Text connections take meta commands as well.
+func (c *Client) metaRequest(ctx context.Context, op, key string, run func(cn *poolConn, req *request) (hits, size int, err error)) (err error) {
+	serverIndex, err := c.pickServer(key)
+	if err != nil {
+		return err
+	}
+	switch c.servers.codec(serverIndex).(type) {
+	case metaCodec, textCodec:
+	default:
+		return ErrMetaUnsupported
+	}
+	ctx, req := c.startRequest(ctx, op, serverIndex, key)
+	var hits, size int
+	defer func() {
+		req.end(hits, size, err)
+	}()
+	cn, err := c.getConnection(ctx, serverIndex)
+	if err != nil {
+		return err
+	}
+	req.acquired(cn)
+	hits, size, err = run(cn, &req)
+	c.releaseConnection(&req, cn, err)
+	return err
+}
+
+// MetaGet gets the item for the given key along with the metadata
+// selected by opts, with the meta protocol. ErrCacheMiss is returned
+// for a miss, unless opts.Vivify is set.
+func (c *Client) MetaGet(key string, opts MetaGetOptions) (*MetaItem, error) {
+	return c.MetaGetContext(context.Background(), key, opts)
+}
+
+// MetaGetContext is like MetaGet, with a context as in GetContext.
+func (c *Client) MetaGetContext(ctx context.Context, key string, opts MetaGetOptions) (mi *MetaItem, err error) {
+	err = c.metaRequest(ctx, OpMetaGet, key, func(cn *poolConn, req *request) (int, int, error) {
+		var err error
+		if mi, err = metaGet(cn, req, key, opts); err != nil {
+			return 0, 0, err
+		}
+		return 1, len(mi.Value), nil
+	})
+	return mi, err
+}
+
+// MetaSet stores item with the meta protocol, in the mode given by
+// opts. ErrNotStored is returned if the mode's condition isn't met, and
+// ErrCASConflict if the item was modified despite opts.CompareAndSwap.
+// The item gets its new CAS ID.
+func (c *Client) MetaSet(item *Item, opts MetaSetOptions) error {
+	return c.MetaSetContext(context.Background(), item, opts)
+}
+
+// MetaSetContext is like MetaSet, with a context as in GetContext.
+func (c *Client) MetaSetContext(ctx context.Context, item *Item, opts MetaSetOptions) error {
+	var args []string
+	if opts.Mode != 0 {
+		args = append(args, "M"+string(opts.Mode))
+	}
+	if opts.CompareAndSwap {
+		args = append(args, "C"+strconv.FormatUint(item.casid, 10))
+	}
+	if opts.Invalidate {
+		args = append(args, "I")
+	}
+	return c.metaRequest(ctx, OpMetaSet, item.Key, func(cn *poolConn, req *request) (int, int, error) {
+		return 0, len(item.Value), metaStore(cn, req, item, args...)
+	})
+}
+
+// MetaDelete deletes, or with opts.Invalidate marks as stale, the item
+// with the provided key, with the meta protocol. ErrCacheMiss is
+// returned if the item isn't in the cache.
+func (c *Client) MetaDelete(key string, opts MetaDeleteOptions) error {
+	return c.MetaDeleteContext(context.Background(), key, opts)
+}
+
+// MetaDeleteContext is like MetaDelete, with a context as in GetContext.
+func (c *Client) MetaDeleteContext(ctx context.Context, key string, opts MetaDeleteOptions) error {
+	var args []string
+	if opts.Invalidate {
+		args = append(args, "I")
+		if opts.Expiration != 0 {
+			args = append(args, "T"+expirationText(uint32(opts.Expiration)))
+		}
+	}
+	return c.metaRequest(ctx, OpMetaDelete, key, func(cn *poolConn, req *request) (int, int, error) {
+		return 0, 0, metaDelete(cn, req, key, args...)
+	})
+}
+
+// MetaArithmetic increments or decrements the value of key as described
+// by opts, with the meta protocol, and returns the new value.
+// ErrCacheMiss is returned for a missing key, unless opts.Create is set.
+func (c *Client) MetaArithmetic(key string, opts MetaArithmeticOptions) (uint64, error) {
+	return c.MetaArithmeticContext(context.Background(), key, opts)
+}
+
+// MetaArithmeticContext is like MetaArithmetic, with a context as in
+// GetContext.
+func (c *Client) MetaArithmeticContext(ctx context.Context, key string, opts MetaArithmeticOptions) (newValue uint64, err error) {
+	expiration := uint32(noAutoCreate)
+	if opts.Create {
+		if expiration, err = createExpiration(opts.Expiration); err != nil {
+			return 0, err
+		}
+	}
+	args := metaArithmeticArgs(opts.Decrement, opts.Delta, opts.Initial, expiration)
+	err = c.metaRequest(ctx, OpMetaArithmetic, key, func(cn *poolConn, req *request) (int, int, error) {
+		var err error
+		newValue, err = metaArithmetic(cn, req, key, args...)
+		return 0, 0, err
+	})
+	return newValue, err
+}
@@ -0,0 +1,142 @@
+package memcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dev-lazarev/memcache/memtest"
+)
+
+func TestMetaProtocol(t *testing.T) {
+	s := memtest.NewUnstartedServer()
+	s.User, s.Password = testConfig.User, testConfig.Password
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	config := testConfig
+	config.Server = s.Addr
+	config.Protocol = ProtocolMeta
+	// Check every reused connection, to exercise the meta noop.
+	config.PingIdleAfter = time.Nanosecond
+	c, err := New([]Config{config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testWithClient(t, c)
+}
+
+func TestMeta(t *testing.T) {
+	c, clock := newClockedClient(t, ProtocolMeta)
+
+	item := &Item{Key: "foo", Value: []byte("bar"), Flags: 42, Expiration: 100}
+	if err := c.MetaSet(item, MetaSetOptions{}); err != nil {
+		t.Fatalf("MetaSet: %v", err)
+	}
+	if item.casid == 0 {
+		t.Error("MetaSet didn't set the CAS ID")
+	}
+	if err := c.MetaSet(&Item{Key: "foo", Value: []byte("x")}, MetaSetOptions{Mode: MetaModeAdd}); err != ErrNotStored {
+		t.Errorf("MetaSet add of an existing key = %v, want ErrNotStored", err)
+	}
+	if err := c.MetaSet(&Item{Key: "foo", Value: []byte("baz")}, MetaSetOptions{Mode: MetaModeAppend}); err != nil {
+		t.Fatalf("MetaSet append: %v", err)
+	}
+	if err := c.MetaSet(item, MetaSetOptions{CompareAndSwap: true}); err != ErrCASConflict {
+		t.Errorf("MetaSet with a stale CAS ID = %v, want ErrCASConflict", err)
+	}
+
+	clock.Advance(10 * time.Second)
+	mi, err := c.MetaGet("foo", MetaGetOptions{TTL: true, LastAccess: true, HitBefore: true})
+	if err != nil {
+		t.Fatalf("MetaGet: %v", err)
+	}
+	if string(mi.Value) != "barbaz" || mi.Flags != 42 || mi.TTL != 90 || mi.LastAccess != 10 || mi.HitBefore {
+		t.Errorf("MetaGet = %+v, want barbaz, flags 42, TTL 90, last access 10, not hit before", mi)
+	}
+	mi, err = c.MetaGet("foo", MetaGetOptions{NoValue: true, HitBefore: true, Touch: true, TTL: true})
+	if err != nil {
+		t.Fatalf("MetaGet with touch: %v", err)
+	}
+	if mi.Value != nil || !mi.HitBefore || mi.TTL != -1 {
+		t.Errorf("MetaGet with touch = %+v, want no value, hit before and TTL -1", mi)
+	}
+	if _, err := c.MetaGet("missing", MetaGetOptions{}); err != ErrCacheMiss {
+		t.Errorf("MetaGet of a missing key = %v, want ErrCacheMiss", err)
+	}
+
+	// Stale-while-revalidate: the first client to see the invalidated
+	// item wins the right to refresh it.
+	if err := c.MetaDelete("foo", MetaDeleteOptions{Invalidate: true, Expiration: 30}); err != nil {
+		t.Fatalf("MetaDelete invalidate: %v", err)
+	}
+	winner, err := c.MetaGet("foo", MetaGetOptions{})
+	if err != nil || !winner.Stale || !winner.Won || string(winner.Value) != "barbaz" {
+		t.Fatalf("MetaGet of an invalidated item = %+v, %v, want the stale value, won", winner, err)
+	}
+	mi, err = c.MetaGet("foo", MetaGetOptions{})
+	if err != nil || !mi.Stale || mi.Won || !mi.WinPending {
+		t.Fatalf("second MetaGet of an invalidated item = %+v, %v, want stale, win pending", mi, err)
+	}
+	winner.Value = []byte("fresh")
+	if err := c.MetaSet(&winner.Item, MetaSetOptions{CompareAndSwap: true}); err != nil {
+		t.Fatalf("MetaSet by the winner: %v", err)
+	}
+	if mi, err = c.MetaGet("foo", MetaGetOptions{}); err != nil || mi.Stale || string(mi.Value) != "fresh" {
+		t.Errorf("MetaGet after the refresh = %+v, %v, want fresh", mi, err)
+	}
+
+	mi, err = c.MetaGet("vivified", MetaGetOptions{Vivify: true, Expiration: 30})
+	if err != nil || !mi.Won || len(mi.Value) != 0 {
+		t.Errorf("MetaGet with vivify of a missing key = %+v, %v, want an empty won item", mi, err)
+	}
+	if mi, err = c.MetaGet("vivified", MetaGetOptions{Vivify: true, Expiration: 30}); err != nil || mi.Won || !mi.WinPending {
+		t.Errorf("second MetaGet with vivify = %+v, %v, want win pending", mi, err)
+	}
+	if err := c.MetaSet(&Item{Key: "recache", Value: []byte("v"), Expiration: 60}, MetaSetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if mi, err = c.MetaGet("recache", MetaGetOptions{Recache: 30}); err != nil || mi.Won {
+		t.Errorf("MetaGet with recache of a fresh item = %+v, %v, want not won", mi, err)
+	}
+	clock.Advance(40 * time.Second)
+	if mi, err = c.MetaGet("recache", MetaGetOptions{Recache: 30}); err != nil || !mi.Won {
+		t.Errorf("MetaGet with recache of an expiring item = %+v, %v, want won", mi, err)
+	}
+
+	if err := c.MetaDelete("foo", MetaDeleteOptions{}); err != nil {
+		t.Fatalf("MetaDelete: %v", err)
+	}
+	if err := c.MetaDelete("foo", MetaDeleteOptions{}); err != ErrCacheMiss {
+		t.Errorf("MetaDelete of a missing key = %v, want ErrCacheMiss", err)
+	}
+
+	if _, err := c.MetaArithmetic("n", MetaArithmeticOptions{Delta: 1}); err != ErrCacheMiss {
+		t.Errorf("MetaArithmetic of a missing key = %v, want ErrCacheMiss", err)
+	}
+	if _, err := c.MetaArithmetic("n", MetaArithmeticOptions{Delta: 1, Create: true, Expiration: -1}); err != ErrNegativeExpiration {
+		t.Errorf("MetaArithmetic creating the key with a negative expiration = %v, want ErrNegativeExpiration", err)
+	}
+	n, err := c.MetaArithmetic("n", MetaArithmeticOptions{Delta: 1, Create: true, Initial: 10})
+	if err != nil || n != 10 {
+		t.Errorf("MetaArithmetic creating the key = %d, %v, want 10", n, err)
+	}
+	n, err = c.MetaArithmetic("n", MetaArithmeticOptions{Delta: 4, Decrement: true})
+	if err != nil || n != 6 {
+		t.Errorf("MetaArithmetic decrement = %d, %v, want 6", n, err)
+	}
+	if _, err := c.MetaArithmetic("recache", MetaArithmeticOptions{Delta: 1}); err != ErrBadIncrDec {
+		t.Errorf("MetaArithmetic of a non-numeric value = %v, want ErrBadIncrDec", err)
+	}
+}
+
+func TestMetaUnsupported(t *testing.T) {
+	c := newLocalhostServer(t)
+	if _, err := c.MetaGet("foo", MetaGetOptions{}); err != ErrMetaUnsupported {
+		t.Errorf("MetaGet over the binary protocol = %v, want ErrMetaUnsupported", err)
+	}
+	if err := c.MetaSet(&Item{Key: "foo"}, MetaSetOptions{}); err != ErrMetaUnsupported {
+		t.Errorf("MetaSet over the binary protocol = %v, want ErrMetaUnsupported", err)
+	}
+}
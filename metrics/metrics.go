@@ -0,0 +1,366 @@
+// Package metrics exports memcache client metrics in the Prometheus
+// text exposition format, without depending on the Prometheus client
+// library.
+//
+// A Collector is installed as the Observer of a Client and served over
+// HTTP:
+//
+//	mc, _ := memcache.New(configs)
+//	collector := metrics.NewCollector(mc)
+//	mc.Observer = collector
+//	http.Handle("/metrics", collector)
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dev-lazarev/memcache"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the latency
+// histogram buckets used when Collector.Buckets is empty.
+var DefaultBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// Collector aggregates the events of a memcache.Client and exposes them
+// in the Prometheus text format. It implements memcache.Observer and
+// http.Handler.
+type Collector struct {
+	//Buckets are the histogram upper bounds in seconds, sorted. If empty, DefaultBuckets is used.
+	Buckets []float64
+
+	//Namespace prefixes every metric name, "memcache" by default.
+	Namespace string
+
+	poolStats func() []memcache.PoolStats
+
+	mu           sync.Mutex
+	requests     map[requestKey]uint64
+	latency      map[opKey]*histogram
+	hits         map[opKey]uint64
+	misses       map[opKey]uint64
+	bytes        map[opKey]uint64
+	acquire      map[string]*histogram
+	acquireFails map[errorKey]uint64
+}
+
+type requestKey struct {
+	server, operation, result string
+}
+
+type opKey struct {
+	server, operation string
+}
+
+type errorKey struct {
+	server, result string
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(buckets))
+	}
+	for i, b := range buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// NewCollector returns a Collector which also reports the connection
+// pool gauges of client. The client may be nil, in which case only the
+// observed events are exported.
+func NewCollector(client *memcache.Client) *Collector {
+	c := &Collector{
+		requests:     make(map[requestKey]uint64),
+		latency:      make(map[opKey]*histogram),
+		hits:         make(map[opKey]uint64),
+		misses:       make(map[opKey]uint64),
+		bytes:        make(map[opKey]uint64),
+		acquire:      make(map[string]*histogram),
+		acquireFails: make(map[errorKey]uint64),
+	}
+	if client != nil {
+		c.poolStats = client.PoolStats
+	}
+	return c
+}
+
+func (c *Collector) buckets() []float64 {
+	if len(c.Buckets) > 0 {
+		return c.Buckets
+	}
+	return DefaultBuckets
+}
+
+func (c *Collector) namespace() string {
+	if c.Namespace != "" {
+		return c.Namespace
+	}
+	return "memcache"
+}
+
+// ObserveRequest implements memcache.Observer.
+func (c *Collector) ObserveRequest(e memcache.RequestEvent) {
+	op := opKey{e.Server, e.Operation}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests[requestKey{e.Server, e.Operation, Result(e.Err)}]++
+	h := c.latency[op]
+	if h == nil {
+		h = new(histogram)
+		c.latency[op] = h
+	}
+	h.observe(c.buckets(), e.Duration.Seconds())
+	c.bytes[op] += uint64(e.Bytes)
+	if isRetrieval(e.Operation) && (e.Err == nil || e.Err == memcache.ErrCacheMiss) {
+		c.hits[op] += uint64(e.Hits)
+		c.misses[op] += uint64(e.Keys - e.Hits)
+	}
+}
+
+// ObservePool implements memcache.Observer.
+func (c *Collector) ObservePool(e memcache.PoolEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := c.acquire[e.Server]
+	if h == nil {
+		h = new(histogram)
+		c.acquire[e.Server] = h
+	}
+	h.observe(c.buckets(), e.Duration.Seconds())
+	if e.Err != nil {
+		c.acquireFails[errorKey{e.Server, Result(e.Err)}]++
+	}
+}
+
+func isRetrieval(op string) bool {
+	return op == memcache.OpGet || op == memcache.OpGetMulti || op == memcache.OpGetAndTouch || op == memcache.OpMetaGet
+}
+
+// Result classifies err into the value of the result label: "ok" for
+// nil, a short name for the errors defined by the memcache package,
+// "timeout" and "network" for network failures and "other" otherwise.
+func Result(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, memcache.ErrCacheMiss):
+		return "miss"
+	case errors.Is(err, memcache.ErrNotStored):
+		return "not_stored"
+	case errors.Is(err, memcache.ErrCASConflict):
+		return "cas_conflict"
+	case errors.Is(err, memcache.ErrBadIncrDec):
+		return "bad_incr_decr"
+	case errors.Is(err, memcache.ErrMalformedKey):
+		return "malformed_key"
+	case errors.Is(err, memcache.ErrServerError):
+		return "server_error"
+	case errors.Is(err, memcache.ErrPoolTimeout):
+		return "pool_timeout"
+	case errors.Is(err, memcache.ErrClientClosed), errors.Is(err, memcache.ErrPoolClosed):
+		return "closed"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		if ne.Timeout() {
+			return "timeout"
+		}
+		return "network"
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return "network"
+	}
+	return "other"
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = c.WriteTo(w)
+}
+
+// WriteTo writes the metrics to w in the Prometheus text format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	ns := c.namespace()
+	buckets := c.buckets()
+
+	c.mu.Lock()
+	header(cw, ns+"_requests_total", "counter", "Requests made to memcache servers, by result.")
+	for _, k := range sortedKeys(c.requests, func(k requestKey) string { return k.server + "\x00" + k.operation + "\x00" + k.result }) {
+		sample(cw, ns+"_requests_total", labels("server", k.server, "operation", k.operation, "result", k.result), float64(c.requests[k]))
+	}
+	header(cw, ns+"_request_duration_seconds", "histogram", "Latency of requests made to memcache servers.")
+	for _, k := range sortedKeys(c.latency, opKeyString) {
+		writeHistogram(cw, ns+"_request_duration_seconds", []string{"server", k.server, "operation", k.operation}, buckets, c.latency[k])
+	}
+	writeOpCounter(cw, ns+"_hits_total", "Keys found by retrieval requests.", c.hits)
+	writeOpCounter(cw, ns+"_misses_total", "Keys not found by retrieval requests.", c.misses)
+	writeOpCounter(cw, ns+"_bytes_total", "Size of the values sent and received.", c.bytes)
+	header(cw, ns+"_pool_acquire_duration_seconds", "histogram", "Time taken to check out a connection.")
+	for _, server := range sortedKeys(c.acquire, func(s string) string { return s }) {
+		writeHistogram(cw, ns+"_pool_acquire_duration_seconds", []string{"server", server}, buckets, c.acquire[server])
+	}
+	header(cw, ns+"_pool_acquire_errors_total", "counter", "Failed connection checkouts, by result.")
+	for _, k := range sortedKeys(c.acquireFails, func(k errorKey) string { return k.server + "\x00" + k.result }) {
+		sample(cw, ns+"_pool_acquire_errors_total", labels("server", k.server, "result", k.result), float64(c.acquireFails[k]))
+	}
+	c.mu.Unlock()
+
+	if c.poolStats != nil {
+		writePoolStats(cw, ns, c.poolStats())
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+func writePoolStats(w *countWriter, ns string, stats []memcache.PoolStats) {
+	gauges := []struct {
+		name, help string
+		value      func(memcache.PoolStats) float64
+	}{
+		{"_pool_max_open_connections", "Maximum number of open connections, 0 for no limit.", func(s memcache.PoolStats) float64 { return float64(s.MaxOpen) }},
+		{"_pool_open_connections", "Open connections.", func(s memcache.PoolStats) float64 { return float64(s.Open) }},
+		{"_pool_in_use_connections", "Connections in use.", func(s memcache.PoolStats) float64 { return float64(s.InUse) }},
+		{"_pool_idle_connections", "Idle connections.", func(s memcache.PoolStats) float64 { return float64(s.Idle) }},
+	}
+	for _, g := range gauges {
+		header(w, ns+g.name, "gauge", g.help)
+		for _, s := range stats {
+			sample(w, ns+g.name, labels("server", s.Server), g.value(s))
+		}
+	}
+	header(w, ns+"_pool_wait_total", "counter", "Connection checkouts which had to wait.")
+	for _, s := range stats {
+		sample(w, ns+"_pool_wait_total", labels("server", s.Server), float64(s.WaitCount))
+	}
+	header(w, ns+"_pool_wait_seconds_total", "counter", "Time spent waiting for a connection.")
+	for _, s := range stats {
+		sample(w, ns+"_pool_wait_seconds_total", labels("server", s.Server), s.WaitDuration.Seconds())
+	}
+	header(w, ns+"_pool_closed_total", "counter", "Connections closed by the pool, by reason.")
+	for _, s := range stats {
+		for _, c := range []struct {
+			reason string
+			n      int64
+		}{
+			{"max_idle", s.MaxIdleClosed},
+			{"idle_timeout", s.IdleTimeoutClosed},
+			{"max_lifetime", s.MaxLifetimeClosed},
+			{"validation", s.ValidationClosed},
+		} {
+			sample(w, ns+"_pool_closed_total", labels("server", s.Server, "reason", c.reason), float64(c.n))
+		}
+	}
+	header(w, ns+"_pool_wait_timeouts_total", "counter", "Connection checkouts which timed out, cancellations excluded.")
+	for _, s := range stats {
+		sample(w, ns+"_pool_wait_timeouts_total", labels("server", s.Server), float64(s.WaitTimeouts))
+	}
+}
+
+func writeOpCounter(w *countWriter, name, help string, values map[opKey]uint64) {
+	header(w, name, "counter", help)
+	for _, k := range sortedKeys(values, opKeyString) {
+		sample(w, name, labels("server", k.server, "operation", k.operation), float64(values[k]))
+	}
+}
+
+func writeHistogram(w *countWriter, name string, lbls []string, buckets []float64, h *histogram) {
+	for i, b := range buckets {
+		var n uint64
+		if h.counts != nil {
+			n = h.counts[i]
+		}
+		sample(w, name+"_bucket", labels(append(lbls[:len(lbls):len(lbls)], "le", formatFloat(b))...), float64(n))
+	}
+	sample(w, name+"_bucket", labels(append(lbls[:len(lbls):len(lbls)], "le", "+Inf")...), float64(h.count))
+	sample(w, name+"_sum", labels(lbls...), h.sum)
+	sample(w, name+"_count", labels(lbls...), float64(h.count))
+}
+
+func opKeyString(k opKey) string {
+	return k.server + "\x00" + k.operation
+}
+
+func sortedKeys[K comparable, V any](m map[K]V, key func(K) string) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return key(keys[i]) < key(keys[j]) })
+	return keys
+}
+
+func header(w *countWriter, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sample(w *countWriter, name, labels string, v float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(v))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// labels formats name/value pairs as a label set.
+func labels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		labelEscaper.WriteString(&b, pairs[i+1])
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// countWriter counts the bytes written and remembers the first error.
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dev-lazarev/memcache"
+)
+
+func TestCollector(t *testing.T) {
+	c := NewCollector(nil)
+	c.Buckets = []float64{0.001, 0.01}
+	c.ObserveRequest(memcache.RequestEvent{Operation: memcache.OpGet, Server: "a:1", Keys: 1, Hits: 1, Bytes: 5, Duration: 500 * time.Microsecond})
+	c.ObserveRequest(memcache.RequestEvent{Operation: memcache.OpGet, Server: "a:1", Keys: 1, Duration: 5 * time.Millisecond, Err: memcache.ErrCacheMiss})
+	c.ObserveRequest(memcache.RequestEvent{Operation: memcache.OpGetMulti, Server: "a:1", Keys: 3, Hits: 2, Bytes: 10, Duration: time.Second})
+	c.ObserveRequest(memcache.RequestEvent{Operation: memcache.OpSet, Server: "b:2", Keys: 1, Bytes: 7, Err: memcache.ErrNotStored})
+	c.ObservePool(memcache.PoolEvent{Server: "a:1", Duration: time.Millisecond})
+	c.ObservePool(memcache.PoolEvent{Server: "b:2", Duration: time.Second, Err: memcache.ErrPoolTimeout})
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	out := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE memcache_requests_total counter",
+		`memcache_requests_total{server="a:1",operation="get",result="ok"} 1`,
+		`memcache_requests_total{server="a:1",operation="get",result="miss"} 1`,
+		`memcache_requests_total{server="b:2",operation="set",result="not_stored"} 1`,
+		"# TYPE memcache_request_duration_seconds histogram",
+		`memcache_request_duration_seconds_bucket{server="a:1",operation="get",le="0.001"} 1`,
+		`memcache_request_duration_seconds_bucket{server="a:1",operation="get",le="0.01"} 2`,
+		`memcache_request_duration_seconds_bucket{server="a:1",operation="get",le="+Inf"} 2`,
+		`memcache_request_duration_seconds_sum{server="a:1",operation="get"} 0.0055`,
+		`memcache_request_duration_seconds_count{server="a:1",operation="get_multi"} 1`,
+		`memcache_hits_total{server="a:1",operation="get"} 1`,
+		`memcache_misses_total{server="a:1",operation="get"} 1`,
+		`memcache_hits_total{server="a:1",operation="get_multi"} 2`,
+		`memcache_misses_total{server="a:1",operation="get_multi"} 1`,
+		`memcache_bytes_total{server="b:2",operation="set"} 7`,
+		`memcache_pool_acquire_duration_seconds_count{server="b:2"} 1`,
+		`memcache_pool_acquire_errors_total{server="b:2",result="pool_timeout"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("output is missing %q", line)
+		}
+	}
+	if strings.Contains(out, `memcache_hits_total{server="b:2"`) {
+		t.Error("hits reported for a storage operation")
+	}
+	if t.Failed() {
+		t.Log(out)
+	}
+}
+
+func TestCollectorPoolStats(t *testing.T) {
+	mc, err := memcache.New([]memcache.Config{{Server: "127.0.0.1:1", MaxIdle: 1, MaxCap: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+	c := NewCollector(mc)
+	c.Namespace = "mc"
+	var b strings.Builder
+	n, err := c.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(b.Len()) {
+		t.Errorf("WriteTo = %d, wrote %d bytes", n, b.Len())
+	}
+	for _, line := range []string{
+		`mc_pool_max_open_connections{server="127.0.0.1:1"} 2`,
+		`mc_pool_open_connections{server="127.0.0.1:1"} 0`,
+		`mc_pool_closed_total{server="127.0.0.1:1",reason="max_lifetime"} 0`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("output is missing %q:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestResult(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{nil, "ok"},
+		{memcache.ErrCacheMiss, "miss"},
+		{memcache.ErrCASConflict, "cas_conflict"},
+		{memcache.ErrClientClosed, "closed"},
+		{&timeoutError{}, "timeout"},
+		{errors.New("boom"), "other"},
+	} {
+		if got := Result(tc.err); got != tc.want {
+			t.Errorf("Result(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (*timeoutError) Error() string   { return "i/o timeout" }
+func (*timeoutError) Timeout() bool   { return true }
+func (*timeoutError) Temporary() bool { return true }
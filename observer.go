@@ -0,0 +1,95 @@
+package memcache
+
+import "time"
+
+// Observer receives events about the requests made by a Client and the
+// use of its connection pools, for example to export metrics. Methods
+// are called synchronously from the goroutine making the request, so
+// implementations must be safe for concurrent use and return quickly.
+type Observer interface {
+	// ObserveRequest is called once a request to a server finishes.
+	// Batch operations report an event per server.
+	ObserveRequest(e RequestEvent)
+
+	// ObservePool is called once a connection has been checked out of
+	// a server pool, or the attempt failed.
+	ObservePool(e PoolEvent)
+}
+
+// Operation names reported in RequestEvent.Operation.
+const (
+	OpGet         = "get"
+	OpGetMulti    = "get_multi"
+	OpGetAndTouch = "gat"
+	OpSet         = "set"
+	OpAdd         = "add"
+	OpCAS         = "cas"
+	OpDelete      = "delete"
+	OpTouch       = "touch"
+	OpIncrement   = "incr"
+	OpDecrement   = "decr"
+	OpFlush       = "flush"
+	OpStats       = "stats"
+
+	OpMetaGet        = "mg"
+	OpMetaSet        = "ms"
+	OpMetaDelete     = "md"
+	OpMetaArithmetic = "ma"
+)
+
+// RequestEvent describes a request made to a server.
+type RequestEvent struct {
+	// Operation is the name of the Client operation, one of the Op
+	// constants. Quiet batch operations have a "_q" suffix.
+	Operation string
+
+	// Server is the address of the server, as given in Config.Server.
+	Server string
+
+	// Keys is the number of keys sent to the server.
+	Keys int
+
+	// Hits is the number of keys found, for retrieval operations.
+	// The misses are the remaining keys, unless Err is a failure.
+	Hits int
+
+	// Bytes is the total size of the values sent or received.
+	Bytes int
+
+	// Duration is the time taken by the request, including the time
+	// spent waiting for a connection.
+	Duration time.Duration
+
+	// Err is the error returned for the request, if any. Misses of
+	// single key retrievals are reported as ErrCacheMiss.
+	Err error
+}
+
+// PoolEvent describes a connection checkout from a server pool.
+type PoolEvent struct {
+	// Server is the address of the server, as given in Config.Server.
+	Server string
+
+	// Duration is the time taken to obtain the connection, including
+	// waiting for a free one and dialing it.
+	Duration time.Duration
+
+	// Err is the error which prevented getting a connection, if any.
+	Err error
+}
+
+// observeRequest reports a request to the Observer, if there's one.
+func (c *Client) observeRequest(op string, serverIndex uint32, keys, hits, bytes int, start time.Time, err error) {
+	if c.Observer == nil {
+		return
+	}
+	c.Observer.ObserveRequest(RequestEvent{
+		Operation: op,
+		Server:    c.servers.Name(serverIndex),
+		Keys:      keys,
+		Hits:      hits,
+		Bytes:     bytes,
+		Duration:  time.Since(start),
+		Err:       err,
+	})
+}
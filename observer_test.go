@@ -0,0 +1,85 @@
+package memcache
+
+import (
+	"sync"
+	"testing"
+)
+
+type recordingObserver struct {
+	mu       sync.Mutex
+	requests []RequestEvent
+	pools    []PoolEvent
+}
+
+func (o *recordingObserver) ObserveRequest(e RequestEvent) {
+	o.mu.Lock()
+	o.requests = append(o.requests, e)
+	o.mu.Unlock()
+}
+
+func (o *recordingObserver) ObservePool(e PoolEvent) {
+	o.mu.Lock()
+	o.pools = append(o.pools, e)
+	o.mu.Unlock()
+}
+
+func TestObserver(t *testing.T) {
+	c := newStubClient(t, Config{MaxIdle: 1, MaxCap: 1})
+	o := &recordingObserver{}
+	c.Observer = o
+
+	if err := c.Set(&Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetMulti([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Increment("n", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(0); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err := c.Get("foo"); err != ErrClientClosed {
+		t.Fatalf("Get after Close = %v, want %v", err, ErrClientClosed)
+	}
+
+	want := []RequestEvent{
+		{Operation: OpSet, Keys: 1, Bytes: 3},
+		{Operation: OpGet, Keys: 1, Hits: 1, Bytes: 3},
+		{Operation: OpGetMulti, Keys: 2},
+		{Operation: OpDelete, Keys: 1},
+		{Operation: OpIncrement, Keys: 1},
+		{Operation: OpFlush},
+		{Operation: OpGet, Keys: 1, Err: ErrClientClosed},
+	}
+	if len(o.requests) != len(want) {
+		t.Fatalf("observed %d requests, want %d: %+v", len(o.requests), len(want), o.requests)
+	}
+	for i, e := range o.requests {
+		w := want[i]
+		if e.Server != "stub:11211" || e.Duration <= 0 {
+			t.Errorf("request %d = %+v, want server and duration set", i, e)
+		}
+		e.Server, e.Duration = "", 0
+		if e != w {
+			t.Errorf("request %d = %+v, want %+v", i, e, w)
+		}
+	}
+	// No connection is checked out once the client is closed.
+	if len(o.pools) != len(want)-1 {
+		t.Errorf("observed %d checkouts, want %d", len(o.pools), len(want)-1)
+	}
+	for _, e := range o.pools {
+		if e.Server != "stub:11211" || e.Err != nil {
+			t.Errorf("pool event = %+v", e)
+		}
+	}
+}
@@ -0,0 +1,577 @@
+package memcache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrPoolClosed is returned when a connection is requested from a
+	// pool which has been released.
+	ErrPoolClosed = errors.New("memcache: connection pool is closed")
+
+	// ErrPoolTimeout is returned when no connection became available
+	// within Config.PoolTimeout while the pool was at MaxCap.
+	ErrPoolTimeout = errors.New("memcache: timed out waiting for a connection")
+)
+
+// PoolStats describes the state of the connection pool of a server.
+type PoolStats struct {
+	// Server is the server address, as given in Config.Server.
+	Server string
+
+	// MaxOpen is the maximum number of open connections, or zero if
+	// there's no limit.
+	MaxOpen int
+
+	// Open is the number of established connections, both in use
+	// and idle, plus the ones being dialed.
+	Open int
+	// InUse is the number of connections currently checked out.
+	InUse int
+	// Idle is the number of idle connections.
+	Idle int
+
+	// WaitCount is the total number of times a connection had to be
+	// waited for because the pool was at MaxCap.
+	WaitCount int64
+	// WaitDuration is the total time spent waiting for connections.
+	WaitDuration time.Duration
+	// WaitTimeouts is the number of waits which timed out before a
+	// connection became available, either after the wait timeout or
+	// at the deadline of the caller's context. Waits canceled by the
+	// caller aren't counted.
+	WaitTimeouts int64
+
+	// MaxIdleClosed is the number of connections closed because the
+	// pool already had MaxIdle idle connections.
+	MaxIdleClosed int64
+	// IdleTimeoutClosed is the number of connections closed because
+	// they were idle for longer than IdleTimeout.
+	IdleTimeoutClosed int64
+	// MaxLifetimeClosed is the number of connections closed because
+	// they were open for longer than MaxConnLifetime.
+	MaxLifetimeClosed int64
+	// ValidationClosed is the number of idle connections closed because
+	// they failed the checks enabled by ValidateConnections and
+	// PingIdleAfter.
+	ValidationClosed int64
+}
+
+// poolConn is a connection managed by a connPool.
+type poolConn struct {
+	net.Conn
+	createdAt  time.Time
+	returnedAt time.Time
+	// expiresAt is when the connection reaches its maximum lifetime,
+	// or zero if it has none.
+	expiresAt time.Time
+	// hasDeadline is set while the connection carries the deadline of
+	// the request using it.
+	hasDeadline bool
+	// firstByteAt is when the first byte of a response was read, it's
+	// only recorded while timeFirstByte is set.
+	firstByteAt   time.Time
+	timeFirstByte bool
+	// maxBody is the maximum body size of the responses read from the
+	// connection.
+	maxBody int
+	// codec speaks the protocol of the server, br buffers the reads of
+	// the text protocol.
+	codec codec
+	br    *bufio.Reader
+}
+
+// Read reads from the connection, recording when the first byte of the
+// response arrives if requested.
+func (pc *poolConn) Read(b []byte) (int, error) {
+	n, err := pc.Conn.Read(b)
+	if pc.timeFirstByte && n > 0 && pc.firstByteAt.IsZero() {
+		pc.firstByteAt = time.Now()
+	}
+	return n, err
+}
+
+// newPoolConn wraps a newly established connection. Its lifetime is
+// shortened by up to 10% at random, so connections opened together
+// aren't all recycled at the same time.
+func (p *connPool) newPoolConn(conn net.Conn) *poolConn {
+	now := time.Now()
+	pc := &poolConn{Conn: conn, createdAt: now, returnedAt: now, maxBody: p.maxBody, codec: p.codec}
+	if p.maxLifetime > 0 {
+		lifetime := p.maxLifetime
+		if jitter := int64(lifetime / 10); jitter > 0 {
+			lifetime -= time.Duration(rand.Int63n(jitter))
+		}
+		pc.expiresAt = now.Add(lifetime)
+	}
+	return pc
+}
+
+// connPool is the pool of connections to a single server. Connections
+// are dialed outside of the pool lock, so a slow or unreachable server
+// only blocks the callers waiting for its connections.
+type connPool struct {
+	name        string
+	factory     func(ctx context.Context) (net.Conn, error)
+	validate    func(pc *poolConn) error
+	initialCap  int
+	maxCap      int
+	maxIdle     int
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	waitTimeout time.Duration
+	maxBody     int
+	codec       codec
+	logger      Logger
+
+	mu     sync.Mutex
+	closed bool
+	idle   []*poolConn
+	// open counts the connections in use, idle and being dialed.
+	open  int
+	inUse int
+	// waiters are served in FIFO order. A waiter receives either a
+	// connection, or nil when it may try to dial a new one.
+	waiters []chan *poolConn
+	stats   PoolStats
+	// failing is set while the server can't be connected to.
+	failing bool
+	// stop is closed on release to stop the maintainer.
+	stop chan struct{}
+}
+
+// newConnPool returns a pool for the server described by config, filled
+// with config.InitialCap connections.
+func newConnPool(config Config, factory func(ctx context.Context) (net.Conn, error)) (*connPool, error) {
+	if config.InitialCap < 0 || config.InitialCap > config.MaxIdle || (config.MaxCap > 0 && config.MaxIdle > config.MaxCap) {
+		return nil, errors.New("memcache: invalid capacity settings")
+	}
+	p := &connPool{
+		name:        config.Server,
+		factory:     factory,
+		maxCap:      config.MaxCap,
+		maxIdle:     config.MaxIdle,
+		idleTimeout: config.IdleTimeout,
+		maxLifetime: config.MaxConnLifetime,
+		waitTimeout: config.PoolTimeout,
+		maxBody:     config.maxResponseSize(),
+		codec:       config.Protocol.codec(),
+		validate:    config.connValidator(),
+		initialCap:  config.InitialCap,
+		logger:      config.logger(),
+		stop:        make(chan struct{}),
+	}
+	for i := 0; i < config.InitialCap; i++ {
+		conn, err := p.connect(context.Background())
+		if err != nil {
+			p.release()
+			return nil, fmt.Errorf("memcache: failed to fill the pool for %s: %w", config.Server, err)
+		}
+		p.idle = append(p.idle, p.newPoolConn(conn))
+		p.open++
+	}
+	if p.initialCap > 0 || p.idleTimeout > 0 || p.maxLifetime > 0 {
+		interval := config.MaintenanceInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		go p.maintainer(interval)
+	}
+	return p, nil
+}
+
+// get returns an idle connection, dials a new one or, if the pool is at
+// MaxCap, waits for a connection to be returned until ctx is done or
+// PoolTimeout expires. Idle connections failing validation are closed
+// and replaced.
+func (p *connPool) get(ctx context.Context) (*poolConn, error) {
+	p.mu.Lock()
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if pc := p.popIdle(); pc != nil {
+			p.inUse++
+			p.mu.Unlock()
+			if p.validate == nil {
+				return pc, nil
+			}
+			err := p.validate(pc)
+			if err == nil {
+				return pc, nil
+			}
+			// Replace the dead connection transparently.
+			p.closeConn(pc, "validation", "error", err)
+			p.mu.Lock()
+			p.stats.ValidationClosed++
+			p.discardLocked()
+			continue
+		}
+		if p.maxCap <= 0 || p.open < p.maxCap {
+			p.open++
+			p.inUse++
+			p.mu.Unlock()
+			return p.dial(ctx)
+		}
+		pc, err := p.wait(ctx)
+		if err != nil || pc != nil {
+			return pc, err
+		}
+		// A slot was freed, try again.
+		p.mu.Lock()
+	}
+}
+
+// popIdle returns the most recently used idle connection which is still
+// usable, closing the expired ones. p.mu must be held.
+func (p *connPool) popIdle() *poolConn {
+	now := time.Now()
+	for len(p.idle) > 0 {
+		pc := p.idle[len(p.idle)-1]
+		p.idle[len(p.idle)-1] = nil
+		p.idle = p.idle[:len(p.idle)-1]
+		reason := p.expired(pc, now)
+		if reason == "" {
+			return pc
+		}
+		p.open--
+		go p.closeConn(pc, reason)
+	}
+	return nil
+}
+
+func (p *connPool) lifetimeExpired(pc *poolConn, now time.Time) bool {
+	return !pc.expiresAt.IsZero() && !now.Before(pc.expiresAt)
+}
+
+// expired returns why the idle connection pc can't be reused anymore,
+// counting it in the stats, or an empty string if it still can. p.mu
+// must be held.
+func (p *connPool) expired(pc *poolConn, now time.Time) string {
+	switch {
+	case p.idleTimeout > 0 && now.Sub(pc.returnedAt) > p.idleTimeout:
+		p.stats.IdleTimeoutClosed++
+		return "idle_timeout"
+	case p.lifetimeExpired(pc, now):
+		p.stats.MaxLifetimeClosed++
+		return "max_lifetime"
+	}
+	return ""
+}
+
+// closeConn closes a connection which left the pool, logging why.
+func (p *connPool) closeConn(pc *poolConn, reason string, args ...any) {
+	p.logger.Debug("memcache: connection closed", append([]any{"server", p.name, "reason", reason}, args...)...)
+	_ = pc.Close()
+}
+
+// connect opens a new connection with the pool factory, logging when
+// the server becomes unreachable and when it recovers.
+func (p *connPool) connect(ctx context.Context) (net.Conn, error) {
+	conn, err := p.factory(ctx)
+	if err != nil && ctx.Err() != nil {
+		// The caller gave up, that says nothing about the server.
+		p.logger.Debug("memcache: connection attempt canceled", "server", p.name, "error", err)
+		return nil, err
+	}
+	p.mu.Lock()
+	failing := p.failing
+	p.failing = err != nil
+	p.mu.Unlock()
+	switch {
+	case err != nil && !failing:
+		p.logger.Error("memcache: server unreachable", "server", p.name, "error", err)
+	case err != nil:
+		p.logger.Debug("memcache: connection failed", "server", p.name, "error", err)
+	case failing:
+		p.logger.Info("memcache: server reachable again", "server", p.name)
+	default:
+		p.logger.Debug("memcache: connection opened", "server", p.name)
+	}
+	return conn, err
+}
+
+// dial opens a new connection for a slot already accounted for in
+// p.open and p.inUse.
+func (p *connPool) dial(ctx context.Context) (*poolConn, error) {
+	conn, err := p.connect(ctx)
+	if err != nil {
+		p.mu.Lock()
+		p.open--
+		p.inUse--
+		p.notifyFreeSlot()
+		p.mu.Unlock()
+		return nil, err
+	}
+	return p.newPoolConn(conn), nil
+}
+
+// wait queues the caller until a connection is handed over. It returns
+// a nil connection and error when a slot was freed instead. p.mu must be
+// held and is released.
+func (p *connPool) wait(ctx context.Context) (*poolConn, error) {
+	req := make(chan *poolConn, 1)
+	p.waiters = append(p.waiters, req)
+	p.stats.WaitCount++
+	p.mu.Unlock()
+
+	start := time.Now()
+	var timeout <-chan time.Time
+	if p.waitTimeout > 0 {
+		timer := time.NewTimer(p.waitTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case pc, ok := <-req:
+		p.mu.Lock()
+		p.stats.WaitDuration += time.Since(start)
+		p.mu.Unlock()
+		if !ok {
+			return nil, ErrPoolClosed
+		}
+		return pc, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = ErrPoolTimeout
+	}
+
+	p.mu.Lock()
+	p.stats.WaitDuration += time.Since(start)
+	if err == ErrPoolTimeout || err == context.DeadlineExceeded {
+		p.stats.WaitTimeouts++
+	}
+	removed := false
+	for i, w := range p.waiters {
+		if w == req {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			removed = true
+			break
+		}
+	}
+	p.mu.Unlock()
+	if !removed {
+		// Something was handed over while giving up, pass it on.
+		if pc, ok := <-req; ok {
+			if pc != nil {
+				p.put(pc)
+			} else {
+				p.mu.Lock()
+				p.notifyFreeSlot()
+				p.mu.Unlock()
+			}
+		}
+	}
+	return nil, err
+}
+
+// notifyFreeSlot tells the first waiter, if any, that it may dial a new
+// connection. p.mu must be held.
+func (p *connPool) notifyFreeSlot() {
+	if len(p.waiters) == 0 {
+		return
+	}
+	req := p.waiters[0]
+	p.waiters = p.waiters[1:]
+	req <- nil
+}
+
+// put returns a healthy connection to the pool, handing it over to a
+// waiter if there's one.
+func (p *connPool) put(pc *poolConn) {
+	p.mu.Lock()
+	now := time.Now()
+	if p.closed || p.lifetimeExpired(pc, now) {
+		reason := "pool_closed"
+		if !p.closed {
+			p.stats.MaxLifetimeClosed++
+			reason = "max_lifetime"
+		}
+		p.discardLocked()
+		p.mu.Unlock()
+		p.closeConn(pc, reason)
+		return
+	}
+	if len(p.waiters) > 0 {
+		req := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		p.mu.Unlock()
+		req <- pc
+		return
+	}
+	p.inUse--
+	if len(p.idle) >= p.maxIdle {
+		p.open--
+		p.stats.MaxIdleClosed++
+		p.mu.Unlock()
+		p.closeConn(pc, "max_idle")
+		return
+	}
+	pc.returnedAt = now
+	p.idle = append(p.idle, pc)
+	p.mu.Unlock()
+}
+
+// discard closes a connection which can't be reused, such as one which
+// failed in the middle of a command.
+func (p *connPool) discard(pc *poolConn) error {
+	p.mu.Lock()
+	p.discardLocked()
+	p.mu.Unlock()
+	p.logger.Debug("memcache: connection closed", "server", p.name, "reason", "error")
+	return pc.Close()
+}
+
+// discardLocked releases the slot of a checked out connection. p.mu
+// must be held.
+func (p *connPool) discardLocked() {
+	p.open--
+	p.inUse--
+	p.notifyFreeSlot()
+}
+
+// release closes all idle connections and makes the pool unusable.
+// Connections in use are closed when they're returned.
+func (p *connPool) release() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.stop)
+	idle := p.idle
+	p.idle = nil
+	p.open -= len(idle)
+	waiters := p.waiters
+	p.waiters = nil
+	p.mu.Unlock()
+
+	for _, req := range waiters {
+		close(req)
+	}
+	for _, pc := range idle {
+		p.closeConn(pc, "pool_closed")
+	}
+}
+
+// maintainer periodically closes the idle connections which expired and
+// dials new ones to keep at least InitialCap connections open. Aged
+// connections in use are left alone and closed when they're returned, so
+// recycling never interrupts a request. Replacements go through the pool
+// factory, authenticating with the current credentials.
+func (p *connPool) maintainer(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.maintain()
+		}
+	}
+}
+
+func (p *connPool) maintain() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	var expired []*poolConn
+	var reasons []string
+	idle := p.idle[:0]
+	for _, pc := range p.idle {
+		reason := p.expired(pc, now)
+		if reason == "" {
+			idle = append(idle, pc)
+			continue
+		}
+		expired = append(expired, pc)
+		reasons = append(reasons, reason)
+	}
+	for i := len(idle); i < len(p.idle); i++ {
+		p.idle[i] = nil
+	}
+	p.idle = idle
+	p.open -= len(expired)
+	need := p.initialCap - p.open
+	if p.maxCap > 0 && p.open+need > p.maxCap {
+		need = p.maxCap - p.open
+	}
+	if need > 0 {
+		p.open += need
+	}
+	p.mu.Unlock()
+
+	for i, pc := range expired {
+		p.closeConn(pc, reasons[i])
+	}
+	for ; need > 0; need-- {
+		conn, err := p.connect(context.Background())
+		if err != nil {
+			p.mu.Lock()
+			p.open -= need
+			for i := 0; i < need; i++ {
+				p.notifyFreeSlot()
+			}
+			p.mu.Unlock()
+			return
+		}
+		p.addIdle(p.newPoolConn(conn))
+	}
+}
+
+// addIdle adds a new connection, whose slot is already accounted for in
+// p.open, to the pool.
+func (p *connPool) addIdle(pc *poolConn) {
+	p.mu.Lock()
+	if p.closed {
+		p.open--
+		p.mu.Unlock()
+		p.closeConn(pc, "pool_closed")
+		return
+	}
+	if len(p.waiters) > 0 {
+		req := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		p.inUse++
+		p.mu.Unlock()
+		req <- pc
+		return
+	}
+	p.idle = append(p.idle, pc)
+	p.mu.Unlock()
+}
+
+// idleLen returns the number of idle connections.
+func (p *connPool) idleLen() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+func (p *connPool) poolStats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Server = p.name
+	stats.MaxOpen = p.maxCap
+	stats.Open = p.open
+	stats.InUse = p.inUse
+	stats.Idle = len(p.idle)
+	return stats
+}
@@ -0,0 +1,264 @@
+package memcache
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestPool(t *testing.T, config Config) (*connPool, *int32) {
+	var dials int32
+	p, err := newConnPool(config, func(ctx context.Context) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		client, server := net.Pipe()
+		go serveStubConn(server)
+		return client, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.release)
+	return p, &dials
+}
+
+func TestPoolReuse(t *testing.T) {
+	p, dials := newTestPool(t, Config{Server: "test", InitialCap: 1, MaxIdle: 2, MaxCap: 2})
+	if n := atomic.LoadInt32(dials); n != 1 {
+		t.Fatalf("dials after creation = %d, want InitialCap 1", n)
+	}
+	a, err := p.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := p.poolStats(); st.Open != 2 || st.InUse != 2 || st.Idle != 0 {
+		t.Errorf("stats with 2 in use = %+v", st)
+	}
+	p.put(a)
+	p.put(b)
+	if st := p.poolStats(); st.Open != 2 || st.InUse != 0 || st.Idle != 2 {
+		t.Errorf("stats with 2 idle = %+v", st)
+	}
+	if _, err := p.get(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(dials); n != 2 {
+		t.Errorf("dials = %d, want 2", n)
+	}
+}
+
+func TestPoolWait(t *testing.T) {
+	p, _ := newTestPool(t, Config{Server: "test", MaxIdle: 1, MaxCap: 1, PoolTimeout: 20 * time.Millisecond})
+	a, err := p.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.get(context.Background()); err != ErrPoolTimeout {
+		t.Fatalf("get at MaxCap = %v, want %v", err, ErrPoolTimeout)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.get(ctx); err != context.Canceled {
+		t.Fatalf("get with canceled context = %v, want %v", err, context.Canceled)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, err := p.get(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("get past the context deadline = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// A returned connection is handed over to the waiter.
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		p.put(a)
+	}()
+	b, err := p.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b != a {
+		t.Error("waiter didn't receive the returned connection")
+	}
+
+	// A discarded connection lets the waiter dial a new one.
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		p.discard(b)
+	}()
+	c, err := p.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == b {
+		t.Error("waiter received the discarded connection")
+	}
+
+	st := p.poolStats()
+	// The canceled wait isn't a timeout.
+	if st.WaitCount != 5 || st.WaitTimeouts != 2 || st.WaitDuration <= 0 {
+		t.Errorf("wait stats = %+v, want 5 waits and 2 timeouts", st)
+	}
+	if st.Open != 1 || st.InUse != 1 {
+		t.Errorf("stats = %+v, want 1 open connection in use", st)
+	}
+}
+
+func TestPoolExpiration(t *testing.T) {
+	p, dials := newTestPool(t, Config{Server: "test", MaxIdle: 1, MaxCap: 1, IdleTimeout: 10 * time.Millisecond})
+	a, _ := p.get(context.Background())
+	p.put(a)
+	time.Sleep(20 * time.Millisecond)
+	b, _ := p.get(context.Background())
+	if b == a || atomic.LoadInt32(dials) != 2 {
+		t.Error("connection idle for longer than IdleTimeout was reused")
+	}
+	p.put(b)
+	if st := p.poolStats(); st.IdleTimeoutClosed != 1 || st.Open != 1 {
+		t.Errorf("stats = %+v, want 1 idle timeout", st)
+	}
+
+	p, dials = newTestPool(t, Config{Server: "test", MaxIdle: 1, MaxCap: 1, MaxConnLifetime: 10 * time.Millisecond})
+	a, _ = p.get(context.Background())
+	time.Sleep(20 * time.Millisecond)
+	p.put(a)
+	b, _ = p.get(context.Background())
+	if b == a || atomic.LoadInt32(dials) != 2 {
+		t.Error("connection older than MaxConnLifetime was reused")
+	}
+	if st := p.poolStats(); st.MaxLifetimeClosed != 1 || st.Open != 1 {
+		t.Errorf("stats = %+v, want 1 lifetime expiration", st)
+	}
+}
+
+func TestPoolRelease(t *testing.T) {
+	p, _ := newTestPool(t, Config{Server: "test", MaxIdle: 1, MaxCap: 1})
+	a, _ := p.get(context.Background())
+	errc := make(chan error)
+	go func() {
+		_, err := p.get(context.Background())
+		errc <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	p.release()
+	if err := <-errc; err != ErrPoolClosed {
+		t.Errorf("waiting get after release = %v, want %v", err, ErrPoolClosed)
+	}
+	p.put(a)
+	if st := p.poolStats(); st.Open != 0 {
+		t.Errorf("open connections after release = %d, want 0", st.Open)
+	}
+	if _, err := p.get(context.Background()); err != ErrPoolClosed {
+		t.Errorf("get after release = %v, want %v", err, ErrPoolClosed)
+	}
+}
+
+func TestPoolCapacity(t *testing.T) {
+	for _, config := range []Config{
+		{InitialCap: 2, MaxIdle: 1, MaxCap: 2},
+		{MaxIdle: 3, MaxCap: 2},
+		{InitialCap: -1},
+	} {
+		if _, err := newConnPool(config, nil); err == nil {
+			t.Errorf("newConnPool(%+v) accepted invalid capacity", config)
+		}
+	}
+}
+
+func TestPoolValidation(t *testing.T) {
+	for _, config := range []Config{
+		{Server: "test", MaxIdle: 1, MaxCap: 1, ValidateConnections: true},
+		{Server: "test", MaxIdle: 1, MaxCap: 1, PingIdleAfter: time.Millisecond, ConnectionTimeout: time.Second},
+	} {
+		var servers []net.Conn
+		p, err := newConnPool(config, func(ctx context.Context) (net.Conn, error) {
+			client, server := net.Pipe()
+			servers = append(servers, server)
+			go serveStubConn(server)
+			return client, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.release()
+
+		a, _ := p.get(context.Background())
+		p.put(a)
+		time.Sleep(5 * time.Millisecond)
+		b, err := p.get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b != a {
+			t.Errorf("%+v: healthy idle connection was not reused", config)
+		}
+		p.put(b)
+
+		// Simulate a server restart.
+		servers[0].Close()
+		time.Sleep(5 * time.Millisecond)
+		c, err := p.get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c == a || len(servers) != 2 {
+			t.Errorf("%+v: dead idle connection was not replaced", config)
+		}
+		if err := sendConnCommand(c, "", cmdNoop, nil, 0, nil); err != nil {
+			t.Errorf("%+v: replacement connection: %v", config, err)
+		}
+		if st := p.poolStats(); st.ValidationClosed != 1 || st.Open != 1 {
+			t.Errorf("%+v: stats = %+v, want 1 connection closed by validation", config, st)
+		}
+	}
+}
+
+func TestPoolMaintainer(t *testing.T) {
+	p, dials := newTestPool(t, Config{
+		Server:              "test",
+		InitialCap:          2,
+		MaxIdle:             2,
+		MaxCap:              4,
+		MaxConnLifetime:     30 * time.Millisecond,
+		MaintenanceInterval: 5 * time.Millisecond,
+	})
+	p.mu.Lock()
+	for _, pc := range p.idle {
+		if d := pc.expiresAt.Sub(pc.createdAt); d < 27*time.Millisecond || d > 30*time.Millisecond {
+			t.Errorf("connection lifetime = %v, want between 27ms and 30ms", d)
+		}
+	}
+	p.mu.Unlock()
+
+	// Connections discarded after errors are reopened in the background.
+	a, _ := p.get(context.Background())
+	b, _ := p.get(context.Background())
+	p.discard(a)
+	p.discard(b)
+	time.Sleep(15 * time.Millisecond)
+	if st := p.poolStats(); st.Open != 2 || st.Idle != 2 {
+		t.Errorf("stats after discarding = %+v, want InitialCap idle connections", st)
+	}
+
+	// Aged idle connections are replaced, in use ones are left alone
+	// until they're returned.
+	inUse, _ := p.get(context.Background())
+	before := atomic.LoadInt32(dials)
+	time.Sleep(60 * time.Millisecond)
+	if n := atomic.LoadInt32(dials); n <= before {
+		t.Errorf("dials = %d, want aged connections to be replaced", n)
+	}
+	if err := sendConnCommand(inUse, "", cmdNoop, nil, 0, nil); err != nil {
+		t.Errorf("aged connection in use was closed: %v", err)
+	}
+	p.put(inUse)
+	time.Sleep(15 * time.Millisecond)
+	st := p.poolStats()
+	if st.MaxLifetimeClosed < 3 || st.Open < 2 || st.Idle != st.Open {
+		t.Errorf("stats after recycling = %+v, want aged connections replaced", st)
+	}
+}
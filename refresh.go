@@ -0,0 +1,99 @@
+package memcache
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrRefreshPending is returned by GetOrRefresh for a missing item whose
+// value another caller was told to compute and hasn't stored yet.
+var ErrRefreshPending = errors.New("memcache: item is being refreshed by another client")
+
+// defaultRefreshLockTime is the default RefreshOptions.LockTime.
+const defaultRefreshLockTime = 30
+
+// RefreshOptions configure the stale-while-revalidate reads of
+// GetOrRefresh.
+type RefreshOptions struct {
+	// LockTime is the expiration time, in the same format as
+	// Item.Expiration, of the empty item created on a miss until the
+	// caller told to compute the value stores it. It bounds the time
+	// other callers get ErrRefreshPending if that caller fails. Zero
+	// means 30 seconds.
+	LockTime int32
+
+	// Recache, if positive, makes a single caller refresh the item once
+	// its remaining TTL drops below Recache seconds, while the others
+	// keep getting its current value.
+	Recache int32
+}
+
+// GetOrRefresh gets the item for key, protecting the backing store from
+// stampedes when it's missing, stale or about to expire: a single caller
+// gets refresh set, and must compute the value and store it with
+// SetRefreshed, while the others get the stale value or, for a missing
+// item, ErrRefreshPending. Items are marked stale with Invalidate.
+//
+// The item returned along with refresh holds the stale value, or no
+// value for a missing item. The caller sets its Value, Flags and
+// Expiration before giving it to SetRefreshed.
+//
+// GetOrRefresh uses meta commands, and fails with ErrMetaUnsupported if
+// the server of key is configured with ProtocolBinary, the default: it
+// needs ProtocolMeta or ProtocolText, and memcached 1.6+. An empty value
+// can't be told from the empty item created on a miss, and is reported
+// with ErrRefreshPending while a refresh is pending.
+func (c *Client) GetOrRefresh(key string, opts RefreshOptions) (item *Item, refresh bool, err error) {
+	return c.GetOrRefreshContext(context.Background(), key, opts)
+}
+
+// GetOrRefreshContext is like GetOrRefresh, with a context as in
+// GetContext.
+func (c *Client) GetOrRefreshContext(ctx context.Context, key string, opts RefreshOptions) (item *Item, refresh bool, err error) {
+	lockTime := opts.LockTime
+	if lockTime == 0 {
+		lockTime = defaultRefreshLockTime
+	}
+	mi, err := c.MetaGetContext(ctx, key, MetaGetOptions{Vivify: true, Expiration: lockTime, Recache: opts.Recache})
+	if err != nil {
+		return nil, false, err
+	}
+	switch {
+	case mi.Won:
+		return &mi.Item, true, nil
+	case mi.WinPending && !mi.Stale && len(mi.Value) == 0:
+		return nil, false, ErrRefreshPending
+	}
+	return &mi.Item, false, nil
+}
+
+// SetRefreshed stores the item returned by GetOrRefresh along with
+// refresh, once the caller updated its value. If the item was
+// invalidated again meanwhile, it's stored anyway but still stale, so
+// that the next GetOrRefresh refreshes it again. ErrCASConflict is
+// returned if the item was otherwise modified, and ErrNotStored if it
+// was deleted.
+func (c *Client) SetRefreshed(item *Item) error {
+	return c.SetRefreshedContext(context.Background(), item)
+}
+
+// SetRefreshedContext is like SetRefreshed, with a context as in
+// GetContext.
+func (c *Client) SetRefreshedContext(ctx context.Context, item *Item) error {
+	return c.MetaSetContext(ctx, item, MetaSetOptions{CompareAndSwap: true, Invalidate: true})
+}
+
+// Invalidate marks the item for key as stale instead of deleting it, so
+// that the next GetOrRefresh is told to refresh it while the others keep
+// getting its value. expiration, if not zero, is the new expiration time
+// of the item, in the same format as Item.Expiration, bounding how long
+// it's served if it's never refreshed. ErrCacheMiss is returned if the
+// item isn't in the cache.
+func (c *Client) Invalidate(key string, expiration int32) error {
+	return c.InvalidateContext(context.Background(), key, expiration)
+}
+
+// InvalidateContext is like Invalidate, with a context as in GetContext.
+func (c *Client) InvalidateContext(ctx context.Context, key string, expiration int32) error {
+	return c.MetaDeleteContext(ctx, key, MetaDeleteOptions{Invalidate: true, Expiration: expiration})
+}
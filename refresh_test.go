@@ -0,0 +1,120 @@
+package memcache
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetOrRefresh(t *testing.T) {
+	c, clock := newClockedClient(t, ProtocolMeta)
+
+	// getAll calls GetOrRefresh concurrently and returns the item told
+	// to refresh, along with the values and errors of the others.
+	getAll := func(opts RefreshOptions) (winner *Item, values []string, errs []error) {
+		t.Helper()
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		winners := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				item, refresh, err := c.GetOrRefresh("hot", opts)
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case refresh:
+					winners++
+					winner = item
+				case err != nil:
+					errs = append(errs, err)
+				default:
+					values = append(values, string(item.Value))
+				}
+			}()
+		}
+		wg.Wait()
+		if winners > 1 {
+			t.Fatalf("%d callers told to refresh, want at most 1", winners)
+		}
+		return winner, values, errs
+	}
+
+	winner, values, errs := getAll(RefreshOptions{})
+	if winner == nil || len(winner.Value) != 0 || len(values) != 0 || len(errs) != 9 {
+		t.Fatalf("GetOrRefresh of a missing item = winner %+v, values %q, errors %v, want an empty winner and 9 errors", winner, values, errs)
+	}
+	for _, err := range errs {
+		if err != ErrRefreshPending {
+			t.Fatalf("GetOrRefresh error = %v, want ErrRefreshPending", err)
+		}
+	}
+	winner.Value, winner.Expiration = []byte("v1"), 100
+	if err := c.SetRefreshed(winner); err != nil {
+		t.Fatalf("SetRefreshed: %v", err)
+	}
+	if winner, values, _ = getAll(RefreshOptions{}); winner != nil || len(values) != 10 || values[0] != "v1" {
+		t.Fatalf("GetOrRefresh of a fresh item = winner %+v, values %q, want v1 without a winner", winner, values)
+	}
+
+	if err := c.Invalidate("hot", 0); err != nil {
+		t.Fatalf("Invalidate: %v", err)
+	}
+	winner, values, errs = getAll(RefreshOptions{})
+	if winner == nil || string(winner.Value) != "v1" || len(values) != 9 || values[0] != "v1" || len(errs) != 0 {
+		t.Fatalf("GetOrRefresh of a stale item = winner %+v, values %q, errors %v, want the stale v1 for all", winner, values, errs)
+	}
+	// An invalidation racing with the refresh keeps the item stale.
+	if err := c.Invalidate("hot", 0); err != nil {
+		t.Fatal(err)
+	}
+	winner.Value = []byte("v2")
+	if err := c.SetRefreshed(winner); err != nil {
+		t.Fatalf("SetRefreshed after another invalidation: %v", err)
+	}
+	winner, _, _ = getAll(RefreshOptions{})
+	if winner == nil || string(winner.Value) != "v2" {
+		t.Fatalf("GetOrRefresh after a racing invalidation = winner %+v, want v2 to refresh", winner)
+	}
+	winner.Value, winner.Expiration = []byte("v3"), 100
+	if err := c.SetRefreshed(winner); err != nil {
+		t.Fatal(err)
+	}
+
+	if winner, _, _ = getAll(RefreshOptions{Recache: 30}); winner != nil {
+		t.Fatalf("GetOrRefresh with recache of a fresh item = winner %+v, want none", winner)
+	}
+	clock.Advance(80 * time.Second)
+	if winner, values, _ = getAll(RefreshOptions{Recache: 30}); winner == nil || len(values) != 9 || values[0] != "v3" {
+		t.Fatalf("GetOrRefresh with recache of an expiring item = winner %+v, values %q, want a winner and v3 for the others", winner, values)
+	}
+
+	if err := c.Invalidate("missing", 0); err != ErrCacheMiss {
+		t.Errorf("Invalidate of a missing key = %v, want ErrCacheMiss", err)
+	}
+	if _, _, err := newLocalhostServer(t).GetOrRefresh("hot", RefreshOptions{}); err != ErrMetaUnsupported {
+		t.Errorf("GetOrRefresh over the binary protocol = %v, want ErrMetaUnsupported", err)
+	}
+}
+
+func TestGetOrRefreshText(t *testing.T) {
+	c, _ := newClockedClient(t, ProtocolText)
+	item, refresh, err := c.GetOrRefresh("hot", RefreshOptions{})
+	if err != nil || !refresh {
+		t.Fatalf("GetOrRefresh over the text protocol = %v, %v, want a refresh", refresh, err)
+	}
+	item.Value, item.Expiration = []byte("v1"), 100
+	if err := c.SetRefreshed(item); err != nil {
+		t.Fatalf("SetRefreshed over the text protocol: %v", err)
+	}
+	if it, err := c.Get("hot"); err != nil || string(it.Value) != "v1" {
+		t.Fatalf("Get of the refreshed item = %v, %v, want v1", it, err)
+	}
+	if err := c.Invalidate("hot", 0); err != nil {
+		t.Fatalf("Invalidate over the text protocol: %v", err)
+	}
+	if item, refresh, err = c.GetOrRefresh("hot", RefreshOptions{}); err != nil || !refresh || string(item.Value) != "v1" {
+		t.Errorf("GetOrRefresh of an invalidated item over the text protocol = %+v, %v, %v, want a refresh of v1", item, refresh, err)
+	}
+}
@@ -0,0 +1,333 @@
+// Package replay records the binary protocol traffic of a Client and
+// replays it later, so that production cache behavior can be reproduced
+// in tests without a memcached server.
+//
+// A Recorder wraps the connections opened by a Client through its
+// Config.Dialer and writes every request and response frame to a file,
+// one JSON object per line. A Replayer reads such a file and serves a
+// Client the recorded responses to the requests it sends:
+//
+//	rec := replay.NewRecorder(f)
+//	client, err := memcache.New([]memcache.Config{{
+//		Server: "cache:11211",
+//		Dialer: rec.Dialer(nil),
+//	}})
+//
+// Frames are recorded as they're written on the dialed connections, so
+// servers using TLS can't be recorded. The values of SASL requests are
+// redacted, which only allows replaying PLAIN authentications.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Dialer opens connections to memcached servers, as Config.Dialer.
+type Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Direction tells whether a frame was sent to or received from a server.
+type Direction string
+
+// Directions of the frames.
+const (
+	Request  Direction = "request"
+	Response Direction = "response"
+)
+
+// Record is a binary protocol frame exchanged with a server.
+type Record struct {
+	// Time is when the frame was fully written or read.
+	Time time.Time `json:"time"`
+
+	// Server is the address of the server, as in Config.Server.
+	Server string `json:"server"`
+
+	// Conn numbers the connections of a recording, starting at 1.
+	Conn int `json:"conn"`
+
+	// Dir is the direction of the frame.
+	Dir Direction `json:"dir"`
+
+	// Frame is the 24 bytes header of the frame followed by its body.
+	Frame []byte `json:"frame"`
+}
+
+// headerLen is the size of a binary protocol header.
+const headerLen = 24
+
+// ReadRecords reads the records written by a Recorder.
+func ReadRecords(r io.Reader) ([]Record, error) {
+	var records []Record
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(rec.Frame) < headerLen {
+			return nil, fmt.Errorf("replay: frame of %d bytes is shorter than a header", len(rec.Frame))
+		}
+		records = append(records, rec)
+	}
+}
+
+// framer splits a byte stream into frames.
+type framer struct {
+	buf []byte
+}
+
+// write appends p to the stream and calls emit for every frame
+// completed.
+func (f *framer) write(p []byte, emit func(frame []byte)) {
+	f.buf = append(f.buf, p...)
+	for len(f.buf) >= headerLen {
+		n := headerLen + int(binary.BigEndian.Uint32(f.buf[8:12]))
+		if len(f.buf) < n {
+			return
+		}
+		emit(append([]byte(nil), f.buf[:n]...))
+		f.buf = f.buf[n:]
+	}
+}
+
+// SASL opcodes, whose requests carry credentials.
+const (
+	opSASLAuth = 0x21
+	opSASLStep = 0x22
+)
+
+// redacted replaces the value of the SASL requests.
+var redacted = []byte("REDACTED")
+
+// redact returns frame with its credentials removed.
+func redact(frame []byte) []byte {
+	if op := frame[1]; op != opSASLAuth && op != opSASLStep {
+		return frame
+	}
+	kl := int(binary.BigEndian.Uint16(frame[2:4]))
+	el := int(frame[4])
+	if headerLen+el+kl > len(frame) {
+		return frame
+	}
+	out := append([]byte(nil), frame[:headerLen+el+kl]...)
+	out = append(out, redacted...)
+	binary.BigEndian.PutUint32(out[8:12], uint32(el+kl+len(redacted)))
+	return out
+}
+
+// Recorder writes the frames exchanged on the connections it dials.
+type Recorder struct {
+	mu    sync.Mutex
+	enc   *json.Encoder
+	conns int
+	err   error
+	now   func() time.Time
+}
+
+// NewRecorder returns a Recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w), now: time.Now}
+}
+
+// Dialer returns a Dialer recording the connections opened by dial. A
+// nil dial opens them with a net.Dialer.
+func (r *Recorder) Dialer(dial Dialer) Dialer {
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		r.mu.Lock()
+		r.conns++
+		id := r.conns
+		r.mu.Unlock()
+		return &recordConn{Conn: conn, r: r, server: addr, id: id}, nil
+	}
+}
+
+// Err returns the first error met writing the records.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) record(server string, conn int, dir Direction, frame []byte) {
+	if dir == Request {
+		frame = redact(frame)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	r.err = r.enc.Encode(Record{Time: r.now(), Server: server, Conn: conn, Dir: dir, Frame: frame})
+}
+
+type recordConn struct {
+	net.Conn
+	r      *Recorder
+	server string
+	id     int
+
+	requests, responses framer
+}
+
+func (c *recordConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.responses.write(p[:n], func(frame []byte) {
+		c.r.record(c.server, c.id, Response, frame)
+	})
+	return n, err
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.requests.write(p[:n], func(frame []byte) {
+		c.r.record(c.server, c.id, Request, frame)
+	})
+	return n, err
+}
+
+// exchange is a recorded request and the responses read after it, up to
+// the next request on the same connection.
+type exchange struct {
+	request   []byte
+	responses [][]byte
+	used      bool
+}
+
+// Replayer serves recorded responses to the connections it dials.
+// Requests are matched, byte for byte, with the first recorded request
+// to the same server which wasn't replayed yet, whatever the connection
+// it was recorded on. Responses to pipelined quiet requests are served
+// after the request they were read after, usually the final noop.
+type Replayer struct {
+	mu        sync.Mutex
+	exchanges map[string][]*exchange
+	err       error
+}
+
+// NewReplayer returns a Replayer serving records, as returned by
+// ReadRecords.
+func NewReplayer(records []Record) *Replayer {
+	p := &Replayer{exchanges: make(map[string][]*exchange)}
+	last := make(map[int]*exchange)
+	for _, rec := range records {
+		switch rec.Dir {
+		case Request:
+			e := &exchange{request: rec.Frame}
+			p.exchanges[rec.Server] = append(p.exchanges[rec.Server], e)
+			last[rec.Conn] = e
+		case Response:
+			if e := last[rec.Conn]; e != nil {
+				e.responses = append(e.responses, rec.Frame)
+			}
+		}
+	}
+	return p
+}
+
+// Dialer returns a Dialer whose connections are served by p.
+func (p *Replayer) Dialer() Dialer {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go p.serve(addr, server)
+		return client, nil
+	}
+}
+
+// Err returns an error for the first request which matched no recorded
+// one. Its connection was closed without a response.
+func (p *Replayer) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Unused returns the number of recorded requests which weren't replayed.
+func (p *Replayer) Unused() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, exchanges := range p.exchanges {
+		for _, e := range exchanges {
+			if !e.used {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// match returns the responses to request, marking its exchange as used.
+func (p *Replayer) match(server string, request []byte) ([][]byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range p.exchanges[server] {
+		if !e.used && bytes.Equal(e.request, request) {
+			e.used = true
+			return e.responses, true
+		}
+	}
+	if p.err == nil {
+		p.err = fmt.Errorf("replay: no recorded request to %s matches opcode %#x frame %x", server, request[1], request)
+	}
+	return nil, false
+}
+
+func (p *Replayer) serve(server string, conn net.Conn) {
+	// Responses are written from their own goroutine so that a client
+	// pipelining requests is never blocked by the synchronous pipe.
+	out := make(chan []byte, 1024)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for frame := range out {
+			if _, err := conn.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+	defer func() {
+		conn.Close()
+		close(out)
+		<-done
+	}()
+
+	var requests framer
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		ok := true
+		requests.write(buf[:n], func(frame []byte) {
+			if !ok {
+				return
+			}
+			var responses [][]byte
+			if responses, ok = p.match(server, redact(frame)); ok {
+				for _, resp := range responses {
+					out <- resp
+				}
+			}
+		})
+		if err != nil || !ok {
+			return
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package replay_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dev-lazarev/memcache"
+	"github.com/dev-lazarev/memcache/memtest"
+	"github.com/dev-lazarev/memcache/replay"
+)
+
+// session runs a few commands on c and returns their results.
+func session(t *testing.T, c *memcache.Client) []interface{} {
+	var results []interface{}
+	add := func(v ...interface{}) { results = append(results, v...) }
+
+	add(c.Set(&memcache.Item{Key: "foo", Value: []byte("fooval"), Flags: 7}))
+	add(c.Set(&memcache.Item{Key: "bar", Value: []byte("barval")}))
+	it, err := c.Get("foo")
+	add(err)
+	if it != nil {
+		add(it.Key, string(it.Value), it.Flags)
+	}
+	_, err = c.Get("missing")
+	add(err)
+	items, err := c.GetMulti([]string{"foo", "bar", "missing"})
+	add(err, len(items))
+	for _, key := range []string{"foo", "bar"} {
+		if it := items[key]; it != nil {
+			add(string(it.Value))
+		}
+	}
+	add(c.IncrementWithDefault("n", 1, 5, 0))
+	add(c.Increment("n", 2))
+	add(c.IncrementQ([]string{"n", "m"}, 1, 0, 0))
+	add(c.Delete("foo"))
+	add(c.Delete("foo"))
+	return results
+}
+
+func newClient(t *testing.T, server string, dialer replay.Dialer) *memcache.Client {
+	c, err := memcache.New([]memcache.Config{{
+		Server:            server,
+		User:              "user",
+		Password:          "secret",
+		MaxIdle:           2,
+		MaxCap:            2,
+		ConnectionTimeout: time.Second,
+		Dialer:            dialer,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRecordReplay(t *testing.T) {
+	s := memtest.NewUnstartedServer()
+	s.User, s.Password = "user", "secret"
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var buf bytes.Buffer
+	rec := replay.NewRecorder(&buf)
+	c := newClient(t, s.Addr, rec.Dialer(nil))
+	want := session(t, c)
+	c.Close()
+	if err := rec.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("secret")) || bytes.Contains(buf.Bytes(), []byte("c2VjcmV0")) {
+		t.Error("recording contains the password")
+	}
+
+	records, err := replay.ReadRecords(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) == 0 {
+		t.Fatal("nothing recorded")
+	}
+	for _, r := range records {
+		if r.Server != s.Addr || r.Conn < 1 || r.Time.IsZero() {
+			t.Fatalf("bad record %+v", r)
+		}
+	}
+
+	// The server is gone, every response comes from the recording.
+	s.Close()
+	p := replay.NewReplayer(records)
+	c = newClient(t, s.Addr, p.Dialer())
+	defer c.Close()
+	got := session(t, c)
+	if err := p.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed session = %v, want %v", got, want)
+	}
+	if n := p.Unused(); n != 0 {
+		t.Errorf("%d recorded requests not replayed", n)
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	s := memtest.NewServer()
+	defer s.Close()
+	var buf bytes.Buffer
+	rec := replay.NewRecorder(&buf)
+	c, err := memcache.New([]memcache.Config{{Server: s.Addr, MaxIdle: 1, MaxCap: 1, Dialer: rec.Dialer(nil)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("foo"); err != memcache.ErrCacheMiss {
+		t.Fatalf("Get(foo) = %v, want ErrCacheMiss", err)
+	}
+	c.Close()
+
+	records, err := replay.ReadRecords(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := replay.NewReplayer(records)
+	c, err = memcache.New([]memcache.Config{{Server: s.Addr, MaxIdle: 1, MaxCap: 1, Dialer: p.Dialer()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Get("bar"); err == nil {
+		t.Error("Get(bar) succeeded without a recorded response")
+	}
+	if p.Err() == nil {
+		t.Error("Err() = nil after an unmatched request")
+	}
+}
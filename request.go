@@ -0,0 +1,116 @@
+package memcache
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// request tracks a Client operation on a single server, reporting it to
+// the Tracer, the Observer, OnSlowOp and the server status once it ends.
+type request struct {
+	c           *Client
+	op          string
+	serverIndex uint32
+	// key is the key of single key operations, keys those of batches.
+	key   string
+	keys  []string
+	start time.Time
+	span  Span
+
+	// cn, acquiredAt, sentAt and firstByteAt time the phases of the
+	// request, they're only set if SlowOpThreshold is. cn is the
+	// connection from acquired until released.
+	cn          *poolConn
+	acquiredAt  time.Time
+	sentAt      time.Time
+	firstByteAt time.Time
+}
+
+// startRequest begins tracking the operation op on key, sent to the
+// server at serverIndex. The returned context holds the operation span,
+// if a Tracer is set.
+func (c *Client) startRequest(ctx context.Context, op string, serverIndex uint32, key string) (context.Context, request) {
+	r := request{c: c, op: op, serverIndex: serverIndex, key: key, start: time.Now()}
+	ctx = r.begin(ctx, spanPrefix+op)
+	return ctx, r
+}
+
+// startServerRequest is like startRequest, for the part of a batch
+// operation sent to a single server. Its span is named after op with a
+// ".server" suffix, to tell it apart from the span of the batch.
+func (c *Client) startServerRequest(ctx context.Context, op string, serverIndex uint32, keys []string) (context.Context, request) {
+	r := request{c: c, op: op, serverIndex: serverIndex, keys: keys, start: time.Now()}
+	ctx = r.begin(ctx, spanPrefix+op+".server")
+	return ctx, r
+}
+
+// begin counts the request as in flight and starts its span, named
+// name, if a Tracer is set.
+func (r *request) begin(ctx context.Context, name string) context.Context {
+	atomic.AddInt32(&r.c.health(r.serverIndex).inFlight, 1)
+	if r.c.Tracer != nil {
+		ctx, r.span = r.c.startSpan(ctx, name, r.op, r.keyCount())
+		r.span.SetAttributes(Attribute{AttrServer, r.c.servers.Name(r.serverIndex)})
+	}
+	return ctx
+}
+
+// keyCount returns the number of keys sent to the server.
+func (r *request) keyCount() int {
+	if r.keys == nil && r.key != "" {
+		return 1
+	}
+	return len(r.keys)
+}
+
+// acquired records that the connection cn was checked out.
+func (r *request) acquired(cn *poolConn) {
+	if r.c.SlowOpThreshold <= 0 {
+		return
+	}
+	r.cn = cn
+	r.acquiredAt = time.Now()
+	cn.firstByteAt = time.Time{}
+	cn.timeFirstByte = true
+}
+
+// sent records that the request was written.
+func (r *request) sent() {
+	if r.cn != nil {
+		r.sentAt = time.Now()
+	}
+}
+
+// released records that the connection was given back, copying its
+// timings since it may be checked out by another request right away.
+func (r *request) released() {
+	if r.cn == nil {
+		return
+	}
+	r.firstByteAt = r.cn.firstByteAt
+	r.cn.timeFirstByte = false
+	r.cn = nil
+}
+
+// end completes the request. hits and bytes are only meaningful for
+// retrievals and storage commands, respectively.
+func (r *request) end(hits, bytes int, err error) {
+	keys := r.keyCount()
+	if r.span != nil {
+		if r.op == OpGet || r.op == OpGetMulti || r.op == OpGetAndTouch || r.op == OpMetaGet {
+			r.span.SetAttributes(Attribute{AttrHits, hits}, Attribute{AttrMisses, keys - hits})
+		}
+		if bytes > 0 {
+			r.span.SetAttributes(Attribute{AttrBytes, bytes})
+		}
+		endSpan(r.span, err)
+	}
+	r.c.observeRequest(r.op, r.serverIndex, keys, hits, bytes, r.start, err)
+	h := r.c.health(r.serverIndex)
+	atomic.AddInt32(&h.inFlight, -1)
+	h.record(time.Since(r.start), err)
+	if r.c.SlowOpThreshold > 0 {
+		r.reportIfSlow(bytes, err)
+	}
+}
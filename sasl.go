@@ -0,0 +1,320 @@
+package memcache
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrNoSASLMechanism is returned when credentials are configured but
+	// the server doesn't advertise any of the accepted SASL mechanisms.
+	ErrNoSASLMechanism = errors.New("memcache: no supported SASL mechanism advertised by server")
+
+	// ErrSASLServerSignature is returned when a SCRAM server fails to
+	// prove that it knows the password.
+	ErrSASLServerSignature = errors.New("memcache: invalid SASL server signature")
+)
+
+// DefaultSASLMechanisms is the SASL mechanism preference used when
+// Config.SASLMechanisms is empty, strongest first.
+var DefaultSASLMechanisms = []string{
+	"SCRAM-SHA-512",
+	"SCRAM-SHA-256",
+	"SCRAM-SHA-1",
+	"CRAM-MD5",
+	"PLAIN",
+}
+
+// saslClient is the client side of a SASL mechanism.
+type saslClient interface {
+	// Start returns the initial response, sent along with the
+	// mechanism name in the auth start command.
+	Start() ([]byte, error)
+	// Next returns the response to a server challenge, sent with
+	// an auth step command.
+	Next(challenge []byte) ([]byte, error)
+	// Done verifies the data sent by the server along with its
+	// final success response.
+	Done(data []byte) error
+}
+
+var saslMechanisms = map[string]func(user, password string) saslClient{
+	"PLAIN":         newPlainClient,
+	"CRAM-MD5":      newCRAMMD5Client,
+	"SCRAM-SHA-1":   func(user, password string) saslClient { return newSCRAMClient(sha1.New, user, password) },
+	"SCRAM-SHA-256": func(user, password string) saslClient { return newSCRAMClient(sha256.New, user, password) },
+	"SCRAM-SHA-512": func(user, password string) saslClient { return newSCRAMClient(sha512.New, user, password) },
+}
+
+// checkSASLMechanisms returns an error if any of the given mechanisms
+// is not implemented by this package.
+func checkSASLMechanisms(mechanisms []string) error {
+	for _, mech := range mechanisms {
+		if saslMechanisms[mech] == nil {
+			return fmt.Errorf("memcache: unsupported SASL mechanism %q", mech)
+		}
+	}
+	return nil
+}
+
+// selectSASLMechanism returns the first of the preferred mechanisms
+// found in the space separated list advertised by the server.
+func selectSASLMechanism(preferred []string, advertised string) (string, error) {
+	if len(preferred) == 0 {
+		preferred = DefaultSASLMechanisms
+	}
+	available := strings.Fields(advertised)
+	for _, mech := range preferred {
+		for _, a := range available {
+			if a == mech {
+				return mech, nil
+			}
+		}
+	}
+	return "", ErrNoSASLMechanism
+}
+
+// authenticate runs a SASL exchange on cn, using the first of the
+// preferred mechanisms supported by the server.
+func authenticate(cn net.Conn, preferred []string, creds Credentials) error {
+	if err := sendConnCommand(cn, "", opAuthList, nil, 0, nil); err != nil {
+		return err
+	}
+	_, _, _, value, err := parseResponse("", cn, maxControlResponseSize)
+	if err != nil {
+		return err
+	}
+	mech, err := selectSASLMechanism(preferred, string(value))
+	if err != nil {
+		return err
+	}
+	client := saslMechanisms[mech](creds.User, creds.Password)
+	data, err := client.Start()
+	if err != nil {
+		return err
+	}
+	cmd := opAuthStart
+	for {
+		if err = sendConnCommand(cn, mech, cmd, data, 0, nil); err != nil {
+			return err
+		}
+		_, _, _, value, err = parseResponse(mech, cn, maxControlResponseSize)
+		switch err {
+		case nil:
+			return client.Done(value)
+		case response(respAuthContinue):
+			if data, err = client.Next(value); err != nil {
+				return err
+			}
+			cmd = opAuthStep
+		default:
+			return fmt.Errorf("memcache: SASL %s authentication failed: %w", mech, err)
+		}
+	}
+}
+
+type plainClient struct {
+	user     string
+	password string
+}
+
+func newPlainClient(user, password string) saslClient {
+	return &plainClient{user: user, password: password}
+}
+
+func (c *plainClient) Start() ([]byte, error) {
+	return []byte("\x00" + c.user + "\x00" + c.password), nil
+}
+
+func (c *plainClient) Next(challenge []byte) ([]byte, error) {
+	return nil, errors.New("memcache: unexpected SASL PLAIN challenge")
+}
+
+func (c *plainClient) Done(data []byte) error {
+	return nil
+}
+
+// cramMD5Client implements CRAM-MD5, as described in RFC 2195.
+type cramMD5Client struct {
+	user     string
+	password string
+}
+
+func newCRAMMD5Client(user, password string) saslClient {
+	return &cramMD5Client{user: user, password: password}
+}
+
+func (c *cramMD5Client) Start() ([]byte, error) {
+	return nil, nil
+}
+
+func (c *cramMD5Client) Next(challenge []byte) ([]byte, error) {
+	mac := hmac.New(md5.New, []byte(c.password))
+	mac.Write(challenge)
+	return []byte(c.user + " " + hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+func (c *cramMD5Client) Done(data []byte) error {
+	return nil
+}
+
+// scramClient implements the SCRAM family of mechanisms without channel
+// binding, as described in RFC 5802 and RFC 7677.
+type scramClient struct {
+	hash     func() hash.Hash
+	user     string
+	password string
+	nonce    string
+
+	step            int
+	clientFirstBare string
+	serverSignature []byte
+}
+
+// scramNonce returns a new random client nonce. Tests replace it to
+// obtain reproducible exchanges.
+var scramNonce = func() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(b), nil
+}
+
+// maxSCRAMIterations bounds the iteration count asked by a server, so
+// that a hostile one can't pin a CPU on every new connection.
+const maxSCRAMIterations = 1 << 20
+
+func newSCRAMClient(h func() hash.Hash, user, password string) saslClient {
+	return &scramClient{hash: h, user: user, password: password}
+}
+
+func (c *scramClient) Start() ([]byte, error) {
+	nonce, err := scramNonce()
+	if err != nil {
+		return nil, err
+	}
+	c.nonce = nonce
+	user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(c.user)
+	c.clientFirstBare = "n=" + user + ",r=" + c.nonce
+	c.step = 1
+	return []byte("n,," + c.clientFirstBare), nil
+}
+
+func (c *scramClient) Next(challenge []byte) ([]byte, error) {
+	switch c.step {
+	case 1:
+		c.step++
+		return c.clientFinal(challenge)
+	case 2:
+		// Some servers send their final message as a challenge,
+		// expecting an empty response before reporting success.
+		c.step++
+		return []byte{}, c.Done(challenge)
+	}
+	return nil, errors.New("memcache: unexpected SCRAM challenge")
+}
+
+func (c *scramClient) clientFinal(serverFirst []byte) ([]byte, error) {
+	var nonce, salt string
+	var iterations int
+	for _, attr := range strings.Split(string(serverFirst), ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt = attr[2:]
+		case 'i':
+			iterations, _ = strconv.Atoi(attr[2:])
+		case 'e':
+			return nil, fmt.Errorf("memcache: SCRAM server error: %s", attr[2:])
+		}
+	}
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return nil, errors.New("memcache: invalid SCRAM server nonce")
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return nil, fmt.Errorf("memcache: invalid SCRAM salt: %v", err)
+	}
+	if iterations <= 0 || iterations > maxSCRAMIterations {
+		return nil, errors.New("memcache: invalid SCRAM iteration count")
+	}
+
+	// "biws" is the base64 encoding of the "n,," GS2 header.
+	clientFinalBare := "c=biws,r=" + nonce
+	authMessage := []byte(c.clientFirstBare + "," + string(serverFirst) + "," + clientFinalBare)
+
+	saltedPassword := pbkdf2(c.hash, []byte(c.password), saltBytes, iterations)
+	clientKey := c.hmac(saltedPassword, []byte("Client Key"))
+	h := c.hash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+	proof := c.hmac(storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	serverKey := c.hmac(saltedPassword, []byte("Server Key"))
+	c.serverSignature = c.hmac(serverKey, authMessage)
+
+	return []byte(clientFinalBare + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func (c *scramClient) Done(data []byte) error {
+	s := string(data)
+	switch {
+	case strings.HasPrefix(s, "e="):
+		return fmt.Errorf("memcache: SCRAM server error: %s", s[2:])
+	case strings.HasPrefix(s, "v="):
+		sig, err := base64.StdEncoding.DecodeString(s[2:])
+		if err != nil || c.serverSignature == nil || !hmac.Equal(sig, c.serverSignature) {
+			return ErrSASLServerSignature
+		}
+	case len(s) >= 2 && s[1] == '=':
+		// A server final message without the signature.
+		return ErrSASLServerSignature
+	}
+	// memcached answers a successful exchange with "Authenticated",
+	// dropping the server final message, so it can't always be verified.
+	return nil
+}
+
+func (c *scramClient) hmac(key, data []byte) []byte {
+	mac := hmac.New(c.hash, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pbkdf2 implements the Hi function from RFC 5802, which is PBKDF2 with
+// HMAC as the pseudorandom function and a single block of output.
+func pbkdf2(h func() hash.Hash, password, salt []byte, iterations int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
@@ -0,0 +1,243 @@
+package memcache
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func testSCRAMNonce(t *testing.T, nonce string) {
+	prev := scramNonce
+	scramNonce = func() (string, error) { return nonce, nil }
+	t.Cleanup(func() { scramNonce = prev })
+}
+
+// Test vectors from RFC 5802, section 5 and RFC 7677, section 3.
+var scramTests = []struct {
+	mech        string
+	nonce       string
+	serverFirst string
+	clientFinal string
+	serverFinal string
+}{
+	{
+		mech:        "SCRAM-SHA-1",
+		nonce:       "fyko+d2lbbFgONRv9qkxdawL",
+		serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+		clientFinal: "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+		serverFinal: "v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+	},
+	{
+		mech:        "SCRAM-SHA-256",
+		nonce:       "rOprNGfwEbeRWgbNEkqO",
+		serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+	},
+}
+
+func TestSCRAMClient(t *testing.T) {
+	for _, tt := range scramTests {
+		testSCRAMNonce(t, tt.nonce)
+		c := saslMechanisms[tt.mech]("user", "pencil")
+		first, err := c.Start()
+		if err != nil {
+			t.Fatalf("%s: Start: %v", tt.mech, err)
+		}
+		if g, e := string(first), "n,,n=user,r="+tt.nonce; g != e {
+			t.Errorf("%s: client first = %q, want %q", tt.mech, g, e)
+		}
+		final, err := c.Next([]byte(tt.serverFirst))
+		if err != nil {
+			t.Fatalf("%s: Next: %v", tt.mech, err)
+		}
+		if g, e := string(final), tt.clientFinal; g != e {
+			t.Errorf("%s: client final = %q, want %q", tt.mech, g, e)
+		}
+		if err := c.Done([]byte(tt.serverFinal)); err != nil {
+			t.Errorf("%s: Done: %v", tt.mech, err)
+		}
+		if err := c.Done([]byte("v=AAAA")); err != ErrSASLServerSignature {
+			t.Errorf("%s: Done with bad signature = %v, want %v", tt.mech, err, ErrSASLServerSignature)
+		}
+		if err := c.Done([]byte("x=unsigned")); err != ErrSASLServerSignature {
+			t.Errorf("%s: Done with an unsigned final message = %v, want %v", tt.mech, err, ErrSASLServerSignature)
+		}
+		if err := c.Done([]byte("Authenticated")); err != nil {
+			t.Errorf("%s: Done with memcached's answer = %v, want nil", tt.mech, err)
+		}
+	}
+}
+
+func TestSCRAMIterationLimit(t *testing.T) {
+	testSCRAMNonce(t, "nonce")
+	for _, iterations := range []string{"0", "-1", "1048577", "2147483647"} {
+		c := saslMechanisms["SCRAM-SHA-256"]("user", "pencil")
+		if _, err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Next([]byte("r=nonceserver,s=QSXCR+Q6sek8bf92,i=" + iterations)); err == nil {
+			t.Errorf("Next with %s iterations succeeded, want an error", iterations)
+		}
+	}
+}
+
+func TestCRAMMD5Client(t *testing.T) {
+	// Test vector from RFC 2195, section 2.
+	c := newCRAMMD5Client("tim", "tanstaaftanstaaf")
+	resp, err := c.Next([]byte("<1896.697170952@postoffice.reston.mci.net>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(resp), "tim b913a602c7eda7a495b4e6e7334d3890"; g != e {
+		t.Errorf("CRAM-MD5 response = %q, want %q", g, e)
+	}
+}
+
+func TestSelectSASLMechanism(t *testing.T) {
+	tests := []struct {
+		preferred  []string
+		advertised string
+		want       string
+		err        error
+	}{
+		{nil, "PLAIN", "PLAIN", nil},
+		{nil, "CRAM-MD5 PLAIN SCRAM-SHA-1", "SCRAM-SHA-1", nil},
+		{[]string{"PLAIN", "SCRAM-SHA-256"}, "SCRAM-SHA-256 PLAIN", "PLAIN", nil},
+		{[]string{"SCRAM-SHA-512"}, "PLAIN CRAM-MD5", "", ErrNoSASLMechanism},
+		{nil, "", "", ErrNoSASLMechanism},
+	}
+	for _, tt := range tests {
+		mech, err := selectSASLMechanism(tt.preferred, tt.advertised)
+		if mech != tt.want || err != tt.err {
+			t.Errorf("selectSASLMechanism(%v, %q) = %q, %v, want %q, %v", tt.preferred, tt.advertised, mech, err, tt.want, tt.err)
+		}
+	}
+	if err := checkSASLMechanisms([]string{"PLAIN", "GSSAPI"}); err == nil {
+		t.Error("checkSASLMechanisms accepted GSSAPI")
+	}
+}
+
+// saslExchange is a scripted server side of a SASL exchange: for each
+// expected request value it answers with the given status and value.
+type saslExchange struct {
+	request string
+	status  uint16
+	value   string
+}
+
+func serveSASL(t *testing.T, cn net.Conn, mechanisms string, script []saslExchange) {
+	defer cn.Close()
+	reply := func(cmd byte, status uint16, value string) {
+		hdr := make([]byte, 24)
+		hdr[0] = respMagic
+		hdr[1] = cmd
+		putUint16(hdr[6:8], status)
+		putUint32(hdr[8:12], uint32(len(value)))
+		cn.Write(append(hdr, value...))
+	}
+	read := func() (byte, string, string) {
+		hdr := make([]byte, 24)
+		if _, err := io.ReadFull(cn, hdr); err != nil {
+			t.Errorf("reading request header: %v", err)
+			return 0, "", ""
+		}
+		body := make([]byte, bUint32(hdr[8:12]))
+		if _, err := io.ReadFull(cn, body); err != nil {
+			t.Errorf("reading request body: %v", err)
+			return 0, "", ""
+		}
+		kl := int(bUint16(hdr[2:4]))
+		return hdr[1], string(body[:kl]), string(body[kl:])
+	}
+	if cmd, _, _ := read(); cmd != byte(opAuthList) {
+		t.Errorf("first command = %#x, want auth list", cmd)
+		return
+	}
+	reply(byte(opAuthList), respOk, mechanisms)
+	for _, ex := range script {
+		cmd, _, value := read()
+		if value != ex.request {
+			t.Errorf("SASL request = %q, want %q", value, ex.request)
+		}
+		reply(cmd, ex.status, ex.value)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	tt := scramTests[1]
+	testSCRAMNonce(t, tt.nonce)
+	tests := []struct {
+		name       string
+		preferred  []string
+		creds      Credentials
+		mechanisms string
+		script     []saslExchange
+		err        bool
+	}{
+		{
+			name:       "plain",
+			creds:      Credentials{User: "user", Password: "pencil"},
+			mechanisms: "PLAIN",
+			script:     []saslExchange{{"\x00user\x00pencil", respOk, "Authenticated"}},
+		},
+		{
+			name:       "scram",
+			creds:      Credentials{User: "user", Password: "pencil"},
+			mechanisms: "PLAIN SCRAM-SHA-256",
+			script: []saslExchange{
+				{"n,,n=user,r=" + tt.nonce, respAuthContinue, tt.serverFirst},
+				{tt.clientFinal, respOk, "Authenticated"},
+			},
+		},
+		{
+			name:       "scram final challenge",
+			creds:      Credentials{User: "user", Password: "pencil"},
+			mechanisms: "SCRAM-SHA-256",
+			script: []saslExchange{
+				{"n,,n=user,r=" + tt.nonce, respAuthContinue, tt.serverFirst},
+				{tt.clientFinal, respAuthContinue, tt.serverFinal},
+				{"", respOk, ""},
+			},
+		},
+		{
+			name:       "scram bad server signature",
+			creds:      Credentials{User: "user", Password: "pencil"},
+			mechanisms: "SCRAM-SHA-256",
+			script: []saslExchange{
+				{"n,,n=user,r=" + tt.nonce, respAuthContinue, tt.serverFirst},
+				{tt.clientFinal, respOk, "v=AAAA"},
+			},
+			err: true,
+		},
+		{
+			name:       "rejected",
+			preferred:  []string{"PLAIN"},
+			creds:      Credentials{User: "user", Password: "wrong"},
+			mechanisms: "SCRAM-SHA-256 PLAIN",
+			script:     []saslExchange{{"\x00user\x00wrong", respAuthErr, "Auth failure."}},
+			err:        true,
+		},
+		{
+			name:       "no mechanism",
+			preferred:  []string{"CRAM-MD5"},
+			creds:      Credentials{User: "user", Password: "pencil"},
+			mechanisms: "PLAIN",
+			err:        true,
+		},
+	}
+	for _, tc := range tests {
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			serveSASL(t, server, tc.mechanisms, tc.script)
+		}()
+		err := authenticate(client, tc.preferred, tc.creds)
+		client.Close()
+		<-done
+		if (err != nil) != tc.err {
+			t.Errorf("%s: authenticate = %v, want error %v", tc.name, err, tc.err)
+		}
+	}
+}
@@ -1,53 +1,73 @@
 package memcache
 
 import (
-	"fmt"
+	"context"
 	"net"
-	"strings"
-
-	"github.com/silenceper/pool"
 )
 
-func newPool(addr net.Addr, config Config) (pool.Pool, error) {
-	factory := func() (interface{}, error) {
-		conn, err := net.DialTimeout(addr.Network(), addr.String(), config.ConnectionTimeout)
-		if err != nil {
-			return nil, err
-		}
-		if config.User == "" && config.Password == "" {
-			return conn, nil
-		}
-		err = sendConnCommand(conn, "", opAuthList, nil, 0, nil)
+func newPool(addr net.Addr, config Config) (*connPool, error) {
+	if err := checkSASLMechanisms(config.SASLMechanisms); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	logger := config.logger()
+	factory := func(ctx context.Context) (net.Conn, error) {
+		creds, err := config.credentials()
 		if err != nil {
+			logger.Error("memcache: failed to load credentials", "server", config.Server, "error", err)
 			return nil, err
 		}
-		_, _, _, value, err := parseResponse("", conn)
+		conn, err := dial(ctx, addr, config)
 		if err != nil {
 			return nil, err
 		}
-		if strings.Index(string(value), "PLAIN") != -1 {
-			err = sendConnCommand(conn, "PLAIN", opAuthStart, []byte(fmt.Sprintf("\x00%s\x00%s", config.User, config.Password)), 0, nil)
-			if err != nil {
-				return nil, err
-			}
-			_, _, _, _, err = parseResponse("PLAIN", conn)
-			if err != nil {
-				fmt.Println("auth3", conn.LocalAddr(), conn.RemoteAddr())
+		if tlsConfig != nil {
+			if conn, err = tlsClient(conn, tlsConfig, config.tlsHandshakeTimeout()); err != nil {
 				return nil, err
 			}
 		}
+		if creds.User == "" && creds.Password == "" {
+			return conn, nil
+		}
+		if config.Protocol == ProtocolText || config.Protocol == ProtocolMeta {
+			err = authenticateText(conn, creds)
+		} else {
+			err = authenticate(conn, config.SASLMechanisms, creds)
+		}
+		if err != nil {
+			logger.Error("memcache: authentication failed", "server", config.Server, "error", err)
+			_ = conn.Close()
+			return nil, err
+		}
 		return conn, nil
 	}
 
-	closeConn := func(v interface{}) error { return v.(net.Conn).Close() }
+	return newConnPool(config, factory)
+}
 
-	poolConfig := &pool.Config{
-		InitialCap:  config.InitialCap,
-		MaxIdle:     config.MaxIdle,
-		MaxCap:      config.MaxCap,
-		Factory:     factory,
-		Close:       closeConn,
-		IdleTimeout: config.IdleTimeout,
+// dial opens a new connection to addr, using config.Dialer if set.
+func dial(ctx context.Context, addr net.Addr, config Config) (net.Conn, error) {
+	if config.ConnectionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.ConnectionTimeout)
+		defer cancel()
+	}
+	if config.Dialer == nil {
+		var d net.Dialer
+		return d.DialContext(ctx, addr.Network(), addr.String())
 	}
-	return pool.NewChannelPool(poolConfig)
+	return config.Dialer(ctx, addr.Network(), addr.String())
 }
+
+// serverAddr is an unresolved server address, passed as is to a
+// custom Dialer.
+type serverAddr struct {
+	network string
+	address string
+}
+
+func (a serverAddr) Network() string { return a.network }
+func (a serverAddr) String() string  { return a.address }
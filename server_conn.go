@@ -3,6 +3,7 @@ package memcache
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
@@ -36,15 +37,27 @@ var (
 	// contain whitespace or control characters.
 	ErrMalformedKey = errors.New("malformed: key is too long or contains invalid characters")
 
+	// ErrClientClosed is returned by requests made after Client.Close.
+	ErrClientClosed = errors.New("memcache: client is closed")
+
 	// ErrNoServers is returned when no servers are configured or available.
 	ErrNoServers = errors.New("memcache: no servers configured or available")
 
 	// ErrBadMagic is returned when the magic number in a response is not valid.
 	ErrBadMagic = errors.New("memcache: bad magic number in response")
 
+	// ErrProtocol is matched, using errors.Is, by the errors returned
+	// when a server sends a malformed response. The connection the
+	// response was read from is closed.
+	ErrProtocol = errors.New("memcache: protocol error")
+
 	// ErrBadIncrDec is returned when performing a incr/decr on non-numeric values.
 	ErrBadIncrDec = errors.New("memcache: incr or decr on non-numeric value")
 
+	// ErrNegativeExpiration is returned when the expiration given to
+	// create a missing key with incr or decr is negative.
+	ErrNegativeExpiration = errors.New("memcache: negative expiration for a created counter")
+
 	putUint16 = binary.BigEndian.PutUint16
 	putUint32 = binary.BigEndian.PutUint32
 	putUint64 = binary.BigEndian.PutUint64
@@ -85,6 +98,11 @@ const (
 	cmdPrependQ
 )
 
+const (
+	cmdTouch command = 0x1c
+	cmdGAT   command = 0x1d
+)
+
 // Auth Ops
 const (
 	opAuthList command = command(iota + 0x20)
@@ -159,7 +177,17 @@ const (
 	respMagic uint8 = 0x81
 )
 
-func sendConnCommand(cn net.Conn, key string, cmd command, value []byte, casid uint64, extras []byte) (err error) {
+func sendConnCommand(cn net.Conn, key string, cmd command, value []byte, casid uint64, extras []byte) error {
+	return sendConnCommandOpaque(cn, key, cmd, value, casid, extras, 0)
+}
+
+// sendConnCommandOpaque is like sendConnCommand, but sets the opaque
+// field of the request, which the server echoes back in its response.
+func sendConnCommandOpaque(cn net.Conn, key string, cmd command, value []byte, casid uint64, extras []byte, opaque uint32) (err error) {
+	// Longer keys would overflow the key length field.
+	if len(key) > 0xffff {
+		return ErrMalformedKey
+	}
 	var buf []byte
 
 	buf = make([]byte, 24, 24+len(key)+len(extras))
@@ -180,7 +208,8 @@ func sendConnCommand(cn net.Conn, key string, cmd command, value []byte, casid u
 	vl := len(value)
 	bl := uint32(kl + el + vl)
 	putUint32(buf[8:], bl)
-	// Opaque (12-15), always zero
+	// Opaque (12-15)
+	putUint32(buf[12:], opaque)
 	// CAS (16-23)
 	putUint64(buf[16:], casid)
 	// Extras
@@ -203,7 +232,46 @@ func sendConnCommand(cn net.Conn, key string, cmd command, value []byte, casid u
 	return nil
 }
 
-func parseResponse(rKey string, cn net.Conn) ([]byte, []byte, []byte, []byte, error) {
+// ProtocolError describes a malformed response. It matches ErrProtocol.
+type ProtocolError struct {
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return "memcache: protocol error: " + e.Reason
+}
+
+// Is reports whether target is ErrProtocol.
+func (e *ProtocolError) Is(target error) bool {
+	return target == ErrProtocol
+}
+
+func protocolError(format string, args ...interface{}) error {
+	return &ProtocolError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// itemFlags decodes the flags in the extras of a get response.
+func itemFlags(extras []byte) (uint32, error) {
+	switch len(extras) {
+	case 0:
+		return 0, nil
+	case 4:
+		return bUint32(extras), nil
+	}
+	return 0, protocolError("get response extras of %d bytes, want 4", len(extras))
+}
+
+// maxControlResponseSize is the maximum body size of the responses to
+// noop and SASL requests.
+const maxControlResponseSize = 64 << 10
+
+// parseResponse reads a response from cn and returns its header, key,
+// extras and value. The header is also returned along with the error
+// when the server answered with a non-ok status. SASL continuation
+// responses return their body too, with a respAuthContinue error.
+// Responses whose body is larger than maxBody, or whose lengths are
+// inconsistent, fail with a ProtocolError before their body is read.
+func parseResponse(rKey string, cn net.Conn, maxBody int) ([]byte, []byte, []byte, []byte, error) {
 	var err error
 	hdr := make([]byte, 24)
 	if err = readAtLeast(cn, hdr, 24); err != nil {
@@ -212,19 +280,26 @@ func parseResponse(rKey string, cn net.Conn) ([]byte, []byte, []byte, []byte, er
 	if hdr[0] != respMagic {
 		return nil, nil, nil, nil, ErrBadMagic
 	}
-	total := int(bUint32(hdr[8:12]))
+	total := int64(bUint32(hdr[8:12]))
+	if total > int64(maxBody) {
+		return nil, nil, nil, nil, protocolError("response body of %d bytes exceeds the maximum of %d", total, maxBody)
+	}
+	el := int(hdr[4])
+	kl := int(bUint16(hdr[2:4]))
+	if int64(el+kl) > total {
+		return nil, nil, nil, nil, protocolError("extras and key lengths %d+%d exceed the body length %d", el, kl, total)
+	}
 	status := bUint16(hdr[6:8])
-	if status != respOk {
-		if _, err = io.CopyN(ioutil.Discard, cn, int64(total)); err != nil {
+	if status != respOk && status != respAuthContinue {
+		if _, err = io.CopyN(ioutil.Discard, cn, total); err != nil {
 			return nil, nil, nil, nil, err
 		}
 		if status == respInvalidArgs && !legalKey(rKey) {
-			return nil, nil, nil, nil, ErrMalformedKey
+			return hdr, nil, nil, nil, ErrMalformedKey
 		}
-		return nil, nil, nil, nil, response(status).asError()
+		return hdr, nil, nil, nil, response(status).asError()
 	}
 	var extras []byte
-	el := int(hdr[4])
 	if el > 0 {
 		extras = make([]byte, el)
 		if err = readAtLeast(cn, extras, el); err != nil {
@@ -232,7 +307,6 @@ func parseResponse(rKey string, cn net.Conn) ([]byte, []byte, []byte, []byte, er
 		}
 	}
 	var key []byte
-	kl := int(bUint16(hdr[2:4]))
 	if kl > 0 {
 		key = make([]byte, int(kl))
 		if err = readAtLeast(cn, key, kl); err != nil {
@@ -240,12 +314,15 @@ func parseResponse(rKey string, cn net.Conn) ([]byte, []byte, []byte, []byte, er
 		}
 	}
 	var value []byte
-	vl := total - el - kl
+	vl := int(total) - el - kl
 	if vl > 0 {
 		value = make([]byte, vl)
 		if err = readAtLeast(cn, value, vl); err != nil {
 			return nil, nil, nil, nil, err
 		}
 	}
+	if status == respAuthContinue {
+		return hdr, key, extras, value, response(status)
+	}
 	return hdr, key, extras, value, nil
 }
@@ -1,8 +1,8 @@
 package memcache
 
 import (
+	"context"
 	"fmt"
-	"github.com/silenceper/pool"
 	"hash/crc32"
 	"net"
 	"strings"
@@ -11,44 +11,55 @@ import (
 // ServerList is an implementation of the Servers interface.
 // To initialize a ServerList use NewServerList.
 type ServerList struct {
-	pool         []pool.Pool
+	pool         []*connPool
 	poolLen      uint32
 	serversNames []string
 }
 
 func NewServerList(configs []Config) (*ServerList, error) {
-	servers := make([]pool.Pool, len(configs))
-	serversLen := 0
-	count := 0
+	servers := make([]*connPool, len(configs))
 	serversName := make([]string, len(configs))
+	release := func() {
+		for _, server := range servers {
+			if server != nil {
+				server.release()
+			}
+		}
+	}
 	for i, config := range configs {
-		if strings.Contains(config.Server, "/") {
-			addr, err := net.ResolveUnixAddr("unix", config.Server)
-			if err != nil {
-				return nil, err
+		var addr net.Addr
+		if config.Dialer != nil {
+			network := "tcp"
+			if strings.Contains(config.Server, "/") {
+				network = "unix"
 			}
-			servers[i], err = newPool(addr, config)
+			addr = serverAddr{network: network, address: config.Server}
+		} else if strings.Contains(config.Server, "/") {
+			unixAddr, err := net.ResolveUnixAddr("unix", config.Server)
 			if err != nil {
+				release()
 				return nil, err
 			}
-
+			addr = unixAddr
 		} else {
 			tcpAddr, err := net.ResolveTCPAddr("tcp", config.Server)
 			if err != nil {
+				release()
 				return nil, err
 			}
-			servers[i], err = newPool(tcpAddr, config)
-			if err != nil {
-				return nil, err
-			}
+			addr = tcpAddr
+		}
+		var err error
+		servers[i], err = newPool(addr, config)
+		if err != nil {
+			release()
+			return nil, err
 		}
-		serversName = append(serversName, config.Server)
-		count += servers[i].Len()
-		serversLen++
+		serversName[i] = config.Server
 	}
 	return &ServerList{
 		pool:         servers,
-		poolLen:      uint32(serversLen),
+		poolLen:      uint32(len(servers)),
 		serversNames: serversName,
 	}, nil
 }
@@ -62,43 +73,80 @@ func (s *ServerList) PickServerIndex(key string) (uint32, error) {
 }
 
 func (s *ServerList) GetConnection(index uint32) (net.Conn, error) {
-	if s.poolLen < index {
-		return nil, fmt.Errorf("server not found")
-	}
-
-	connection, err := s.pool[index].Get()
+	pc, err := s.getConn(context.Background(), index)
 	if err != nil {
 		return nil, err
 	}
-
-	return connection.(net.Conn), nil
+	return pc, nil
 }
 
 func (s *ServerList) PutConnection(index uint32, conn net.Conn) error {
-	if s.poolLen < index {
-		return fmt.Errorf("server not found")
+	pc, ok := conn.(*poolConn)
+	if !ok {
+		return fmt.Errorf("connection not from this server list")
 	}
-	return s.pool[index].Put(conn)
+	return s.putConn(index, pc)
 }
 
 func (s *ServerList) CloseConnection(index uint32, conn net.Conn) error {
-	if s.poolLen < index {
+	pc, ok := conn.(*poolConn)
+	if !ok {
+		return fmt.Errorf("connection not from this server list")
+	}
+	return s.closeConn(index, pc)
+}
+
+func (s *ServerList) getConn(ctx context.Context, index uint32) (*poolConn, error) {
+	if index >= s.poolLen {
+		return nil, fmt.Errorf("server not found")
+	}
+	return s.pool[index].get(ctx)
+}
+
+func (s *ServerList) putConn(index uint32, pc *poolConn) error {
+	if index >= s.poolLen {
+		return fmt.Errorf("server not found")
+	}
+	s.pool[index].put(pc)
+	return nil
+}
+
+func (s *ServerList) closeConn(index uint32, pc *poolConn) error {
+	if index >= s.poolLen {
 		return fmt.Errorf("server not found")
 	}
-	return s.pool[index].Close(conn)
+	return s.pool[index].discard(pc)
 }
 
+// logger returns the Logger configured for the server at index.
+func (s *ServerList) logger(index uint32) Logger {
+	if index >= s.poolLen {
+		return nopLogger{}
+	}
+	return s.pool[index].logger
+}
+
+// codec returns the codec of the protocol spoken with the server at
+// index.
+func (s *ServerList) codec(index uint32) codec {
+	if index >= s.poolLen {
+		return nil
+	}
+	return s.pool[index].codec
+}
+
+// Count returns the number of idle connections across all servers.
 func (s *ServerList) Count() int {
 	count := 0
 	for _, server := range s.pool {
-		count += server.Len()
+		count += server.idleLen()
 	}
 	return count
 }
 
 func (s *ServerList) Release() {
 	for _, server := range s.pool {
-		server.Release()
+		server.release()
 	}
 }
 
@@ -109,3 +157,9 @@ func (s *ServerList) PoolLen() uint32 {
 func (s *ServerList) Name(index uint32) string {
 	return s.serversNames[index]
 }
+
+// PoolStats returns the connection pool statistics of the server at
+// the given index.
+func (s *ServerList) PoolStats(index uint32) PoolStats {
+	return s.pool[index].poolStats()
+}
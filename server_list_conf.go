@@ -1,23 +1,94 @@
 package memcache
 
-import "time"
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
 
 type Config struct {
 	Server   string
 	User     string
 	Password string
 
-	//The minimum number of connections to have in the connection pool
+	//Credentials, if set, is consulted for every new connection instead of User and Password
+	Credentials CredentialsProvider
+
+	//The minimum number of connections to have in the connection pool, kept open in the background
 	InitialCap int
 
-	//Maximum number of concurrent live connections
+	//Maximum number of concurrent live connections, zero means no limit
 	MaxCap int
 
+	//Maximum time to wait for a connection when MaxCap connections are in use, zero means no limit
+	PoolTimeout time.Duration
+
 	//Max idle connections
 	MaxIdle int
 
 	//The maximum idle time of the connection, if it exceeds this event, it will be invalid
 	IdleTimeout time.Duration
 
+	//The maximum time a connection may be reused since it was established, zero means no limit.
+	//Each connection gets up to 10% less, so connections opened together are recycled gradually.
+	//Expired idle connections are replaced in the background, those in use when returned
+	MaxConnLifetime time.Duration
+
+	//How often the background maintainer closes expired idle connections and reopens
+	//connections to keep InitialCap open, defaults to a second
+	MaintenanceInterval time.Duration
+
+	//Check that idle connections weren't closed by the server before reusing them, without blocking
+	ValidateConnections bool
+
+	//Idle connections unused for longer than this are checked with a noop before reuse, zero disables it
+	PingIdleAfter time.Duration
+
 	ConnectionTimeout time.Duration
+
+	//Dialer, if set, is used to open connections instead of net.DialTimeout. The address
+	//is passed unresolved and ctx expires after ConnectionTimeout. TLS, if enabled, is
+	//negotiated over the returned connection
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	//TLSConfig enables TLS when set. ServerName defaults to the host in Server
+	TLSConfig *tls.Config
+
+	//PEM encoded client certificate and key files for mutual TLS, enabling TLS if set
+	TLSCertFile string
+	TLSKeyFile  string
+
+	//Maximum duration of the TLS handshake, defaults to ConnectionTimeout
+	TLSHandshakeTimeout time.Duration
+
+	//SASL mechanisms to try, in order of preference. Defaults to DefaultSASLMechanisms.
+	//Connecting fails with ErrNoSASLMechanism if credentials are set and the
+	//server supports none of them. SCRAM only authenticates the server when it
+	//sends its final message: memcached doesn't, answering "Authenticated"
+	//instead, so only the client is authenticated unless TLS is used.
+	SASLMechanisms []string
+
+	//Protocol spoken with the server, ProtocolBinary by default. ProtocolText and ProtocolMeta
+	//authenticate with the "set auth" command of memcached 1.5.15+ instead of SASL. The Meta
+	//methods and GetOrRefresh fail with ErrMetaUnsupported over ProtocolBinary
+	Protocol Protocol
+
+	//Maximum body size of a response, larger ones fail with an ErrProtocol error and close
+	//the connection. Defaults to 16MB
+	MaxResponseSize int
+
+	//Logger, if set, receives connection churn, authentication failures, unreachable
+	//server and protocol error messages. *slog.Logger can be used as is
+	Logger Logger
+}
+
+// defaultMaxResponseSize is the default of Config.MaxResponseSize.
+const defaultMaxResponseSize = 16 << 20
+
+func (c Config) maxResponseSize() int {
+	if c.MaxResponseSize <= 0 {
+		return defaultMaxResponseSize
+	}
+	return c.MaxResponseSize
 }
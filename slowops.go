@@ -0,0 +1,86 @@
+package memcache
+
+import "time"
+
+// SlowOp describes a request slower than Client.SlowOpThreshold. The
+// phase durations are zero for the phases the request didn't reach.
+type SlowOp struct {
+	// Operation is the name of the Client operation, one of the Op
+	// constants, as in RequestEvent.
+	Operation string
+
+	// Server is the address of the server, as given in Config.Server.
+	Server string
+
+	// Keys holds the keys sent to the server. It must not be modified.
+	Keys []string
+
+	// Bytes is the total size of the values sent or received.
+	Bytes int
+
+	// Err is the error returned for the request, if any.
+	Err error
+
+	// Start is when the request started.
+	Start time.Time
+
+	// Duration is the total time taken by the request.
+	Duration time.Duration
+
+	// PoolWait is the time taken to get a connection, including
+	// waiting for a free one and dialing it.
+	PoolWait time.Duration
+
+	// Write is the time taken to write the request.
+	Write time.Duration
+
+	// FirstByte is the time between the end of the write and the first
+	// byte of the response.
+	FirstByte time.Duration
+
+	// Read is the time between the end of the write and the end of the
+	// response.
+	Read time.Duration
+}
+
+// reportIfSlow reports the request to OnSlowOp, or logs it if OnSlowOp
+// isn't set, if it took longer than SlowOpThreshold.
+func (r *request) reportIfSlow(bytes int, err error) {
+	now := time.Now()
+	d := now.Sub(r.start)
+	if d < r.c.SlowOpThreshold {
+		return
+	}
+	op := SlowOp{
+		Operation: r.op,
+		Server:    r.c.servers.Name(r.serverIndex),
+		Keys:      r.keys,
+		Bytes:     bytes,
+		Err:       err,
+		Start:     r.start,
+		Duration:  d,
+	}
+	if op.Keys == nil && r.key != "" {
+		op.Keys = []string{r.key}
+	}
+	if !r.acquiredAt.IsZero() {
+		op.PoolWait = r.acquiredAt.Sub(r.start)
+	} else {
+		op.PoolWait = d
+	}
+	if !r.sentAt.IsZero() {
+		op.Write = r.sentAt.Sub(r.acquiredAt)
+		op.Read = now.Sub(r.sentAt)
+		if !r.firstByteAt.IsZero() {
+			op.FirstByte = r.firstByteAt.Sub(r.sentAt)
+		}
+	}
+	if r.c.OnSlowOp != nil {
+		r.c.OnSlowOp(op)
+		return
+	}
+	r.c.servers.logger(r.serverIndex).Warn("memcache: slow operation",
+		"server", op.Server, "operation", op.Operation, "keys", op.Keys, "bytes", op.Bytes,
+		"duration", op.Duration, "pool_wait", op.PoolWait, "write", op.Write,
+		"first_byte", op.FirstByte, "read", op.Read, "error", op.Err)
+}
@@ -0,0 +1,126 @@
+package memcache
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// delayedConn delays every write, simulating a slow server when used on
+// the server side of a pipe.
+type delayedConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (c delayedConn) Write(b []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Conn.Write(b)
+}
+
+func newDelayedClient(t *testing.T, delay time.Duration, config Config) *Client {
+	config.Server = "slow:11211"
+	config.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go serveStubConn(delayedConn{server, delay})
+		return client, nil
+	}
+	c, err := New([]Config{config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestSlowOps(t *testing.T) {
+	c := newDelayedClient(t, 20*time.Millisecond, Config{MaxIdle: 1, MaxCap: 1})
+	var mu sync.Mutex
+	var slow []SlowOp
+	c.SlowOpThreshold = 10 * time.Millisecond
+	c.OnSlowOp = func(op SlowOp) {
+		mu.Lock()
+		slow = append(slow, op)
+		mu.Unlock()
+	}
+
+	if _, err := c.Get("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetMulti([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(slow) != 2 {
+		t.Fatalf("reported %d slow operations, want 2", len(slow))
+	}
+	get := slow[0]
+	if get.Operation != OpGet || get.Server != "slow:11211" || len(get.Keys) != 1 || get.Keys[0] != "foo" || get.Bytes != 3 {
+		t.Errorf("slow get = %+v", get)
+	}
+	if get.FirstByte < 20*time.Millisecond || get.Read < get.FirstByte || get.Duration < get.PoolWait+get.Write+get.Read {
+		t.Errorf("slow get phases = %+v, want a first byte after 20ms", get)
+	}
+	multi := slow[1]
+	if multi.Operation != OpGetMulti || len(multi.Keys) != 2 || multi.FirstByte < 20*time.Millisecond {
+		t.Errorf("slow get_multi = %+v", multi)
+	}
+
+	// Fast requests aren't reported.
+	c.SlowOpThreshold = time.Hour
+	if _, err := c.Get("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if len(slow) != 2 {
+		t.Errorf("reported %d slow operations, want 2", len(slow))
+	}
+}
+
+func TestSlowOpsLogged(t *testing.T) {
+	logger := &recordingLogger{}
+	c := newDelayedClient(t, 10*time.Millisecond, Config{MaxIdle: 1, MaxCap: 1, Logger: logger})
+	c.SlowOpThreshold = time.Millisecond
+	if err := c.Set(&Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatal(err)
+	}
+	if n := logger.count(LevelWarn, "memcache: slow operation"); n != 1 {
+		t.Errorf("logged %d slow operations, want 1", n)
+	}
+}
+
+func TestSlowOpsConcurrent(t *testing.T) {
+	// A single connection is shared by the requests, which must stop
+	// timing it once it's released.
+	c := newDelayedClient(t, time.Millisecond, Config{MaxIdle: 1, MaxCap: 1})
+	var mu sync.Mutex
+	var slow []SlowOp
+	c.SlowOpThreshold = 1
+	c.OnSlowOp = func(op SlowOp) {
+		mu.Lock()
+		slow = append(slow, op)
+		mu.Unlock()
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := c.Get("foo"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(slow) != 80 {
+		t.Fatalf("reported %d slow operations, want 80", len(slow))
+	}
+	for _, op := range slow {
+		if op.FirstByte <= 0 || op.Read < op.FirstByte {
+			t.Errorf("slow get phases = %+v, want a first byte within the read", op)
+		}
+	}
+}
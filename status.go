@@ -0,0 +1,124 @@
+package memcache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statusWeight is the weight of the latest request in the moving
+// averages of ServerStatus.
+const statusWeight = 0.1
+
+// ServerStatus is a snapshot of the health of a server, as seen by the
+// Client.
+type ServerStatus struct {
+	// Server is the server address, as given in Config.Server.
+	Server string
+
+	// Pool holds the connection counts of the server pool.
+	Pool PoolStats
+
+	// InFlight is the number of requests currently made to the server.
+	InFlight int
+
+	// Requests is the total number of requests made to the server.
+	Requests int64
+
+	// Latency is the exponentially weighted moving average of the
+	// request durations, including the time spent waiting for a
+	// connection.
+	Latency time.Duration
+
+	// ErrorRate is the exponentially weighted moving average of the
+	// fraction of requests which failed, between 0 and 1. Misses and
+	// other expected statuses, like ErrNotStored, aren't failures.
+	ErrorRate float64
+
+	// ConsecutiveFailures is the number of requests which failed since
+	// the last successful one.
+	ConsecutiveFailures int
+
+	// LastError is the error of the last failed request, and
+	// LastErrorTime when it happened.
+	LastError     error
+	LastErrorTime time.Time
+}
+
+// serverHealth accumulates the request outcomes of a server.
+type serverHealth struct {
+	inFlight int32
+
+	mu                  sync.Mutex
+	requests            int64
+	latency             float64
+	errorRate           float64
+	consecutiveFailures int
+	lastError           error
+	lastErrorTime       time.Time
+}
+
+func (h *serverHealth) record(d time.Duration, err error) {
+	failed := 0.0
+	if isServerFailure(err) {
+		failed = 1
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.requests == 0 {
+		h.latency = float64(d)
+		h.errorRate = failed
+	} else {
+		h.latency += statusWeight * (float64(d) - h.latency)
+		h.errorRate += statusWeight * (failed - h.errorRate)
+	}
+	h.requests++
+	if failed == 0 {
+		h.consecutiveFailures = 0
+		return
+	}
+	h.consecutiveFailures++
+	h.lastError = err
+	h.lastErrorTime = time.Now()
+}
+
+// isServerFailure returns whether err means the server couldn't serve a
+// request, as opposed to answering with an expected status or the caller
+// giving up.
+func isServerFailure(err error) bool {
+	switch err {
+	case nil, ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrBadIncrDec, ErrMalformedKey,
+		ErrClientClosed, context.Canceled, context.DeadlineExceeded:
+		return false
+	}
+	return true
+}
+
+// health returns the health of the server at index.
+func (c *Client) health(index uint32) *serverHealth {
+	return &c.status[index]
+}
+
+// ServerStatus returns the health of every server, in the order they
+// were configured.
+func (c *Client) ServerStatus() []ServerStatus {
+	status := make([]ServerStatus, c.servers.PoolLen())
+	for i := range status {
+		h := c.health(uint32(i))
+		h.mu.Lock()
+		status[i] = ServerStatus{
+			Server:              c.servers.Name(uint32(i)),
+			Requests:            h.requests,
+			Latency:             time.Duration(h.latency),
+			ErrorRate:           h.errorRate,
+			ConsecutiveFailures: h.consecutiveFailures,
+			LastError:           h.lastError,
+			LastErrorTime:       h.lastErrorTime,
+		}
+		h.mu.Unlock()
+		status[i].InFlight = int(atomic.LoadInt32(&h.inFlight))
+		status[i].Pool = c.servers.PoolStats(uint32(i))
+	}
+	return status
+}
@@ -0,0 +1,74 @@
+package memcache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerStatus(t *testing.T) {
+	c := newDelayedClient(t, 10*time.Millisecond, Config{MaxIdle: 1, MaxCap: 1})
+	done := make(chan error)
+	go func() {
+		_, err := c.Get("foo")
+		done <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	st := c.ServerStatus()
+	if len(st) != 1 || st[0].Server != "slow:11211" || st[0].InFlight != 1 || st[0].Pool.InUse != 1 {
+		t.Errorf("status during a request = %+v", st)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("foo"); err != nil {
+		t.Fatal(err)
+	}
+	st = c.ServerStatus()
+	if st[0].InFlight != 0 || st[0].Requests != 2 || st[0].Latency < 10*time.Millisecond || st[0].ErrorRate != 0 || st[0].LastError != nil {
+		t.Errorf("status after 2 requests = %+v", st[0])
+	}
+}
+
+func TestServerStatusFailures(t *testing.T) {
+	errDown := errors.New("server down")
+	down := true
+	c, err := New([]Config{{
+		Server:  "flaky:11211",
+		MaxIdle: 1,
+		MaxCap:  1,
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if down {
+				return nil, errDown
+			}
+			client, server := net.Pipe()
+			go serveStubConn(server)
+			return client, nil
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.Get("foo"); err != errDown {
+			t.Fatalf("Get with server down = %v, want %v", err, errDown)
+		}
+	}
+	st := c.ServerStatus()[0]
+	if st.ConsecutiveFailures != 3 || st.LastError != errDown || st.LastErrorTime.IsZero() || st.ErrorRate != 1 {
+		t.Errorf("status with server down = %+v", st)
+	}
+
+	down = false
+	if err := c.Delete("foo"); err != nil {
+		t.Fatal(err)
+	}
+	st = c.ServerStatus()[0]
+	if st.ConsecutiveFailures != 0 || st.LastError != errDown || st.ErrorRate >= 1 || st.ErrorRate <= 0.8 {
+		t.Errorf("status after recovery = %+v", st)
+	}
+}
@@ -0,0 +1,587 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// textCodec speaks the text protocol. Keys are checked before sending,
+// since the protocol can't carry those with spaces or control
+// characters. Stored items don't get their new CAS ID, which the
+// protocol doesn't return, so CompareAndSwap needs an item from a Get.
+type textCodec struct{}
+
+// reader returns the buffered reader of the text protocol responses.
+func (cn *poolConn) reader() *bufio.Reader {
+	if cn.br == nil {
+		cn.br = bufio.NewReader(cn)
+	}
+	return cn.br
+}
+
+var (
+	crlf          = []byte("\r\n")
+	textEnd       = []byte("END")
+	textStored    = []byte("STORED")
+	textNotStored = []byte("NOT_STORED")
+	textExists    = []byte("EXISTS")
+	textNotFound  = []byte("NOT_FOUND")
+	textDeleted   = []byte("DELETED")
+	textTouched   = []byte("TOUCHED")
+	textOK        = []byte("OK")
+	textValue     = []byte("VALUE ")
+	textStat      = []byte("STAT ")
+	textVersion   = []byte("VERSION ")
+)
+
+// readLine reads a response line, without its terminating CRLF. The
+// line is only valid until the next read.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, protocolError("response line longer than %d bytes", r.Size())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(line, crlf) {
+		return nil, protocolError("response line %q not terminated by CRLF", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// textError returns the error for a line which isn't one of the
+// expected answers to a command.
+func textError(line []byte) error {
+	switch {
+	case bytes.Equal(line, []byte("ERROR")):
+		return errUnknownCommand
+	case bytes.HasPrefix(line, []byte("CLIENT_ERROR ")):
+		if bytes.Contains(line, []byte("non-numeric")) {
+			return ErrBadIncrDec
+		}
+		return fmt.Errorf("%w: client error: %s", ErrServerError, line[len("CLIENT_ERROR "):])
+	case bytes.HasPrefix(line, []byte("SERVER_ERROR ")):
+		return fmt.Errorf("%w: %s", ErrServerError, line[len("SERVER_ERROR "):])
+	}
+	return protocolError("unexpected response %q", line)
+}
+
+// errUnknownCommand is returned for an ERROR line. Unlike the other
+// error lines it leaves the rest of a command, such as its data block,
+// unread by the server.
+var errUnknownCommand = fmt.Errorf("%w: unknown command", ErrServerError)
+
+// writeText writes a command buffered in buf.
+func writeText(cn *poolConn, req *request, buf *bytes.Buffer) error {
+	if _, err := cn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	req.sent()
+	return nil
+}
+
+// expirationText formats an expiration, given as the uint32 of the
+// binary protocol, keeping negative ones.
+func expirationText(expiration uint32) string {
+	return strconv.FormatInt(int64(int32(expiration)), 10)
+}
+
+func (textCodec) get(cn *poolConn, req *request, key string) (*Item, error) {
+	if !legalKey(key) {
+		return nil, ErrMalformedKey
+	}
+	var buf bytes.Buffer
+	buf.WriteString("gets " + key + "\r\n")
+	return textRetrieveOne(cn, req, &buf)
+}
+
+func (textCodec) getAndTouch(cn *poolConn, req *request, key string, expiration int32) (*Item, error) {
+	if !legalKey(key) {
+		return nil, ErrMalformedKey
+	}
+	var buf bytes.Buffer
+	buf.WriteString("gats " + expirationText(uint32(expiration)) + " " + key + "\r\n")
+	return textRetrieveOne(cn, req, &buf)
+}
+
+func textRetrieveOne(cn *poolConn, req *request, buf *bytes.Buffer) (*Item, error) {
+	if err := writeText(cn, req, buf); err != nil {
+		return nil, err
+	}
+	var item *Item
+	err := readValues(cn, func(it *Item) { item = it })
+	if err == nil && item == nil {
+		err = ErrCacheMiss
+	}
+	return item, err
+}
+
+// getMulti gets all the keys with a single gets command. Illegal keys
+// are skipped, as misses.
+func (textCodec) getMulti(cn *poolConn, req *request, keys []string, found func(*Item)) error {
+	var buf bytes.Buffer
+	buf.WriteString("gets")
+	for _, key := range keys {
+		if legalKey(key) {
+			buf.WriteString(" " + key)
+		}
+	}
+	if buf.Len() == len("gets") {
+		return nil
+	}
+	buf.WriteString("\r\n")
+	if err := writeText(cn, req, &buf); err != nil {
+		return err
+	}
+	return readValues(cn, found)
+}
+
+// readValues reads the items answered to a retrieval command, up to
+// END, and calls found for each of them.
+func readValues(cn *poolConn, found func(*Item)) error {
+	r := cn.reader()
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(line, textEnd) {
+			return nil
+		}
+		if !bytes.HasPrefix(line, textValue) {
+			return textError(line)
+		}
+		// VALUE <key> <flags> <bytes> [<cas unique>]
+		fields := bytes.Fields(line[len(textValue):])
+		if len(fields) != 3 && len(fields) != 4 {
+			return protocolError("malformed value line %q", line)
+		}
+		it := &Item{Key: string(fields[0])}
+		flags, err := strconv.ParseUint(string(fields[1]), 10, 32)
+		if err != nil {
+			return protocolError("malformed value line %q", line)
+		}
+		it.Flags = uint32(flags)
+		size, err := strconv.Atoi(string(fields[2]))
+		if err != nil || size < 0 {
+			return protocolError("malformed value line %q", line)
+		}
+		if len(fields) == 4 {
+			if it.casid, err = strconv.ParseUint(string(fields[3]), 10, 64); err != nil {
+				return protocolError("malformed value line %q", line)
+			}
+		}
+		if size > cn.maxBody {
+			return protocolError("value of %d bytes exceeds the limit of %d", size, cn.maxBody)
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return err
+		}
+		if !bytes.HasSuffix(value, crlf) {
+			return protocolError("value not terminated by CRLF")
+		}
+		it.Value = value[:size]
+		found(it)
+	}
+}
+
+// writeStorage buffers a storage command, a cas one if casid isn't zero.
+func writeStorage(buf *bytes.Buffer, name string, key string, flags uint32, expiration uint32, value []byte, casid uint64) {
+	buf.WriteString(name + " " + key + " " + strconv.FormatUint(uint64(flags), 10) + " " +
+		expirationText(expiration) + " " + strconv.Itoa(len(value)))
+	if casid != 0 {
+		buf.WriteString(" " + strconv.FormatUint(casid, 10))
+	}
+	buf.WriteString("\r\n")
+	buf.Write(value)
+	buf.WriteString("\r\n")
+}
+
+// storageError returns the error for the answer to a storage command.
+func storageError(line []byte, cas bool) error {
+	switch {
+	case bytes.Equal(line, textStored):
+		return nil
+	case bytes.Equal(line, textNotStored):
+		return ErrNotStored
+	case bytes.Equal(line, textExists):
+		return ErrCASConflict
+	case bytes.Equal(line, textNotFound) && cas:
+		return ErrNotStored
+	}
+	return textError(line)
+}
+
+func (textCodec) store(cn *poolConn, req *request, cmd command, item *Item, casid uint64) error {
+	if !legalKey(item.Key) {
+		return ErrMalformedKey
+	}
+	name := "set"
+	switch {
+	case casid != 0:
+		name = "cas"
+	case cmd == cmdAdd:
+		name = "add"
+	}
+	var buf bytes.Buffer
+	writeStorage(&buf, name, item.Key, item.Flags, uint32(item.Expiration), item.Value, casid)
+	if err := writeText(cn, req, &buf); err != nil {
+		return err
+	}
+	line, err := readLine(cn.reader())
+	if err != nil {
+		return err
+	}
+	return storageError(line, casid != 0)
+}
+
+// setQ pipelines a set for each item, and reads their answers in order.
+func (textCodec) setQ(cn *poolConn, req *request, items []*Item) ([]error, error) {
+	return textPipeline(cn, req, items, func(buf *bytes.Buffer, item *Item) {
+		writeStorage(buf, "set", item.Key, item.Flags, uint32(item.Expiration), item.Value, 0)
+	}, func(*Item) error {
+		line, err := readLine(cn.reader())
+		if err != nil {
+			return err
+		}
+		return storageError(line, false)
+	})
+}
+
+// textPipeline writes the command of every item with legal keys, then
+// reads their answers in order. The returned slice is either nil or has
+// an error per item. A CLIENT_ERROR or SERVER_ERROR line only fails its
+// item, other errors stop the reads and are also given to the items
+// left unanswered.
+func textPipeline(cn *poolConn, req *request, items []*Item, write func(*bytes.Buffer, *Item), read func(*Item) error) ([]error, error) {
+	var errs []error
+	setErr := func(ii int, err error) {
+		if errs == nil {
+			errs = make([]error, len(items))
+		}
+		errs[ii] = err
+	}
+	var buf bytes.Buffer
+	var sent []int
+	for ii, item := range items {
+		if !legalKey(item.Key) {
+			setErr(ii, ErrMalformedKey)
+			continue
+		}
+		write(&buf, item)
+		sent = append(sent, ii)
+	}
+	if len(sent) == 0 {
+		return errs, nil
+	}
+	if err := writeText(cn, req, &buf); err != nil {
+		return nil, err
+	}
+	for n, ii := range sent {
+		err := read(items[ii])
+		if !resumableError(err) && !isItemError(err) {
+			for _, ii := range sent[n:] {
+				setErr(ii, err)
+			}
+			return errs, err
+		}
+		if err != nil {
+			setErr(ii, err)
+		}
+	}
+	return errs, nil
+}
+
+// isItemError reports whether err is the error line answering a single
+// command, after which the connection is still in sync.
+func isItemError(err error) bool {
+	return err != errUnknownCommand && errors.Is(err, ErrServerError)
+}
+
+// textKeyCommand sends cmdLine, a command on key answered with done on
+// success and NOT_FOUND for a missing key.
+func textKeyCommand(cn *poolConn, req *request, key, cmdLine string, done []byte) error {
+	if !legalKey(key) {
+		return ErrMalformedKey
+	}
+	var buf bytes.Buffer
+	buf.WriteString(cmdLine + "\r\n")
+	if err := writeText(cn, req, &buf); err != nil {
+		return err
+	}
+	line, err := readLine(cn.reader())
+	if err != nil {
+		return err
+	}
+	switch {
+	case bytes.Equal(line, done):
+		return nil
+	case bytes.Equal(line, textNotFound):
+		return ErrCacheMiss
+	}
+	return textError(line)
+}
+
+// delete uses the meta md command for a CAS delete, which the text
+// protocol lacks. Servers older than memcached 1.6 don't support it.
+func (textCodec) delete(cn *poolConn, req *request, key string, casid uint64) error {
+	if casid != 0 {
+		return metaDelete(cn, req, key, "C"+strconv.FormatUint(casid, 10))
+	}
+	return textKeyCommand(cn, req, key, "delete "+key, textDeleted)
+}
+
+func (textCodec) touch(cn *poolConn, req *request, key string, expiration int32) error {
+	return textKeyCommand(cn, req, key, "touch "+key+" "+expirationText(uint32(expiration)), textTouched)
+}
+
+func incrDecrName(cmd command) string {
+	if cmd == cmdDecr || cmd == cmdDecrementQ {
+		return "decr"
+	}
+	return "incr"
+}
+
+func writeIncrDecr(buf *bytes.Buffer, name, key string, delta uint64) {
+	buf.WriteString(name + " " + key + " " + strconv.FormatUint(delta, 10) + "\r\n")
+}
+
+// readIncrDecr reads the answer to an incr or decr command.
+func readIncrDecr(cn *poolConn) (uint64, error) {
+	line, err := readLine(cn.reader())
+	if err != nil {
+		return 0, err
+	}
+	if bytes.Equal(line, textNotFound) {
+		return 0, ErrCacheMiss
+	}
+	if len(line) > 0 && line[0] >= '0' && line[0] <= '9' {
+		n, err := strconv.ParseUint(string(bytes.TrimRight(line, " ")), 10, 64)
+		if err != nil {
+			return 0, protocolError("malformed incr/decr response %q", line)
+		}
+		return n, nil
+	}
+	return 0, textError(line)
+}
+
+// incrDecr emulates the creation of missing keys with an add of the
+// initial value, since text incr and decr don't create them. When
+// another client adds the key first the command is retried.
+func (textCodec) incrDecr(cn *poolConn, req *request, cmd command, key string, delta, initial uint64, expiration uint32) (uint64, error) {
+	if !legalKey(key) {
+		return 0, ErrMalformedKey
+	}
+	name := incrDecrName(cmd)
+	for {
+		var buf bytes.Buffer
+		writeIncrDecr(&buf, name, key, delta)
+		if err := writeText(cn, req, &buf); err != nil {
+			return 0, err
+		}
+		n, err := readIncrDecr(cn)
+		if err != ErrCacheMiss || expiration == noAutoCreate {
+			return n, err
+		}
+
+		buf.Reset()
+		value := strconv.FormatUint(initial, 10)
+		writeStorage(&buf, "add", key, 0, expiration, []byte(value), 0)
+		if err := writeText(cn, req, &buf); err != nil {
+			return 0, err
+		}
+		line, err := readLine(cn.reader())
+		if err != nil {
+			return 0, err
+		}
+		if err = storageError(line, false); err != ErrNotStored {
+			return initial, err
+		}
+	}
+}
+
+// incrDecrQ pipelines an incr or decr for each key, then adds the keys
+// which were missing, and updates again those another client added in
+// the meantime.
+func (textCodec) incrDecrQ(cn *poolConn, req *request, cmd command, keys []string, delta, initial uint64, expiration uint32) ([]error, error) {
+	var errs []error
+	setErr := func(ii int, err error) {
+		if errs == nil {
+			errs = make([]error, len(keys))
+		}
+		errs[ii] = err
+	}
+	name := incrDecrName(cmd)
+	var pending []int
+	for ii, key := range keys {
+		if legalKey(key) {
+			pending = append(pending, ii)
+		} else {
+			setErr(ii, ErrMalformedKey)
+		}
+	}
+
+	var missing []int
+	incr := func(sent func()) error {
+		var buf bytes.Buffer
+		for _, ii := range pending {
+			writeIncrDecr(&buf, name, keys[ii], delta)
+		}
+		if _, err := cn.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		sent()
+		missing = missing[:0]
+		for _, ii := range pending {
+			_, err := readIncrDecr(cn)
+			switch {
+			case err == ErrCacheMiss && expiration != noAutoCreate:
+				missing = append(missing, ii)
+			case resumableError(err):
+				if err != nil {
+					setErr(ii, err)
+				}
+			default:
+				return err
+			}
+		}
+		return nil
+	}
+	if len(pending) == 0 {
+		return errs, nil
+	}
+	if err := incr(req.sent); err != nil {
+		return nil, err
+	}
+	if len(missing) == 0 {
+		return errs, nil
+	}
+
+	var buf bytes.Buffer
+	value := []byte(strconv.FormatUint(initial, 10))
+	for _, ii := range missing {
+		writeStorage(&buf, "add", keys[ii], 0, expiration, value, 0)
+	}
+	if err := writeText(cn, req, &buf); err != nil {
+		return nil, err
+	}
+	pending = pending[:0]
+	for _, ii := range missing {
+		line, err := readLine(cn.reader())
+		if err != nil {
+			return nil, err
+		}
+		switch err := storageError(line, false); {
+		case err == ErrNotStored:
+			pending = append(pending, ii)
+		case resumableError(err):
+			if err != nil {
+				setErr(ii, err)
+			}
+		default:
+			return nil, err
+		}
+	}
+	if len(pending) == 0 {
+		return errs, nil
+	}
+	// Keys which are missing again aren't retried.
+	if err := incr(func() {}); err != nil {
+		return nil, err
+	}
+	for _, ii := range missing {
+		setErr(ii, ErrCacheMiss)
+	}
+	return errs, nil
+}
+
+func (textCodec) flush(cn *poolConn, req *request, expiration int) error {
+	var buf bytes.Buffer
+	buf.WriteString("flush_all")
+	if expiration > 0 {
+		buf.WriteString(" " + strconv.Itoa(expiration))
+	}
+	buf.WriteString("\r\n")
+	if err := writeText(cn, req, &buf); err != nil {
+		return err
+	}
+	line, err := readLine(cn.reader())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(line, textOK) {
+		return textError(line)
+	}
+	return nil
+}
+
+func (textCodec) stats(cn *poolConn, req *request) (map[string]string, error) {
+	var buf bytes.Buffer
+	buf.WriteString("stats\r\n")
+	if err := writeText(cn, req, &buf); err != nil {
+		return nil, err
+	}
+	stats := make(map[string]string)
+	r := cn.reader()
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(line, textEnd) {
+			return stats, nil
+		}
+		if !bytes.HasPrefix(line, textStat) {
+			return nil, textError(line)
+		}
+		// STAT <name> <value>, where the value may contain spaces.
+		kv := bytes.SplitN(line[len(textStat):], []byte(" "), 2)
+		if len(kv) != 2 {
+			return nil, protocolError("malformed stat line %q", line)
+		}
+		stats[string(kv[0])] = string(kv[1])
+	}
+}
+
+// noop sends a version command, the cheapest one answered by the text
+// protocol.
+func (textCodec) noop(cn *poolConn) error {
+	if _, err := cn.Write([]byte("version\r\n")); err != nil {
+		return err
+	}
+	line, err := readLine(cn.reader())
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(line, textVersion) {
+		return textError(line)
+	}
+	return nil
+}
+
+// authenticateText authenticates cn with a set of the user and password,
+// as understood by memcached 1.5.15+ started with an authentication file.
+func authenticateText(cn net.Conn, creds Credentials) error {
+	var buf bytes.Buffer
+	writeStorage(&buf, "set", "auth", 0, 0, []byte(creds.User+" "+creds.Password), 0)
+	if _, err := cn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	// Nothing else is read from cn before the answer, so it can be
+	// buffered by a reader of its own.
+	line, err := readLine(bufio.NewReader(cn))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(line, textStored) {
+		return fmt.Errorf("memcache: text protocol authentication failed: %w", textError(line))
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package memcache
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// tlsConfig returns the TLS configuration for connections to the server,
+// or nil if TLS is disabled. Client certificates configured through
+// TLSCertFile and TLSKeyFile are loaded once, when the pool is created.
+func (c Config) tlsConfig() (*tls.Config, error) {
+	if c.TLSConfig == nil && c.TLSCertFile == "" {
+		return nil, nil
+	}
+	var config *tls.Config
+	if c.TLSConfig != nil {
+		config = c.TLSConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if c.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(c.Server); err == nil {
+			config.ServerName = host
+		}
+	}
+	return config, nil
+}
+
+// tlsHandshakeTimeout returns the maximum duration of a TLS handshake,
+// defaulting to the connection timeout.
+func (c Config) tlsHandshakeTimeout() time.Duration {
+	if c.TLSHandshakeTimeout > 0 {
+		return c.TLSHandshakeTimeout
+	}
+	return c.ConnectionTimeout
+}
+
+// tlsClient wraps conn in a TLS client connection and performs the
+// handshake, giving up after timeout if it's positive. conn is closed
+// if the handshake fails.
+func tlsClient(conn net.Conn, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	tlsConn := tls.Client(conn, config)
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return tlsConn, nil
+}
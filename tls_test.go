@@ -0,0 +1,270 @@
+package memcache
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// newTestCert creates a certificate for name signed by parent, or a self
+// signed CA certificate if parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// startTLSServer starts a TLS-terminating stand-in for memcached,
+// serving connections with serveStubConn.
+func startTLSServer(t *testing.T, config *tls.Config) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			cn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveStubConn(cn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// serveStubConn answers every get on cn with the value "tls", every
+// counter update with 1 and every other command with an empty success
+// response. Quiet commands succeed silently, so their misses aren't
+// answered either.
+func serveStubConn(cn net.Conn) {
+	defer cn.Close()
+	for {
+		hdr := make([]byte, 24)
+		if _, err := io.ReadFull(cn, hdr); err != nil {
+			return
+		}
+		if _, err := io.CopyN(io.Discard, cn, int64(bUint32(hdr[8:12]))); err != nil {
+			return
+		}
+		switch hdr[1] {
+		case cmdGetQ, cmdGetKQ, cmdSetQ, cmdAddQ, cmdReplaceQ, cmdDeleteQ, cmdIncrementQ,
+			cmdDecrementQ, cmdQuitQ, cmdFlushQ, cmdAppendQ, cmdPrependQ:
+			continue
+		}
+		resp := make([]byte, 24)
+		resp[0] = respMagic
+		resp[1] = hdr[1]
+		copy(resp[12:16], hdr[12:16])
+		if hdr[1] == cmdGet {
+			resp[4] = 4
+			putUint32(resp[8:12], 4+3)
+			resp = append(resp, 0, 0, 0, 0)
+			resp = append(resp, "tls"...)
+		}
+		if hdr[1] == cmdIncr || hdr[1] == cmdDecr {
+			putUint32(resp[8:12], 8)
+			resp = append(resp, 0, 0, 0, 0, 0, 0, 0, 1)
+		}
+		if _, err := cn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	serverCert := newTestCert(t, "127.0.0.1", ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	addr := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCertificate(t)},
+	})
+	c, err := New([]Config{{
+		Server:            addr,
+		MaxIdle:           1,
+		MaxCap:            1,
+		ConnectionTimeout: time.Second,
+		TLSConfig:         &tls.Config{RootCAs: roots},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Set(&Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatalf("Set over TLS: %v", err)
+	}
+	it, err := c.Get("foo")
+	if err != nil {
+		t.Fatalf("Get over TLS: %v", err)
+	}
+	if string(it.Value) != "tls" {
+		t.Errorf("Get over TLS = %q, want tls", it.Value)
+	}
+
+	// Without the CA the server certificate must be rejected.
+	c, err = New([]Config{{
+		Server:            addr,
+		MaxIdle:           1,
+		MaxCap:            1,
+		ConnectionTimeout: time.Second,
+		TLSConfig:         &tls.Config{},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Set(&Item{Key: "foo", Value: []byte("bar")}); err == nil {
+		t.Fatal("Set with untrusted server certificate: want error, got nil")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	serverCert := newTestCert(t, "127.0.0.1", ca)
+	clientCert := newTestCert(t, "client", ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, clientCert.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, clientCert.keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCertificate(t)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	})
+	config := Config{
+		Server:            addr,
+		MaxIdle:           1,
+		MaxCap:            1,
+		ConnectionTimeout: time.Second,
+		TLSConfig:         &tls.Config{RootCAs: roots},
+		TLSCertFile:       certFile,
+		TLSKeyFile:        keyFile,
+	}
+	c, err := New([]Config{config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Set(&Item{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatalf("Set with client certificate: %v", err)
+	}
+
+	config.TLSCertFile, config.TLSKeyFile = "", ""
+	c, err = New([]Config{config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Set(&Item{Key: "foo", Value: []byte("bar")}); err == nil {
+		t.Fatal("Set without client certificate: want error, got nil")
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	// A plain TCP listener which never answers the handshake.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			cn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer cn.Close()
+		}
+	}()
+
+	start := time.Now()
+	_, err = New([]Config{{
+		Server:              l.Addr().String(),
+		InitialCap:          1,
+		MaxIdle:             1,
+		MaxCap:              1,
+		ConnectionTimeout:   time.Second,
+		TLSConfig:           &tls.Config{InsecureSkipVerify: true},
+		TLSHandshakeTimeout: 50 * time.Millisecond,
+	}})
+	if err == nil {
+		t.Fatal("New with stalled TLS handshake: want error, got nil")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("stalled TLS handshake took %v, want about 50ms", d)
+	}
+}
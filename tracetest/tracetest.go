@@ -0,0 +1,126 @@
+// Package tracetest provides an in-memory memcache.Tracer which records
+// the spans created by a Client, for use in tests.
+package tracetest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dev-lazarev/memcache"
+)
+
+// Span is a span recorded by a Recorder.
+type Span struct {
+	// Name is the name the span was started with.
+	Name string
+
+	// Parent is the span found in the context the span was started
+	// with, or nil if there was none.
+	Parent *Span
+
+	// Attributes holds the attributes set on the span. Setting an
+	// attribute twice keeps the last value.
+	Attributes map[string]interface{}
+
+	// Errors holds the errors recorded on the span.
+	Errors []error
+
+	// Ended is set once the span has been ended.
+	Ended bool
+
+	r *Recorder
+}
+
+// SetAttributes implements memcache.Span.
+func (s *Span) SetAttributes(attrs ...memcache.Attribute) {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	for _, attr := range attrs {
+		s.Attributes[attr.Key] = attr.Value
+	}
+}
+
+// RecordError implements memcache.Span.
+func (s *Span) RecordError(err error) {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	s.Errors = append(s.Errors, err)
+}
+
+// End implements memcache.Span.
+func (s *Span) End() {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	s.Ended = true
+}
+
+// Recorder is a memcache.Tracer keeping every span it starts in memory.
+// The zero value is ready to use.
+type Recorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of ctx holding span, so spans started
+// from it become its children.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span held by ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Start implements memcache.Tracer.
+func (r *Recorder) Start(ctx context.Context, name string) (context.Context, memcache.Span) {
+	span := r.start(ctx, name)
+	return ContextWithSpan(ctx, span), span
+}
+
+// StartRoot starts a span which isn't created by a Client, to be used
+// as the parent of Client spans, and returns a context holding it.
+func (r *Recorder) StartRoot(ctx context.Context, name string) (context.Context, *Span) {
+	span := r.start(ctx, name)
+	return ContextWithSpan(ctx, span), span
+}
+
+func (r *Recorder) start(ctx context.Context, name string) *Span {
+	span := &Span{
+		Name:       name,
+		Parent:     SpanFromContext(ctx),
+		Attributes: make(map[string]interface{}),
+		r:          r,
+	}
+	r.mu.Lock()
+	r.spans = append(r.spans, span)
+	r.mu.Unlock()
+	return span
+}
+
+// Spans returns copies of the spans started so far, in order. The Parent
+// fields point to the recorded spans rather than to the copies.
+func (r *Recorder) Spans() []Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	spans := make([]Span, len(r.spans))
+	for i, span := range r.spans {
+		spans[i] = *span
+		spans[i].Attributes = make(map[string]interface{}, len(span.Attributes))
+		for k, v := range span.Attributes {
+			spans[i].Attributes[k] = v
+		}
+		spans[i].Errors = append([]error(nil), span.Errors...)
+	}
+	return spans
+}
+
+// Reset forgets the spans recorded so far.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	r.spans = nil
+	r.mu.Unlock()
+}
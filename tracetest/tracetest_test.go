@@ -0,0 +1,40 @@
+package tracetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dev-lazarev/memcache"
+)
+
+var _ memcache.Tracer = (*Recorder)(nil)
+
+func TestRecorder(t *testing.T) {
+	var r Recorder
+	ctx, root := r.StartRoot(context.Background(), "handler")
+	ctx, span := r.Start(ctx, "memcache.get")
+	span.SetAttributes(memcache.Attribute{Key: memcache.AttrKeyCount, Value: 1})
+	span.RecordError(errors.New("boom"))
+	span.End()
+	_, child := r.Start(ctx, "memcache.get.server")
+	child.End()
+
+	spans := r.Spans()
+	if len(spans) != 3 {
+		t.Fatalf("recorded %d spans, want 3", len(spans))
+	}
+	if spans[0].Parent != nil || spans[0].Ended {
+		t.Errorf("root span = %+v", spans[0])
+	}
+	if spans[1].Parent != root || spans[1].Attributes[memcache.AttrKeyCount] != 1 || len(spans[1].Errors) != 1 || !spans[1].Ended {
+		t.Errorf("client span = %+v", spans[1])
+	}
+	if spans[2].Parent == nil || spans[2].Parent.Name != "memcache.get" {
+		t.Errorf("child span parent = %+v", spans[2].Parent)
+	}
+	r.Reset()
+	if len(r.Spans()) != 0 {
+		t.Error("Reset kept the recorded spans")
+	}
+}
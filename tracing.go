@@ -0,0 +1,77 @@
+package memcache
+
+import "context"
+
+// Tracer creates spans for Client operations. Its shape follows
+// OpenTelemetry's trace.Tracer, so an adapter over an OpenTelemetry
+// tracer is a few lines long:
+//
+//	type otelTracer struct{ trace.Tracer }
+//
+//	func (t otelTracer) Start(ctx context.Context, name string) (context.Context, memcache.Span) {
+//		ctx, span := t.Tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+//		return ctx, otelSpan{span}
+//	}
+//
+// Parent spans are taken from the context given to the Context variants
+// of the Client methods, such as GetContext.
+type Tracer interface {
+	// Start starts a span named name, as a child of the span in ctx if
+	// there's one, and returns a context holding the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is an operation traced by a Tracer.
+type Span interface {
+	// SetAttributes sets the given attributes on the span.
+	SetAttributes(attrs ...Attribute)
+
+	// RecordError records err as an exception event on the span and
+	// marks it as failed.
+	RecordError(err error)
+
+	// End completes the span.
+	End()
+}
+
+// Attribute is a key/value pair describing a span. Value is either a
+// string, an int or a bool.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Attribute keys set on the spans, following the OpenTelemetry semantic
+// conventions where there's one.
+const (
+	AttrDBSystem    = "db.system"
+	AttrDBOperation = "db.operation"
+	AttrServer      = "server.address"
+	AttrKeyCount    = "db.memcached.key_count"
+	AttrHits        = "db.memcached.hits"
+	AttrMisses      = "db.memcached.misses"
+	AttrBytes       = "db.memcached.bytes"
+)
+
+// spanPrefix is prepended to the operation names to build span names.
+const spanPrefix = "memcache."
+
+// startSpan starts a span for an operation which may involve several
+// servers. It must only be called if c.Tracer is set.
+func (c *Client) startSpan(ctx context.Context, name, op string, keys int) (context.Context, Span) {
+	ctx, span := c.Tracer.Start(ctx, name)
+	span.SetAttributes(
+		Attribute{AttrDBSystem, "memcached"},
+		Attribute{AttrDBOperation, op},
+		Attribute{AttrKeyCount, keys},
+	)
+	return ctx, span
+}
+
+// endSpan records err on span, unless it's a cache miss, and ends it.
+func endSpan(span Span, err error) {
+	if err != nil && err != ErrCacheMiss {
+		span.RecordError(err)
+	}
+	span.End()
+}
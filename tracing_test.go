@@ -0,0 +1,119 @@
+package memcache
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testSpan struct {
+	name   string
+	parent *testSpan
+	attrs  map[string]interface{}
+	errs   []error
+	ended  bool
+}
+
+func (s *testSpan) SetAttributes(attrs ...Attribute) {
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *testSpan) RecordError(err error) { s.errs = append(s.errs, err) }
+func (s *testSpan) End()                  { s.ended = true }
+
+type testSpanKey struct{}
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(testSpanKey{}).(*testSpan)
+	span := &testSpan{name: name, parent: parent, attrs: make(map[string]interface{})}
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return context.WithValue(ctx, testSpanKey{}, span), span
+}
+
+func TestTracer(t *testing.T) {
+	c := newStubClient(t, Config{MaxIdle: 1, MaxCap: 1})
+	tracer := &testTracer{}
+	c.Tracer = tracer
+	root := &testSpan{name: "root"}
+	ctx := context.WithValue(context.Background(), testSpanKey{}, root)
+
+	if _, err := c.GetContext(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetMultiContext(ctx, []string{"a", "b", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetContext(ctx, &Item{Key: "foo", Value: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if err := c.DeleteContext(ctx, "foo"); err != ErrClientClosed {
+		t.Fatalf("DeleteContext after Close = %v, want %v", err, ErrClientClosed)
+	}
+
+	want := []struct {
+		name   string
+		parent string
+		attrs  map[string]interface{}
+	}{
+		{"memcache.get", "root", map[string]interface{}{AttrDBSystem: "memcached", AttrDBOperation: OpGet, AttrServer: "stub:11211", AttrKeyCount: 1, AttrHits: 1, AttrMisses: 0, AttrBytes: 3}},
+		{"memcache.get_multi", "root", map[string]interface{}{AttrDBSystem: "memcached", AttrDBOperation: OpGetMulti, AttrKeyCount: 3, AttrHits: 0, AttrMisses: 3}},
+		{"memcache.get_multi.server", "memcache.get_multi", map[string]interface{}{AttrDBSystem: "memcached", AttrDBOperation: OpGetMulti, AttrServer: "stub:11211", AttrKeyCount: 3, AttrHits: 0, AttrMisses: 3}},
+		{"memcache.set", "root", map[string]interface{}{AttrDBSystem: "memcached", AttrDBOperation: OpSet, AttrServer: "stub:11211", AttrKeyCount: 1, AttrBytes: 5}},
+		{"memcache.delete", "root", map[string]interface{}{AttrDBSystem: "memcached", AttrDBOperation: OpDelete, AttrServer: "stub:11211", AttrKeyCount: 1}},
+	}
+	if len(tracer.spans) != len(want) {
+		t.Fatalf("recorded %d spans, want %d", len(tracer.spans), len(want))
+	}
+	for i, span := range tracer.spans {
+		w := want[i]
+		if span.name != w.name || span.parent == nil || span.parent.name != w.parent || !span.ended {
+			t.Errorf("span %d = %s (parent %v, ended %v), want %s child of %s", i, span.name, span.parent, span.ended, w.name, w.parent)
+		}
+		if len(span.attrs) != len(w.attrs) {
+			t.Errorf("span %s attributes = %v, want %v", span.name, span.attrs, w.attrs)
+		}
+		for k, v := range w.attrs {
+			if span.attrs[k] != v {
+				t.Errorf("span %s attribute %s = %v, want %v", span.name, k, span.attrs[k], v)
+			}
+		}
+	}
+	if errs := tracer.spans[4].errs; len(errs) != 1 || errs[0] != ErrClientClosed {
+		t.Errorf("delete span errors = %v, want %v", errs, ErrClientClosed)
+	}
+}
+
+func TestContextDeadline(t *testing.T) {
+	c := newStubClient(t, Config{MaxIdle: 1, MaxCap: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := c.GetContext(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	// The connection is reused without the deadline of the first request.
+	cn, err := c.getConnection(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn.hasDeadline {
+		t.Error("returned connection kept the request deadline")
+	}
+	c.putConnection(0, cn)
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Millisecond))
+	defer cancel()
+	if _, err := c.GetContext(ctx, "foo"); err != context.DeadlineExceeded {
+		t.Errorf("GetContext with expired context = %v, want %v", err, context.DeadlineExceeded)
+	}
+}